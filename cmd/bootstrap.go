@@ -21,12 +21,12 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"github.com/randyridgley/simple-go-iot-device/config"
-	"github.com/randyridgley/simple-go-iot-device/device"
 	"github.com/randyridgley/simple-go-iot-device/device/connect"
 	"github.com/randyridgley/simple-go-iot-device/device/provision"
 	// "github.com/randyridgley/simple-go-iot-device/device/shadow"
@@ -34,6 +34,8 @@ import (
 
 var configuration config.Configurations
 
+var provisionTimeout time.Duration
+
 type sampleStruct struct {
 	Values []int
 }
@@ -54,7 +56,8 @@ Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx, _ := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
 		err := viper.Unmarshal(&configuration)
 		if err != nil {
@@ -64,22 +67,14 @@ to quickly create a Cobra application.`,
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt)
 
-		thingConfig := device.ThingConfiguration{
-			ThingName:            configuration.ThingName,
-			DeviceLocation:       configuration.DeviceLocation,
-			SerialNumber:         configuration.SerialNumber,
-			ProvisioningTemplate: configuration.Bootstrap.ProvisioningTemplate,
-			Endpoint:             configuration.Server.Endpoint,
-			Port:                 configuration.Server.Port,
-		}
-
-		thing, err := device.New(thingConfig)
+		thing, err := newThing()
 		check(err)
 
 		go func() {
 			<-c
 			// add full cleanup here
 			// thing.Cleanup()
+			cancel()
 			thing.Connection.Disconnect(250)
 			fmt.Println("[MQTT] Disconnected")
 			quit <- struct{}{}
@@ -99,29 +94,26 @@ to quickly create a Cobra application.`,
 				panic(err)
 			}
 
-			// $aws/certificates/create/json
-			// $aws/certificates/create/json/accepted or $aws/certificates/create/json/rejected
-			// publish thing
-			// accepted or rejected
-			p.Provision(ctx)
+			provisionCtx, cancel := context.WithTimeout(ctx, provisionTimeout)
+			err = p.Provision(provisionCtx)
+			cancel()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
 		}
 
 		fmt.Println("Starting up thing on own channel")
-		keyPair := connect.KeyPair{
-			PrivateKeyPath:    configuration.Primary.PrivateKeyPath,
-			CertificatePath:   configuration.Primary.CertificatePath,
-			CACertificatePath: configuration.Bootstrap.CACertificatePath, //Bootstrap and Primary are same CA
-		}
-
-		fmt.Printf("%s\n", keyPair.CertificatePath)
-		fmt.Printf("%s\n", keyPair.PrivateKeyPath)
-		thing.Connect(keyPair)
+		keyPair, err := thing.KeyPair(configuration.Bootstrap.CACertificatePath) //Bootstrap and Primary are same CA
+		check(err)
+		check(thing.Connect(keyPair))
 
 		// register device shadow
 		// startup and services and topic subscriptions
-		payload := "{\"let-me\": \"in\"}"
-		thing.Connection.Publish("fleet/2974685", payload)
-		fmt.Println("Published message")
+		publisher, err := newPublisher(thing)
+		check(err)
+		go publisher.Run(ctx)
+		fmt.Println("Publishing telemetry")
 
 		// s, err := shadow.New(ctx, *thing)
 		// if err != nil {
@@ -173,6 +165,8 @@ to quickly create a Cobra application.`,
 func init() {
 	rootCmd.AddCommand(bootstrapCmd)
 
+	bootstrapCmd.Flags().DurationVar(&provisionTimeout, "provision-timeout", 5*time.Minute, "time allowed for provisioning the thing")
+
 	// Here you will define your flags and configuration settings.
 
 	// Cobra supports Persistent Flags which will work for this command
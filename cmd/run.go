@@ -16,36 +16,248 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+	"github.com/randyridgley/simple-go-iot-device/device/jobs"
+	"github.com/randyridgley/simple-go-iot-device/device/ota"
+	"github.com/randyridgley/simple-go-iot-device/device/rotation"
+	"github.com/randyridgley/simple-go-iot-device/device/shadow"
+)
+
+// Exit codes reported by the run command so a service manager can decide
+// whether restarting the device makes sense.
+const (
+	exitOK          = 0
+	exitFailure     = 1  // a supervised service failed
+	exitUnavailable = 69 // the AWS IoT endpoint could not be reached or the connection gave up
+	exitTempFail    = 75 // services did not drain before the deadline
+	exitConfig      = 78 // configuration is invalid or the thing is not provisioned
 )
 
+var drainTimeout time.Duration
+
 // runCmd represents the run command
 var runCmd = &cobra.Command{
 	Use:   "run",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "Run the provisioned device until it is told to stop",
+	Long: `Run connects the device to AWS IoT with its primary certificate,
+attaches the thing shadow and starts the device services. It keeps running
+until SIGINT or SIGTERM is received and then drains the services before
+disconnecting.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+The process exits with 0 on a clean shutdown, 1 if a service failed,
+69 if the endpoint could not be reached or the connection gave up
+reconnecting, 75 if services did not stop within
+the drain timeout and 78 if the configuration is unusable.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("run called")
+		os.Exit(run())
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(runCmd)
 
-	// Here you will define your flags and configuration settings.
+	runCmd.Flags().DurationVar(&drainTimeout, "drain-timeout", 10*time.Second, "time allowed for services to stop on shutdown")
+}
+
+func run() int {
+	if err := viper.Unmarshal(&configuration); err != nil {
+		fmt.Printf("Unable to decode into struct, %v\n", err)
+		return exitConfig
+	}
+
+	thing, err := newThing()
+	if err != nil {
+		fmt.Println(err)
+		return exitConfig
+	}
+	keyPair := connect.KeyPair{CACertificatePath: configuration.Bootstrap.CACertificatePath}
+	if thing.UsesCertificate() {
+		if !thing.IsProvisioned() {
+			fmt.Println("Thing is not provisioned, run the bootstrap command first.")
+			return exitConfig
+		}
+
+		keyPair, err = thing.KeyPair(configuration.Bootstrap.CACertificatePath) //Bootstrap and Primary are same CA
+		if err != nil {
+			fmt.Println(err)
+			return exitConfig
+		}
+	}
+	if err := thing.Connect(keyPair); err != nil {
+		fmt.Println(err)
+		return exitUnavailable
+	}
+	// The publisher copies the thing, so it is created once the thing has
+	// its connection.
+	publisher, err := newPublisher(thing)
+	if err != nil {
+		fmt.Println(err)
+		thing.Connection.Disconnect(250)
+		return exitConfig
+	}
+
+	gaveUp := watchConnection(thing.Connection)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	sup := device.NewSupervisor(context.Background())
+
+	s, err := shadow.New(context.Background(), *thing)
+	if err != nil {
+		fmt.Println(err)
+		thing.Connection.Disconnect(250)
+		return exitUnavailable
+	}
+	sup.Go("shadow", func(ctx context.Context) error {
+		return runShadow(ctx, s)
+	})
+	shadows := shadow.NewManager(*thing)
+	for _, name := range configuration.NamedShadows {
+		named, err := shadows.Open(context.Background(), name)
+		if err != nil {
+			fmt.Println(err)
+			thing.Connection.Disconnect(250)
+			return exitConfig
+		}
+		sup.Go("shadow/"+name, func(ctx context.Context) error {
+			return runShadow(ctx, named)
+		})
+	}
+	publisher.OnError(func(err error) {
+		fmt.Printf("telemetry error: %v\n", err)
+	})
+	sup.Go("telemetry", publisher.Run)
+	var rotator *rotation.Rotator
+	if configuration.Rotation.Enabled && thing.UsesCertificate() {
+		rotator = rotation.New(*thing, rotation.Configuration{
+			RenewBefore:       configuration.Rotation.RenewBefore,
+			CheckInterval:     configuration.Rotation.CheckInterval,
+			CACertificatePath: configuration.Bootstrap.CACertificatePath,
+			RetireRule:        configuration.Rotation.RetireRule,
+		})
+		sup.Go("rotation", rotator.Run)
+	}
+	if configuration.Jobs.Enabled {
+		j, err := jobs.New(context.Background(), *thing)
+		if err != nil {
+			fmt.Println(err)
+			thing.Connection.Disconnect(250)
+			return exitUnavailable
+		}
+		j.OnError(func(err error) {
+			fmt.Printf("jobs error: %v\n", err)
+		})
+		if configuration.OTA.Enabled {
+			agent, err := ota.New(*thing, ota.Configuration{
+				StagingDirectory:           configuration.OTA.StagingDirectory,
+				CodeSigningCertificatePath: configuration.OTA.CodeSigningCertificatePath,
+				AllowUnsigned:              configuration.OTA.AllowUnsigned,
+				BlockSize:                  configuration.OTA.BlockSize,
+			})
+			if err != nil {
+				fmt.Println(err)
+				thing.Connection.Disconnect(250)
+				return exitConfig
+			}
+			j.Handle(jobs.OperationOTA, agent.Handle)
+		}
+		if rotator != nil {
+			j.Handle(rotation.Operation, rotator.Handle)
+		}
+		sup.Go("jobs", j.Run)
+	}
+
+	code := exitOK
+	select {
+	case sig := <-signals:
+		fmt.Printf("Received %v, shutting down\n", sig)
+	case err := <-gaveUp:
+		fmt.Printf("Connection lost for good (%v), shutting down\n", err)
+		code = exitUnavailable
+	case <-sup.Done():
+	}
+	sup.Stop()
+
+	go func() {
+		// A second signal skips the drain.
+		<-signals
+		os.Exit(exitFailure)
+	}()
+
+	switch err := sup.Wait(drainTimeout); {
+	case err == nil:
+	case err == device.ErrDrainTimeout:
+		fmt.Println(err)
+		if code == exitOK {
+			code = exitTempFail
+		}
+	case code == exitOK:
+		code = exitFailure
+	}
+
+	thing.Connection.Disconnect(250)
+	fmt.Println("[MQTT] Disconnected")
+	return code
+}
+
+// watchConnection logs the state changes and errors of conn. The returned
+// channel receives the error of conn giving up reconnecting, after which
+// the device services cannot continue.
+func watchConnection(conn connect.Connection) <-chan error {
+	gaveUp := make(chan error, 1)
+	conn.OnStateChange(func(ev connect.Event) {
+		if ev.Err != nil {
+			fmt.Printf("[MQTT] %s: %v\n", ev.State, ev.Err)
+			if ev.State == connect.StateDisconnected && errors.Is(ev.Err, connect.ErrReconnectFailed) {
+				select {
+				case gaveUp <- ev.Err:
+				default:
+				}
+			}
+			return
+		}
+		fmt.Printf("[MQTT] %s\n", ev.State)
+	})
+	conn.OnError(func(err error) {
+		fmt.Printf("connection error: %v\n", err)
+	})
+	return gaveUp
+}
+
+// runShadow fetches the current shadow document and logs deltas until ctx
+// is cancelled.
+func runShadow(ctx context.Context, s shadow.Shadow) error {
+	s.OnError(func(err error) {
+		fmt.Printf("shadow error: %v\n", err)
+	})
+	s.OnDelta(func(delta map[string]interface{}) {
+		fmt.Printf("shadow delta: %+v\n", delta)
+	})
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// runCmd.PersistentFlags().String("foo", "", "A help for foo")
+	getCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	doc, err := s.Get(getCtx)
+	cancel()
+	if err != nil {
+		// A thing without a shadow document is rejected with 404.
+		fmt.Printf("getting shadow document: %v\n", err)
+	} else {
+		fmt.Printf("shadow document: %+v\n", doc)
+	}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// runCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	<-ctx.Done()
+	return nil
 }
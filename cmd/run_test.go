@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+	"github.com/randyridgley/simple-go-iot-device/device/connect/connecttest"
+)
+
+func TestWatchConnectionGiveUp(t *testing.T) {
+	broker := connecttest.NewBroker()
+	conn := broker.Connection("thing-1")
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	gaveUp := watchConnection(conn)
+
+	// A lost connection that is still reconnecting is not fatal.
+	broker.Drop(nil)
+	select {
+	case err := <-gaveUp:
+		t.Fatalf("gave up with %v while reconnecting", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn.GiveUp()
+	select {
+	case err := <-gaveUp:
+		if !errors.Is(err, connect.ErrReconnectFailed) {
+			t.Errorf("gave up with %v, want %v", err, connect.ErrReconnectFailed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("giving up reconnecting was not reported")
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright © 2020 Randy Ridgley randy.ridgley@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/config"
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/codec"
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+	"github.com/randyridgley/simple-go-iot-device/device/telemetry"
+)
+
+const (
+	defaultTelemetryInterval = 30 * time.Second
+	defaultTelemetryTopic    = "fleet/{serialNumber}"
+	heartbeatStream          = "heartbeat"
+)
+
+// newPublisher creates the telemetry publisher of thing with the
+// configured streams, or the heartbeat stream if none are configured.
+func newPublisher(thing *device.Thing) (telemetry.Publisher, error) {
+	streams := configuration.Telemetry.Streams
+	if len(streams) == 0 {
+		streams = []config.StreamConfigurations{{
+			Name:     heartbeatStream,
+			Topic:    configuration.Telemetry.Topic,
+			Interval: configuration.Telemetry.Interval,
+			Codec:    configuration.Telemetry.Codec,
+		}}
+	}
+
+	p := telemetry.New(*thing)
+	for _, sc := range streams {
+		s, err := newStream(thing, sc)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.Add(s); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func newStream(thing *device.Thing, sc config.StreamConfigurations) (telemetry.Stream, error) {
+	source, err := newSource(thing, sc)
+	if err != nil {
+		return telemetry.Stream{}, fmt.Errorf("stream %s %v", sc.Name, err)
+	}
+	c, err := codec.ByName(sc.Codec)
+	if err != nil {
+		return telemetry.Stream{}, fmt.Errorf("stream %s %v", sc.Name, err)
+	}
+	// None of the configurable sources produce proto.Message values.
+	if c == codec.Protobuf {
+		return telemetry.Stream{}, fmt.Errorf("stream %s: the protobuf codec needs a source of proto.Message values", sc.Name)
+	}
+	s := telemetry.Stream{
+		Name:        sc.Name,
+		Topic:       sc.Topic,
+		Interval:    sc.Interval,
+		Source:      source,
+		Codec:       c,
+		Compression: sc.Compression,
+		Batch: telemetry.Batch{
+			MaxCount: sc.Batch.MaxCount,
+			MaxBytes: sc.Batch.MaxBytes,
+			MaxDelay: sc.Batch.MaxDelay,
+		},
+		BasicIngestRule: sc.BasicIngestRule,
+	}
+	if s.Topic == "" {
+		s.Topic = defaultTelemetryTopic
+	}
+	if s.Interval <= 0 {
+		s.Interval = defaultTelemetryInterval
+	}
+	if sc.QoS != nil {
+		s.PublishOptions = append(s.PublishOptions, connect.WithQoS(*sc.QoS))
+	}
+	return s, nil
+}
+
+// newSource creates the source of the values of a stream.
+func newSource(thing *device.Thing, sc config.StreamConfigurations) (telemetry.Source, error) {
+	c := sc.Source
+	typ := c.Type
+	if typ == "" && sc.Name == heartbeatStream {
+		typ = "heartbeat"
+	}
+	switch typ {
+	case "heartbeat":
+		return telemetry.Heartbeat(thing.Config.SerialNumber), nil
+	case "hostmetrics":
+		return telemetry.HostMetrics(telemetry.HostMetricsConfiguration{
+			ProcPath:   c.ProcPath,
+			Disks:      c.Disks,
+			Interfaces: c.Interfaces,
+		}), nil
+	case "tail":
+		if c.Path == "" {
+			return nil, fmt.Errorf("tail source has no path")
+		}
+		return telemetry.Tail(telemetry.TailConfiguration{
+			Path:      c.Path,
+			FromStart: c.FromStart,
+			MaxLines:  c.MaxLines,
+		}), nil
+	case "command":
+		if len(c.Command) == 0 {
+			return nil, fmt.Errorf("command source has no command")
+		}
+		return telemetry.Command(telemetry.CommandConfiguration{
+			Command: c.Command,
+			Timeout: c.Timeout,
+		}), nil
+	case "synthetic":
+		return telemetry.Synthetic(telemetry.SyntheticConfiguration{
+			Fields: c.Fields,
+			Min:    c.Min,
+			Max:    c.Max,
+			Seed:   c.Seed,
+		}), nil
+	case "":
+		return nil, fmt.Errorf("no source type")
+	default:
+		return nil, fmt.Errorf("unknown source type %q", typ)
+	}
+}
@@ -0,0 +1,214 @@
+/*
+Copyright © 2020 Randy Ridgley randy.ridgley@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/codec"
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+	"github.com/randyridgley/simple-go-iot-device/device/keystore"
+)
+
+// newThing creates the thing described by the loaded configuration.
+func newThing() (*device.Thing, error) {
+	ks, err := keystore.New(keystore.Configuration{
+		Type:      configuration.Keystore.Type,
+		Directory: configuration.Keystore.Directory,
+		KeyFile:   configuration.Keystore.KeyFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := importPrimary(ks); err != nil {
+		return nil, err
+	}
+
+	creds, err := newCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	recording, err := newRecording()
+	if err != nil {
+		return nil, err
+	}
+
+	provisioningCodec, err := codec.ByName(configuration.Bootstrap.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	return device.New(device.ThingConfiguration{
+		ThingName:            configuration.ThingName,
+		DeviceLocation:       configuration.DeviceLocation,
+		SerialNumber:         configuration.SerialNumber,
+		ProvisioningTemplate: configuration.Bootstrap.ProvisioningTemplate,
+		CertificateMode:      configuration.Bootstrap.CertificateMode,
+		KeyAlgorithm:         configuration.Bootstrap.KeyAlgorithm,
+		ProvisioningCodec:    provisioningCodec,
+		Endpoint:             configuration.Server.Endpoint,
+		Port:                 configuration.Server.Port,
+		Transport:            configuration.Server.Transport,
+		Region:               configuration.Server.Region,
+		Credentials:          creds,
+		ALPN:                 configuration.Server.ALPN,
+		Fallback:             configuration.Server.Fallback,
+		Authorizer:           newAuthorizer(),
+		ProtocolVersion:      configuration.Server.ProtocolVersion,
+		TopicAliasMaximum:    configuration.Server.TopicAliasMaximum,
+		Will:                 newWill(),
+		KeepAlive:            configuration.Server.KeepAlive,
+		CleanSession:         configuration.Server.CleanSession,
+		Keystore:             ks,
+		Recording:            recording,
+		Reconnect: connect.ReconnectPolicy{
+			InitialInterval: configuration.Server.Reconnect.InitialInterval,
+			MaxInterval:     configuration.Server.Reconnect.MaxInterval,
+			Multiplier:      configuration.Server.Reconnect.Multiplier,
+			MaxAttempts:     configuration.Server.Reconnect.MaxAttempts,
+			ConnectTimeout:  configuration.Server.Reconnect.ConnectTimeout,
+		},
+		Queue: connect.QueueConfiguration{
+			Directory:   configuration.Queue.Directory,
+			MaxMessages: configuration.Queue.MaxMessages,
+			MaxBytes:    configuration.Queue.MaxBytes,
+			DropPolicy:  configuration.Queue.DropPolicy,
+			TTL:         configuration.Queue.TTL,
+		},
+	})
+}
+
+// newCredentials creates the AWS credentials provider for websocket
+// connections. It returns nil for certificate based transports.
+func newCredentials() (connect.CredentialsProvider, error) {
+	c := configuration.Server.Credentials
+	switch configuration.Server.Transport {
+	case "", connect.TransportMQTTS:
+		return nil, nil
+	}
+	switch c.Source {
+	case "", "env":
+		return connect.EnvCredentials(), nil
+	case "static":
+		return connect.StaticCredentials(connect.Credentials{
+			AccessKeyID:     c.AccessKeyID,
+			SecretAccessKey: c.SecretAccessKey,
+			SessionToken:    c.SessionToken,
+		}), nil
+	case "file":
+		return connect.FileCredentials(c.File, c.Profile), nil
+	default:
+		return nil, fmt.Errorf("unknown credentials source %q", c.Source)
+	}
+}
+
+// newAuthorizer returns the custom authorizer configuration, or nil if no
+// authorizer is configured.
+func newAuthorizer() *connect.AuthorizerConfiguration {
+	a := configuration.Server.Authorizer
+	if a.Name == "" {
+		return nil
+	}
+	token := connect.StaticToken(connect.AuthorizerToken{
+		Token:     a.Token,
+		Signature: a.Signature,
+	})
+	if a.TokenFile != "" {
+		token = connect.FileToken(a.TokenFile)
+	}
+	return &connect.AuthorizerConfiguration{
+		Name:         a.Name,
+		TokenKeyName: a.TokenKeyName,
+		Username:     a.Username,
+		Password:     a.Password,
+		Token:        token,
+	}
+}
+
+// newWill returns the last will of the connection or nil if no will topic
+// is configured.
+func newWill() *connect.Will {
+	w := configuration.Server.Will
+	if w.Topic == "" {
+		return nil
+	}
+	return &connect.Will{
+		Topic:   w.Topic,
+		Payload: []byte(w.Payload),
+		QoS:     w.QoS,
+		Retain:  w.Retain,
+	}
+}
+
+// importPrimary stores the certificate and private key of the deprecated
+// primary section in the keystore, unless it already holds credentials of
+// the thing. Configurations of unprovisioned devices name files that do
+// not exist yet, so the import is skipped until they do.
+func importPrimary(ks keystore.Keystore) error {
+	primary := configuration.Primary
+	if primary.CertificatePath == "" && primary.PrivateKeyPath == "" {
+		return nil
+	}
+	fmt.Println("primary.certificatepath and primary.privatekeypath are deprecated, credentials are kept in the keystore")
+	if primary.CertificatePath == "" || primary.PrivateKeyPath == "" {
+		return fmt.Errorf("primary.certificatepath and primary.privatekeypath must be set together")
+	}
+	if ks.Exists(configuration.ThingName) {
+		fmt.Printf("Ignoring %s and %s, the keystore holds credentials of %s\n", primary.CertificatePath, primary.PrivateKeyPath, configuration.ThingName)
+		return nil
+	}
+	cert, err := ioutil.ReadFile(primary.CertificatePath)
+	if os.IsNotExist(err) {
+		fmt.Printf("Not importing %s, it does not exist\n", primary.CertificatePath)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading primary certificate %v", err)
+	}
+	key, err := ioutil.ReadFile(primary.PrivateKeyPath)
+	if os.IsNotExist(err) {
+		fmt.Printf("Not importing %s, it does not exist\n", primary.PrivateKeyPath)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading primary private key %v", err)
+	}
+	if err := ks.Store(configuration.ThingName, &keystore.Credentials{CertificatePEM: cert, PrivateKeyPEM: key}); err != nil {
+		return fmt.Errorf("importing primary credentials %v", err)
+	}
+	fmt.Printf("Imported %s and %s into the keystore\n", primary.CertificatePath, primary.PrivateKeyPath)
+	return nil
+}
+
+// newRecording opens the file the MQTT messages are recorded to, or
+// returns nil if recording is off. The file stays open until the process
+// exits.
+func newRecording() (io.Writer, error) {
+	path := configuration.Server.Record
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening recording %v", err)
+	}
+	return f, nil
+}
@@ -15,10 +15,19 @@ limitations under the License.
 */
 package config
 
+import "time"
+
 type Configurations struct {
 	Server         ServerConfigurations
 	Bootstrap      BootstrapConfigurations
+	Keystore       KeystoreConfigurations
 	Primary        PrimaryConfigurations
+	Queue          QueueConfigurations
+	Telemetry      TelemetryConfigurations
+	Jobs           JobsConfigurations
+	OTA            OTAConfigurations
+	Rotation       RotationConfigurations
+	NamedShadows   []string
 	SerialNumber   string
 	DeviceLocation string
 	ThingName      string
@@ -26,8 +35,62 @@ type Configurations struct {
 
 // ServerConfigurations exported
 type ServerConfigurations struct {
-	Port     int
-	Endpoint string
+	Port        int
+	Endpoint    string
+	Transport   string
+	Region      string
+	Credentials CredentialsConfigurations
+	ALPN        bool
+	Fallback    bool
+	Authorizer  AuthorizerConfigurations
+
+	ProtocolVersion   int
+	TopicAliasMaximum uint16
+
+	Will         WillConfigurations
+	KeepAlive    time.Duration
+	CleanSession bool
+	Reconnect    ReconnectConfigurations
+	// Record is a file the MQTT messages of the device are appended to.
+	Record string
+}
+
+// ReconnectConfigurations exported
+type ReconnectConfigurations struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	MaxAttempts     int
+	ConnectTimeout  time.Duration
+}
+
+// WillConfigurations exported
+type WillConfigurations struct {
+	Topic   string
+	Payload string
+	QoS     byte
+	Retain  bool
+}
+
+// AuthorizerConfigurations exported
+type AuthorizerConfigurations struct {
+	Name         string
+	TokenKeyName string
+	Token        string
+	Signature    string
+	TokenFile    string
+	Username     string
+	Password     string
+}
+
+// CredentialsConfigurations exported
+type CredentialsConfigurations struct {
+	Source          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	File            string
+	Profile         string
 }
 
 // BootstrapConfigurations exported
@@ -36,10 +99,113 @@ type BootstrapConfigurations struct {
 	CertificatePath      string
 	CACertificatePath    string
 	ProvisioningTemplate string
+	CertificateMode      string
+	KeyAlgorithm         string
+	// Codec is the payload format of fleet provisioning, json or cbor.
+	Codec string
 }
 
-// BootstrapConfigurations exported
+// KeystoreConfigurations exported
+type KeystoreConfigurations struct {
+	Type      string
+	Directory string
+	KeyFile   string
+}
+
+// PrimaryConfigurations exported. Deprecated: the files are imported into
+// the keystore.
 type PrimaryConfigurations struct {
 	PrivateKeyPath  string
 	CertificatePath string
 }
+
+// QueueConfigurations exported
+type QueueConfigurations struct {
+	Directory   string
+	MaxMessages int
+	MaxBytes    int64
+	DropPolicy  string
+	TTL         time.Duration
+}
+
+// TelemetryConfigurations exported
+type TelemetryConfigurations struct {
+	Topic    string
+	Interval time.Duration
+	// Codec is the payload format: json, cbor or msgpack.
+	Codec string
+	// Streams replace the heartbeat described by Topic, Interval and
+	// Codec when set.
+	Streams []StreamConfigurations
+}
+
+// StreamConfigurations exported
+type StreamConfigurations struct {
+	Name        string
+	Topic       string
+	Interval    time.Duration
+	Codec       string
+	Compression string
+	// QoS defaults to 1.
+	QoS    *byte
+	Batch  BatchConfigurations
+	Source SourceConfigurations
+	// BasicIngestRule publishes to $aws/rules/<rule>/<topic>.
+	BasicIngestRule string
+}
+
+// SourceConfigurations exported
+type SourceConfigurations struct {
+	// Type is heartbeat, hostmetrics, tail, command or synthetic. It
+	// defaults to heartbeat for the stream named heartbeat.
+	Type string
+
+	// hostmetrics
+	ProcPath   string
+	Disks      []string
+	Interfaces []string
+
+	// tail
+	Path      string
+	FromStart bool
+	MaxLines  int
+
+	// command
+	Command []string
+	Timeout time.Duration
+
+	// synthetic
+	Fields []string
+	Min    float64
+	Max    float64
+	Seed   int64
+}
+
+// BatchConfigurations exported
+type BatchConfigurations struct {
+	MaxCount int
+	MaxBytes int
+	MaxDelay time.Duration
+}
+
+// JobsConfigurations exported
+type JobsConfigurations struct {
+	Enabled bool
+}
+
+// OTAConfigurations exported
+type OTAConfigurations struct {
+	Enabled                    bool
+	StagingDirectory           string
+	CodeSigningCertificatePath string
+	AllowUnsigned              bool
+	BlockSize                  int
+}
+
+// RotationConfigurations exported
+type RotationConfigurations struct {
+	Enabled       bool
+	RenewBefore   time.Duration
+	CheckInterval time.Duration
+	RetireRule    string
+}
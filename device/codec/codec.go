@@ -0,0 +1,136 @@
+// Package codec encodes MQTT payloads. JSON and CBOR are the formats of
+// the AWS IoT reserved topics; MessagePack and Protobuf are more compact
+// alternatives for the topics of the device itself.
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec marshals values to payloads and back.
+type Codec interface {
+	// Name identifies the format, e.g. "json". It is the last level of
+	// the AWS IoT topics that support several formats.
+	Name() string
+	// ContentType is the MIME type of the payloads, sent as the MQTT 5
+	// content type.
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON encodes payloads with encoding/json.
+	JSON Codec = jsonCodec{}
+	// CBOR encodes payloads as RFC 8949 CBOR. Struct fields use their
+	// json tags unless they have cbor tags.
+	CBOR Codec = newCBORCodec()
+	// MessagePack encodes payloads as MessagePack. Struct fields use
+	// their json tags.
+	MessagePack Codec = msgpackCodec{}
+	// Protobuf encodes proto.Message values with their own schema. It
+	// fails with ErrNotProtoMessage for other values.
+	Protobuf Codec = protobufCodec{}
+)
+
+// ErrNotProtoMessage is returned by Protobuf for values that are not a
+// proto.Message.
+var ErrNotProtoMessage = errors.New("not a proto.Message")
+
+// ByName returns the codec with name, or JSON if name is empty.
+func ByName(name string) (Codec, error) {
+	switch strings.ToLower(name) {
+	case "", "json":
+		return JSON, nil
+	case "cbor":
+		return CBOR, nil
+	case "msgpack", "messagepack":
+		return MessagePack, nil
+	case "protobuf", "proto":
+		return Protobuf, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) ContentType() string                        { return "application/json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBORCodec() cborCodec {
+	enc, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	// Decode maps of unknown values with string keys, like encoding/json.
+	dec, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return cborCodec{enc: enc, dec: dec}
+}
+
+func (cborCodec) Name() string                                 { return "cbor" }
+func (cborCodec) ContentType() string                          { return "application/cbor" }
+func (c cborCodec) Marshal(v interface{}) ([]byte, error)      { return c.enc.Marshal(v) }
+func (c cborCodec) Unmarshal(data []byte, v interface{}) error { return c.dec.Unmarshal(data, v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string        { return "msgpack" }
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	enc.UseCompactFloats(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string        { return "protobuf" }
+func (protobufCodec) ContentType() string { return "application/x-protobuf" }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T %w", v, ErrNotProtoMessage)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T %w", v, ErrNotProtoMessage)
+	}
+	return proto.Unmarshal(data, m)
+}
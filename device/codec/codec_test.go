@@ -0,0 +1,177 @@
+package codec_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/randyridgley/simple-go-iot-device/device/codec"
+)
+
+type reading struct {
+	Sensor      string            `json:"sensor"`
+	Temperature float64           `json:"temperature"`
+	Count       int               `json:"count,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Time        time.Time         `json:"time"`
+	Ignored     string            `json:"-"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := reading{
+		Sensor:      "probe-1",
+		Temperature: 21.5,
+		Count:       3,
+		Tags:        map[string]string{"room": "lab"},
+		Time:        time.Date(2022, 5, 1, 12, 30, 0, 500, time.UTC),
+		Ignored:     "secret",
+	}
+	for _, c := range []codec.Codec{codec.JSON, codec.CBOR, codec.MessagePack} {
+		t.Run(c.Name(), func(t *testing.T) {
+			data, err := c.Marshal(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out reading
+			if err := c.Unmarshal(data, &out); err != nil {
+				t.Fatal(err)
+			}
+			if !out.Time.Equal(in.Time) {
+				t.Errorf("time %v, want %v", out.Time, in.Time)
+			}
+			// MessagePack decodes times in the local time zone.
+			out.Time = in.Time
+			want := in
+			want.Ignored = ""
+			if !reflect.DeepEqual(out, want) {
+				t.Errorf("round trip %+v, want %+v", out, want)
+			}
+
+			// Fields are named by their json tags, like the JSON payloads.
+			var fields map[string]interface{}
+			if err := c.Unmarshal(data, &fields); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"sensor", "temperature", "count", "tags", "time"} {
+				if _, ok := fields[name]; !ok {
+					t.Errorf("field %s missing from %v", name, fields)
+				}
+			}
+			if len(fields) != 5 {
+				t.Errorf("fields %v", fields)
+			}
+			if fields["sensor"] != "probe-1" {
+				t.Errorf("sensor %#v", fields["sensor"])
+			}
+		})
+	}
+}
+
+func TestOmitEmpty(t *testing.T) {
+	for _, c := range []codec.Codec{codec.JSON, codec.CBOR, codec.MessagePack} {
+		t.Run(c.Name(), func(t *testing.T) {
+			data, err := c.Marshal(reading{Sensor: "probe-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]interface{}
+			if err := c.Unmarshal(data, &fields); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := fields["count"]; ok {
+				t.Errorf("empty count was encoded in %v", fields)
+			}
+			if _, ok := fields["tags"]; ok {
+				t.Errorf("empty tags were encoded in %v", fields)
+			}
+		})
+	}
+}
+
+func TestCBORDecodesStringMaps(t *testing.T) {
+	data, err := codec.CBOR.Marshal(map[string]interface{}{
+		"state": map[string]interface{}{"reported": map[string]interface{}{"on": true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if err := codec.CBOR.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		t.Fatalf("decoded %T, want map[string]interface{}", v)
+	}
+	state, ok := doc["state"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("state %T, want map[string]interface{}", doc["state"])
+	}
+	if reported, ok := state["reported"].(map[string]interface{}); !ok || reported["on"] != true {
+		t.Errorf("reported %#v", state["reported"])
+	}
+}
+
+func TestProtobuf(t *testing.T) {
+	data, err := codec.Protobuf.Marshal(wrapperspb.String("probe-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out wrapperspb.StringValue
+	if err := codec.Protobuf.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(&out, wrapperspb.String("probe-1")) {
+		t.Errorf("round trip %v", &out)
+	}
+
+	if _, err := codec.Protobuf.Marshal(reading{}); !errors.Is(err, codec.ErrNotProtoMessage) {
+		t.Errorf("Marshal() of a struct = %v, want %v", err, codec.ErrNotProtoMessage)
+	}
+	var r reading
+	if err := codec.Protobuf.Unmarshal(data, &r); !errors.Is(err, codec.ErrNotProtoMessage) {
+		t.Errorf("Unmarshal() into a struct = %v, want %v", err, codec.ErrNotProtoMessage)
+	}
+}
+
+func TestByName(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		want codec.Codec
+	}{
+		{"", codec.JSON},
+		{"json", codec.JSON},
+		{"JSON", codec.JSON},
+		{"cbor", codec.CBOR},
+		{"msgpack", codec.MessagePack},
+		{"MessagePack", codec.MessagePack},
+		{"protobuf", codec.Protobuf},
+		{"proto", codec.Protobuf},
+	} {
+		got, err := codec.ByName(c.name)
+		if err != nil {
+			t.Errorf("ByName(%q) = %v", c.name, err)
+			continue
+		}
+		if got.Name() != c.want.Name() {
+			t.Errorf("ByName(%q) = %s, want %s", c.name, got.Name(), c.want.Name())
+		}
+	}
+	if _, err := codec.ByName("xml"); err == nil {
+		t.Error(`ByName("xml") succeeded`)
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, c := range []codec.Codec{codec.JSON, codec.CBOR, codec.MessagePack, codec.Protobuf} {
+		if c.ContentType() == "" || seen[c.ContentType()] {
+			t.Errorf("%s content type %q", c.Name(), c.ContentType())
+		}
+		seen[c.ContentType()] = true
+	}
+}
@@ -0,0 +1,72 @@
+package connect
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// ALPNProtocol lets AWS IoT accept MQTT with a client certificate on
+	// port 443.
+	ALPNProtocol = "x-amzn-mqtt-ca"
+	// ALPNPort is the port used when falling back to ALPN.
+	ALPNPort = 443
+
+	probeTimeout = 5 * time.Second
+)
+
+// usesALPN reports whether the configured port needs ALPN.
+func (d *dialer) usesALPN() bool {
+	return d.Config.ALPN || d.Config.Port == ALPNPort
+}
+
+func (d *dialer) alpnProtocol() string {
+	if d.authorizer != nil {
+		return AuthorizerALPNProtocol
+	}
+	return ALPNProtocol
+}
+
+// selectPort points the broker URL at the configured port, or at ALPNPort
+// with ALPN if fallback is enabled and the configured port cannot be
+// reached. The port is probed before the first attempt and again after an
+// attempt failed, not before every reconnect.
+func (d *dialer) selectPort() {
+	if d.probed {
+		return
+	}
+	port, alpn := d.Config.Port, d.usesALPN()
+	if d.Config.Fallback && !alpn {
+		addr := net.JoinHostPort(d.Config.Endpoint, strconv.Itoa(port))
+		conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+		if err != nil {
+			fmt.Printf("%s is unreachable, falling back to port %d with ALPN: %v\n", addr, ALPNPort, err)
+			port, alpn = ALPNPort, true
+		} else {
+			conn.Close()
+		}
+	}
+	d.server.Host = net.JoinHostPort(d.Config.Endpoint, strconv.Itoa(port))
+	d.alpn = alpn
+	d.probed = true
+}
+
+// dialFailed makes the next attempt select the port again.
+func (d *dialer) dialFailed() {
+	d.probed = false
+}
+
+// attemptTLSConfig returns the TLS configuration of the next attempt. The
+// shared configuration is cloned for ALPN, as crypto/tls does not allow
+// changing a configuration once it was used.
+func (d *dialer) attemptTLSConfig() *tls.Config {
+	if !d.alpn {
+		return d.tlsConfig
+	}
+	cfg := d.tlsConfig.Clone()
+	cfg.NextProtos = []string{d.alpnProtocol()}
+	return cfg
+}
@@ -0,0 +1,119 @@
+package connect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sync"
+)
+
+// AuthorizerALPNProtocol is negotiated on port 443 when authenticating with
+// a custom authorizer.
+const AuthorizerALPNProtocol = "mqtt"
+
+// AuthorizerConfiguration authenticates the connection with an AWS IoT
+// custom authorizer instead of the client certificate.
+type AuthorizerConfiguration struct {
+	// Name is the name of the custom authorizer.
+	Name string
+	// TokenKeyName is the query parameter that carries the token.
+	TokenKeyName string
+	// Username and Password are passed on to the authorizer function.
+	Username string
+	Password string
+	// Token is asked for a token before every connection attempt.
+	Token TokenProvider
+}
+
+// AuthorizerToken is a token for a custom authorizer. Signature is only
+// required if the authorizer has token signing enabled.
+type AuthorizerToken struct {
+	Token     string `json:"token"`
+	Signature string `json:"signature"`
+}
+
+// TokenProvider returns the token used for the next connection attempt.
+type TokenProvider interface {
+	Token() (AuthorizerToken, error)
+}
+
+// TokenFunc adapts a function to a TokenProvider, which lets the device
+// fetch a fresh token from its backend before connecting.
+type TokenFunc func() (AuthorizerToken, error)
+
+// Token calls f.
+func (f TokenFunc) Token() (AuthorizerToken, error) {
+	return f()
+}
+
+// StaticToken always returns token.
+func StaticToken(token AuthorizerToken) TokenProvider {
+	return TokenFunc(func() (AuthorizerToken, error) {
+		return token, nil
+	})
+}
+
+// FileToken reads a JSON encoded AuthorizerToken from path before every
+// connection attempt, so another process can keep the file current.
+func FileToken(path string) TokenProvider {
+	return TokenFunc(func() (AuthorizerToken, error) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return AuthorizerToken{}, fmt.Errorf("reading authorizer token %v", err)
+		}
+		var token AuthorizerToken
+		if err := json.Unmarshal(data, &token); err != nil {
+			return AuthorizerToken{}, fmt.Errorf("decoding authorizer token %v", err)
+		}
+		return token, nil
+	})
+}
+
+// authorizer keeps the credentials built from the last token for the
+// paho credentials provider, which is called on every connection attempt
+// but cannot fail.
+type authorizer struct {
+	config   AuthorizerConfiguration
+	mu       sync.Mutex
+	username string
+}
+
+func newAuthorizer(config AuthorizerConfiguration) (*authorizer, error) {
+	if config.Name == "" || config.TokenKeyName == "" {
+		return nil, fmt.Errorf("custom authorizer requires a name and token key name")
+	}
+	if config.Token == nil {
+		return nil, fmt.Errorf("custom authorizer requires a token provider")
+	}
+	return &authorizer{config: config}, nil
+}
+
+// refresh fetches a new token from the TokenProvider.
+func (a *authorizer) refresh() error {
+	token, err := a.config.Token.Token()
+	if err != nil {
+		return fmt.Errorf("fetching authorizer token %v", err)
+	}
+	if token.Token == "" {
+		return fmt.Errorf("authorizer token is empty")
+	}
+
+	query := url.Values{}
+	query.Set("x-amz-customauthorizer-name", a.config.Name)
+	query.Set(a.config.TokenKeyName, token.Token)
+	if token.Signature != "" {
+		query.Set("x-amz-customauthorizer-signature", token.Signature)
+	}
+
+	a.mu.Lock()
+	a.username = a.config.Username + "?" + query.Encode()
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *authorizer) credentials() (string, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.username, a.config.Password
+}
@@ -0,0 +1,82 @@
+package connect
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	basicIngestPrefix  = "$aws/rules/"
+	maxRuleNameLength  = 128
+	maxTopicLength     = 256
+	maxTopicSeparators = 7
+)
+
+// ErrInvalidTopic is returned for topics AWS IoT does not accept.
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// WithBasicIngest publishes the message to the AWS IoT rule named rule
+// through Basic Ingest, i.e. to $aws/rules/<rule>/<topic>. The message
+// skips the broker, which saves its messaging cost, so subscribers of
+// topic do not receive it.
+func WithBasicIngest(rule string) PublishOption {
+	return func(o *publishOptions) {
+		o.basicIngestRule = rule
+	}
+}
+
+// BasicIngestTopic returns the Basic Ingest topic that sends messages of
+// topic to rule. It checks the rule name and the limits AWS IoT puts on
+// topic, which exclude the $aws/rules/<rule>/ prefix.
+func BasicIngestTopic(rule, topic string) (string, error) {
+	if err := checkRuleName(rule); err != nil {
+		return "", err
+	}
+	if err := checkTopic(topic); err != nil {
+		return "", err
+	}
+	return basicIngestPrefix + rule + "/" + topic, nil
+}
+
+// PublishTopic returns the topic that a publish to topic with opts is
+// sent to, for implementations of Connection outside this package.
+func PublishTopic(topic string, opts ...PublishOption) (string, error) {
+	return newPublishOptions(opts).topic(topic)
+}
+
+// topic applies the Basic Ingest rule, if any, to topic.
+func (o publishOptions) topic(topic string) (string, error) {
+	if o.basicIngestRule == "" {
+		return topic, nil
+	}
+	return BasicIngestTopic(o.basicIngestRule, topic)
+}
+
+// checkRuleName checks that rule is a valid AWS IoT rule name.
+func checkRuleName(rule string) error {
+	if rule == "" || len(rule) > maxRuleNameLength {
+		return fmt.Errorf("rule name %q must be 1 to %d characters long", rule, maxRuleNameLength)
+	}
+	for _, r := range rule {
+		if r != '_' && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return fmt.Errorf("rule name %q may only contain letters, digits and _", rule)
+		}
+	}
+	return nil
+}
+
+// checkTopic checks that topic can be published to AWS IoT.
+func checkTopic(topic string) error {
+	switch {
+	case topic == "":
+		return fmt.Errorf("%q %w: empty", topic, ErrInvalidTopic)
+	case len(topic) > maxTopicLength:
+		return fmt.Errorf("%q %w: longer than %d bytes", topic, ErrInvalidTopic, maxTopicLength)
+	case strings.Count(topic, "/") > maxTopicSeparators:
+		return fmt.Errorf("%q %w: more than %d levels", topic, ErrInvalidTopic, maxTopicSeparators+1)
+	case strings.ContainsAny(topic, "+#"):
+		return fmt.Errorf("%q %w: wildcards", topic, ErrInvalidTopic)
+	}
+	return nil
+}
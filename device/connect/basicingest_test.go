@@ -0,0 +1,86 @@
+package connect
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestBasicIngestTopic(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		rule, topic string
+		want        string
+		invalid     bool // The topic is rejected with ErrInvalidTopic.
+		err         bool
+	}{
+		{name: "valid", rule: "Telemetry_1", topic: "fleet/123/metrics", want: "$aws/rules/Telemetry_1/fleet/123/metrics"},
+		{name: "longest rule", rule: strings.Repeat("r", 128), topic: "t", want: "$aws/rules/" + strings.Repeat("r", 128) + "/t"},
+		{name: "empty rule", rule: "", topic: "t", err: true},
+		{name: "rule too long", rule: strings.Repeat("r", 129), topic: "t", err: true},
+		{name: "rule with a dash", rule: "telemetry-rule", topic: "t", err: true},
+		{name: "rule with a slash", rule: "telemetry/rule", topic: "t", err: true},
+		{name: "rule with a space", rule: "telemetry rule", topic: "t", err: true},
+		{name: "rule with a non-ASCII letter", rule: "télémétrie", topic: "t", err: true},
+		// The prefix does not count toward the limits of the topic.
+		{name: "longest topic", rule: "rule", topic: strings.Repeat("t", 256), want: "$aws/rules/rule/" + strings.Repeat("t", 256)},
+		{name: "topic too long", rule: "rule", topic: strings.Repeat("t", 257), invalid: true},
+		{name: "most levels", rule: "rule", topic: "a/b/c/d/e/f/g/h", want: "$aws/rules/rule/a/b/c/d/e/f/g/h"},
+		{name: "too many levels", rule: "rule", topic: "a/b/c/d/e/f/g/h/i", invalid: true},
+		{name: "empty topic", rule: "rule", topic: "", invalid: true},
+		{name: "single level wildcard", rule: "rule", topic: "fleet/+/metrics", invalid: true},
+		{name: "multi level wildcard", rule: "rule", topic: "fleet/#", invalid: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := BasicIngestTopic(c.rule, c.topic)
+			switch {
+			case c.invalid:
+				if !errors.Is(err, ErrInvalidTopic) {
+					t.Errorf("BasicIngestTopic() = %q, %v, want %v", got, err, ErrInvalidTopic)
+				}
+			case c.err:
+				if err == nil || errors.Is(err, ErrInvalidTopic) {
+					t.Errorf("BasicIngestTopic() = %q, %v, want an invalid rule name", got, err)
+				}
+			case err != nil:
+				t.Errorf("BasicIngestTopic() = %v", err)
+			case got != c.want:
+				t.Errorf("BasicIngestTopic() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPublishTopic(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		topic string
+		opts  []PublishOption
+		want  string
+		err   bool
+	}{
+		{name: "without basic ingest", topic: "fleet/123/metrics", want: "fleet/123/metrics"},
+		{name: "other options", topic: "fleet/123/metrics", opts: []PublishOption{WithQoS(1), WithRetain(true)}, want: "fleet/123/metrics"},
+		// Topics are only checked for Basic Ingest, the broker checks
+		// the others.
+		{name: "long topic without basic ingest", topic: strings.Repeat("t", 300), want: strings.Repeat("t", 300)},
+		{name: "basic ingest", topic: "fleet/123/metrics", opts: []PublishOption{WithQoS(1), WithBasicIngest("Telemetry")}, want: "$aws/rules/Telemetry/fleet/123/metrics"},
+		{name: "empty rule", topic: "fleet/123/metrics", opts: []PublishOption{WithBasicIngest("")}, want: "fleet/123/metrics"},
+		{name: "invalid rule", topic: "fleet/123/metrics", opts: []PublishOption{WithBasicIngest("my-rule")}, err: true},
+		{name: "invalid topic", topic: "fleet/+/metrics", opts: []PublishOption{WithBasicIngest("Telemetry")}, err: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := PublishTopic(c.topic, c.opts...)
+			switch {
+			case c.err:
+				if err == nil {
+					t.Errorf("PublishTopic() = %q, want an error", got)
+				}
+			case err != nil:
+				t.Errorf("PublishTopic() = %v", err)
+			case got != c.want:
+				t.Errorf("PublishTopic() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
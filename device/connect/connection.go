@@ -2,9 +2,12 @@ package connect
 
 import (
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -16,95 +19,433 @@ type Connection interface {
 	// Disconnect from MQTT Server
 	Disconnect(timeout uint)
 
-	Publish(topic string, payload interface{}) mqtt.Token
+	// Publish sends payload to topic. It fails with ErrNotConnected while
+	// the connection is down, unless the message is published WithQueue
+	// and a queue is configured: then it is stored and sent in order once
+	// the connection is back.
+	Publish(topic string, payload interface{}, opts ...PublishOption) mqtt.Token
 
-	Subscribe(topic string, handler mqtt.MessageHandler) error
+	Subscribe(topic string, handler mqtt.MessageHandler, opts ...SubscribeOption) error
+	// SubscribeMultiple subscribes to several topic filters with a single
+	// request.
+	SubscribeMultiple(subs []Subscription, opts ...SubscribeOption) error
+
+	Unsubscribe(topics ...string) error
+
+	// State returns the current state of the connection.
+	State() State
+	// OnStateChange registers handler to be called with every change of
+	// the connection state and returns a function that removes it.
+	OnStateChange(handler func(Event)) func()
+	// OnError sets handler of asynchronous errors, such as subscriptions
+	// that could not be restored after a reconnect.
+	OnError(handler func(error))
+	// Metrics returns the reconnect metrics of the connection.
+	Metrics() Metrics
+
+	// UpdateKeyPair replaces the client certificate and reconnects with it
+	// if the connection is open or reconnecting. If the certificate does
+	// not connect, the connection keeps reconnecting with the reconnect
+	// policy.
+	UpdateKeyPair(kp KeyPair) error
 }
 
+const defaultKeepAlive = 30 * time.Second
+
+var (
+	// ErrClosed is returned for requests interrupted by Disconnect.
+	ErrClosed = errors.New("connection closed")
+	// ErrTimeout is returned if the broker did not answer a request in
+	// time.
+	ErrTimeout = errors.New("timed out waiting for the broker")
+	// ErrNotConnected is returned for publishes while the connection is
+	// down that are not queued.
+	ErrNotConnected = errors.New("not connected")
+
+	errKeyPairUpdated = errors.New("reconnecting with new certificate")
+)
+
+// Transports to the AWS IoT endpoint.
+const (
+	// TransportMQTTS is MQTT over TLS authenticated with the client
+	// certificate of the KeyPair.
+	TransportMQTTS = "mqtts"
+	// TransportWSS is MQTT over secure WebSockets authenticated with SigV4.
+	TransportWSS = "wss"
+	// TransportWS is TransportWSS without TLS, for local brokers only.
+	TransportWS = "ws"
+)
+
 type ConnectionConfiguration struct {
 	KeyPair  KeyPair
 	Endpoint string
 	Port     int
 	ClientId string
+	// Transport defaults to TransportMQTTS.
+	Transport string
+	// Region is used to sign websocket connections. It defaults to the
+	// region of the endpoint.
+	Region string
+	// Credentials sign websocket connections.
+	Credentials CredentialsProvider
+	// ALPN negotiates ALPNProtocol so MQTT with a client certificate can
+	// use port 443. It is implied by port 443.
+	ALPN bool
+	// Fallback switches to port 443 with ALPN when the configured port
+	// cannot be reached.
+	Fallback bool
+	// Authorizer authenticates with a custom authorizer instead of the
+	// client certificate. It needs port 443.
+	Authorizer *AuthorizerConfiguration
+	// Will is published by the broker if the connection is lost without
+	// a disconnect.
+	Will *Will
+	// KeepAlive is the interval of keep alive pings. It defaults to 30s.
+	KeepAlive time.Duration
+	// CleanSession discards the subscriptions and undelivered messages of
+	// the previous session when connecting.
+	CleanSession bool
+	// TopicAliasMaximum is the number of topic aliases an MQTT 5
+	// connection may assign. Zero disables topic aliases.
+	TopicAliasMaximum uint16
+	// Reconnect controls how a lost connection is re-established.
+	Reconnect ReconnectPolicy
+	// Queue configures the outbound queue used while offline.
+	Queue QueueConfiguration
 }
 
 type connection struct {
-	Config ConnectionConfiguration
+	*dialer
+	lifecycle
+	subscriptions
+	reconnector
 	Client mqtt.Client
+	mu     sync.Mutex
+	queue  *queue
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// Will is the last will and testament of a connection.
+type Will struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
 }
 
+// KeyPair locates the client certificate and private key. The PEM fields
+// take precedence over the paths when set.
 type KeyPair struct {
 	PrivateKeyPath    string
 	CertificatePath   string
 	CACertificatePath string
+	PrivateKeyPEM     []byte
+	CertificatePEM    []byte
 }
 
-func New(config *ConnectionConfiguration) (Connection, error) {
-	tlsCert, err := tls.LoadX509KeyPair(config.KeyPair.CertificatePath, config.KeyPair.PrivateKeyPath)
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to load certs: %v", err)
+func (kp *KeyPair) load() (tls.Certificate, error) {
+	if len(kp.CertificatePEM) != 0 || len(kp.PrivateKeyPEM) != 0 {
+		return tls.X509KeyPair(kp.CertificatePEM, kp.PrivateKeyPEM)
 	}
+	return tls.LoadX509KeyPair(kp.CertificatePath, kp.PrivateKeyPath)
+}
 
-	certs := x509.NewCertPool()
-	caPEM, err := ioutil.ReadFile(config.KeyPair.CACertificatePath)
-
+func New(config *ConnectionConfiguration) (Connection, error) {
+	d, err := newDialer(config, "tcps")
 	if err != nil {
 		return nil, err
 	}
 
-	certs.AppendCertsFromPEM(caPEM)
-
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		RootCAs:      certs,
+	conn := &connection{
+		dialer:      d,
+		reconnector: newReconnector(config.Reconnect),
+		stop:        make(chan struct{}),
 	}
 
-	if err != nil {
-		return nil, err
+	if config.Queue.Directory != "" {
+		q, err := newQueue(config.Queue)
+		if err != nil {
+			return nil, err
+		}
+		conn.queue = q
 	}
 
-	serverURL := fmt.Sprintf("tcps://%s:%v", config.Endpoint, config.Port)
-	fmt.Printf("Preparing connection to %s\n", serverURL)
-
 	mqttOpts := mqtt.NewClientOptions()
-	mqttOpts.AddBroker(serverURL)
-	mqttOpts.CleanSession = false
-	mqttOpts.AutoReconnect = true
-	mqttOpts.SetMaxReconnectInterval(1 * time.Second)
+	mqttOpts.Servers = []*url.URL{d.server}
+	mqttOpts.CleanSession = config.CleanSession
+	// Reconnects are made by reconnect to apply the policy.
+	mqttOpts.AutoReconnect = false
+	mqttOpts.SetConnectTimeout(config.Reconnect.connectTimeout())
 	mqttOpts.SetClientID(config.ClientId)
-	mqttOpts.SetTLSConfig(tlsConfig)
+	mqttOpts.SetTLSConfig(d.tlsConfig)
+	mqttOpts.SetConnectionAttemptHandler(func(*url.URL, *tls.Config) *tls.Config {
+		return d.attemptTLSConfig()
+	})
+	mqttOpts.SetOnConnectHandler(conn.onConnect)
+	mqttOpts.SetConnectionLostHandler(conn.onConnectionLost)
+	mqttOpts.SetKeepAlive(config.keepAlive())
+	if w := config.Will; w != nil {
+		mqttOpts.SetBinaryWill(w.Topic, w.Payload, w.QoS, w.Retain)
+	}
+	if d.authorizer != nil {
+		mqttOpts.SetCredentialsProvider(d.authorizer.credentials)
+	}
 
-	c := mqtt.NewClient(mqttOpts)
-	conn := &connection{
-		Client: c,
-		Config: *config,
+	conn.Client = mqtt.NewClient(mqttOpts)
+	if conn.queue != nil {
+		go conn.queue.run(conn.stop, conn.Client.IsConnectionOpen, conn.send)
 	}
 	return conn, nil
 }
 
 func (c *connection) Connect() error {
+	c.setState(StateConnecting, nil)
+	return c.connect()
+}
+
+func (c *connection) connect() error {
+	if err := c.dial(); err != nil {
+		c.setState(StateDisconnected, err)
+		return err
+	}
+	c.setState(StateConnected, nil)
+	return nil
+}
+
+func (c *connection) dial() error {
+	if err := c.prepare(); err != nil {
+		return err
+	}
 	// connect to MQTT endpoint
 	if token := c.Client.Connect(); token.Wait() && token.Error() != nil {
 		fmt.Printf("%v", token.Error())
+		c.dialFailed()
 		return token.Error()
 	}
 	return nil
 }
 
+// reconnect re-establishes a lost connection with the delays of the
+// reconnect policy until it is up, closed or out of attempts.
+func (c *connection) reconnect() {
+	for {
+		delay, err := c.next()
+		if err != nil {
+			c.setState(StateDisconnected, err)
+			c.handleError(err)
+			return
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(delay):
+		}
+
+		c.mu.Lock()
+		if c.State() != StateReconnecting {
+			// Reconnected or closed in the meantime.
+			c.mu.Unlock()
+			return
+		}
+		err = c.dial()
+		c.mu.Unlock()
+		if err == nil {
+			return
+		}
+		fmt.Printf("reconnecting %v\n", err)
+		c.failed(err)
+	}
+}
+
+func (c *connection) onConnect(mqtt.Client) {
+	c.succeeded()
+	c.setState(StateConnected, nil)
+	c.restore()
+	if c.queue != nil {
+		c.queue.signal()
+	}
+}
+
+// restore subscribes to the registered topics again, as the broker may
+// not have kept the session.
+func (c *connection) restore() {
+	subs := c.all()
+	if len(subs) == 0 {
+		return
+	}
+	filters := make(map[string]byte, len(subs))
+	for _, sub := range subs {
+		filters[sub.Topic] = sub.QoS
+	}
+	token := c.Client.SubscribeMultiple(filters, nil)
+	if !token.WaitTimeout(defaultRequestTimeout) {
+		c.handleError(&SubscriptionError{Topics: topicsOf(subs), Err: ErrTimeout})
+		return
+	}
+	if err := token.Error(); err != nil {
+		c.handleError(&SubscriptionError{Topics: topicsOf(subs), Err: err})
+		return
+	}
+	if refused := refusedTopics(token); len(refused) > 0 {
+		c.handleError(&SubscriptionError{Topics: refused, Err: ErrRefused})
+	}
+}
+
+func (c *connection) onConnectionLost(_ mqtt.Client, err error) {
+	fmt.Printf("connection lost %v\n", err)
+	c.setState(StateReconnecting, err)
+	go c.reconnect()
+}
+
 func (c *connection) Disconnect(timeout uint) {
+	c.once.Do(func() { close(c.stop) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setState(StateDisconnected, nil)
 	c.Client.Disconnect(timeout)
 }
 
-func (c *connection) Publish(topic string, payload interface{}) mqtt.Token {
+func (c *connection) Publish(topic string, payload interface{}, opts ...PublishOption) mqtt.Token {
+	o := newPublishOptions(opts)
+	topic, err := o.topic(topic)
+	if err != nil {
+		return &doneToken{err: err}
+	}
 	fmt.Printf("Publishing %v to %v", payload, topic)
-	return c.Client.Publish(topic, 1, false, payload)
+	if c.queue == nil || !o.queue {
+		if !c.Client.IsConnectionOpen() {
+			return &doneToken{err: ErrNotConnected}
+		}
+		return withTimeout(c.Client.Publish(topic, o.qos, o.retain, payload), o.timeout)
+	}
+
+	data, err := payloadBytes(payload)
+	if err != nil {
+		return &doneToken{err: err}
+	}
+	m := o.queued(topic, data, c.queue.config.TTL)
+	// Publish directly unless older messages are still waiting, which
+	// would otherwise be overtaken.
+	if !c.Client.IsConnectionOpen() || c.queue.len() > 0 {
+		return &doneToken{err: c.queue.push(m)}
+	}
+	c.queue.reserve(m)
+	t := newAsyncToken()
+	token := withTimeout(c.Client.Publish(topic, o.qos, o.retain, data), o.timeout)
+	go func() {
+		token.Wait()
+		t.complete(c.queue.requeue(m, token.Error()))
+	}()
+	return t
+}
+
+// send publishes a queued message.
+func (c *connection) send(m *queuedMessage) error {
+	token := c.Client.Publish(m.Topic, m.QoS, m.Retain, m.Payload)
+	select {
+	case <-c.stop:
+		return ErrClosed
+	case <-token.Done():
+	}
+	return token.Error()
+}
+
+func (c *connection) Subscribe(topic string, handler mqtt.MessageHandler, opts ...SubscribeOption) error {
+	o := newSubscribeOptions(opts)
+	return c.SubscribeMultiple([]Subscription{{Topic: topic, QoS: o.qos, Handler: handler}}, opts...)
 }
 
-func (c *connection) Subscribe(topic string, handler mqtt.MessageHandler) error {
-	fmt.Printf("Subscribing to %v\n", topic)
-	if token := c.Client.Subscribe(topic, 1, handler); token.Error() != nil {
-		return fmt.Errorf("registering message handlers %v", token.Error())
+func (c *connection) SubscribeMultiple(subs []Subscription, opts ...SubscribeOption) error {
+	o := newSubscribeOptions(opts)
+	filters := make(map[string]byte, len(subs))
+	for _, sub := range subs {
+		fmt.Printf("Subscribing to %v\n", sub.Topic)
+		filters[sub.Topic] = sub.QoS
+		c.Client.AddRoute(sub.Topic, sub.Handler)
+	}
+	// Registered first so a reconnect during the request restores them.
+	c.add(subs)
+	if err := waitSubscribe(c.Client.SubscribeMultiple(filters, nil), o.timeout); err != nil {
+		c.remove(topicsOf(subs))
+		return fmt.Errorf("registering message handlers %v", err)
 	}
 	return nil
 }
+
+// waitSubscribe waits for the SUBACK of token and checks the granted QoS
+// of every topic filter.
+func waitSubscribe(token mqtt.Token, timeout time.Duration) error {
+	if !token.WaitTimeout(timeout) {
+		return ErrTimeout
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+	if refused := refusedTopics(token); len(refused) > 0 {
+		return fmt.Errorf("%s %v", strings.Join(refused, ", "), ErrRefused)
+	}
+	return nil
+}
+
+// refusedTopics returns the topic filters the broker refused in the SUBACK
+// of token.
+func refusedTopics(token mqtt.Token) []string {
+	st, ok := token.(*mqtt.SubscribeToken)
+	if !ok {
+		return nil
+	}
+	var refused []string
+	for topic, qos := range st.Result() {
+		if qos == 0x80 {
+			refused = append(refused, topic)
+		}
+	}
+	sort.Strings(refused)
+	return refused
+}
+
+func (c *connection) Unsubscribe(topics ...string) error {
+	fmt.Printf("Unsubscribing from %v\n", topics)
+	c.remove(topics)
+	if token := c.Client.Unsubscribe(topics...); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("unsubscribing %v", token.Error())
+	}
+	return nil
+}
+
+func (c *connection) UpdateKeyPair(kp KeyPair) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.setKeyPair(kp); err != nil {
+		return err
+	}
+	// A reconnect loop is already running while reconnecting.
+	running := c.State() == StateReconnecting
+	if !running && !c.Client.IsConnected() {
+		return nil
+	}
+	fmt.Println("Reconnecting with new certificate")
+	if c.Client.IsConnected() {
+		c.Client.Disconnect(250)
+	}
+	c.setState(StateReconnecting, errKeyPairUpdated)
+	if err := c.dial(); err != nil {
+		// Keep reconnecting, so a fallback to the previous key pair finds
+		// the connection still in use.
+		c.setState(StateReconnecting, err)
+		if !running {
+			go c.reconnect()
+		}
+		return err
+	}
+	c.setState(StateConnected, nil)
+	return nil
+}
+
+func (c *ConnectionConfiguration) keepAlive() time.Duration {
+	if c.KeepAlive == 0 {
+		return defaultKeepAlive
+	}
+	return c.KeepAlive
+}
@@ -0,0 +1,309 @@
+// Package connecttest provides an in-memory MQTT broker and an
+// implementation of connect.Connection on top of it, so code that talks
+// to AWS IoT through a connection can be tested without a network.
+package connecttest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+)
+
+// ErrNotConnected is returned for requests made while a Connection is not
+// connected.
+var ErrNotConnected = errors.New("not connected")
+
+// Message is a message published on a Broker. It implements
+// mqtt.Message.
+type Message struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+	id       uint16
+	// ClientID is the client that published the message, empty for
+	// messages published with Broker.Publish.
+	ClientID string
+	// Time is when the message was published.
+	Time time.Time
+}
+
+func (m *Message) Duplicate() bool   { return false }
+func (m *Message) Qos() byte         { return m.qos }
+func (m *Message) Retained() bool    { return m.retained }
+func (m *Message) Topic() string     { return m.topic }
+func (m *Message) MessageID() uint16 { return m.id }
+func (m *Message) Payload() []byte   { return m.payload }
+func (m *Message) Ack()              {}
+
+// Broker is an in-memory MQTT broker. It keeps every published message
+// for inspection and delivers messages to subscribers in order, each on
+// its own goroutine.
+type Broker struct {
+	mu        sync.Mutex
+	conns     map[string]*Connection
+	hooks     map[int]*hook
+	nextHook  int
+	retained  map[string]*Message
+	published []*Message
+	nextID    uint16
+	dropped   error
+}
+
+type hook struct {
+	filter  string
+	handler func(*Message)
+	inbox   *inbox
+}
+
+// NewBroker creates an empty Broker.
+func NewBroker() *Broker {
+	return &Broker{
+		conns:    make(map[string]*Connection),
+		hooks:    make(map[int]*hook),
+		retained: make(map[string]*Message),
+	}
+}
+
+// NewConnection creates a Connection with the client id of config. It has
+// the signature of connect.New so it can replace it in tests. A connection
+// with the same client id replaces the previous one.
+func (b *Broker) NewConnection(config *connect.ConnectionConfiguration) (connect.Connection, error) {
+	return b.Connection(config.ClientId), nil
+}
+
+// Connection returns a new disconnected Connection with clientID.
+func (b *Broker) Connection(clientID string) *Connection {
+	return &Connection{
+		broker:   b,
+		clientID: clientID,
+		subs:     make(map[string]connect.Subscription),
+		events:   &inbox{},
+		messages: &inbox{},
+	}
+}
+
+// Handle calls handler with every message published on a topic matching
+// filter, like a rule or service in the cloud, and returns a function
+// that removes it.
+func (b *Broker) Handle(filter string, handler func(msg *Message)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextHook
+	b.nextHook++
+	b.hooks[id] = &hook{filter: filter, handler: handler, inbox: &inbox{}}
+	return func() {
+		b.mu.Lock()
+		delete(b.hooks, id)
+		b.mu.Unlock()
+	}
+}
+
+// Publish publishes payload to topic from the cloud side. Payloads other
+// than []byte and string are marshaled to JSON.
+func (b *Broker) Publish(topic string, payload interface{}) error {
+	data, err := encode(payload)
+	if err != nil {
+		return err
+	}
+	b.publish(&Message{topic: topic, payload: data, qos: 1})
+	return nil
+}
+
+// PublishRetained publishes payload to topic and keeps it for future
+// subscribers.
+func (b *Broker) PublishRetained(topic string, payload interface{}) error {
+	data, err := encode(payload)
+	if err != nil {
+		return err
+	}
+	b.publish(&Message{topic: topic, payload: data, qos: 1, retained: true})
+	return nil
+}
+
+// Messages returns the messages published on topics matching filter, in
+// the order they were published.
+func (b *Broker) Messages(filter string) []*Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var msgs []*Message
+	for _, m := range b.published {
+		if Match(filter, m.topic) {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+// Drop cuts the network of all connections, which enter
+// connect.StateReconnecting with err until Restore is called.
+func (b *Broker) Drop(err error) {
+	if err == nil {
+		err = errors.New("connection lost")
+	}
+	b.mu.Lock()
+	b.dropped = err
+	conns := b.connections()
+	b.mu.Unlock()
+	for _, c := range conns {
+		c.lost(err)
+	}
+}
+
+// Restore brings the connections cut by Drop back. Subscriptions are
+// kept as if the broker had kept the sessions.
+func (b *Broker) Restore() {
+	b.mu.Lock()
+	b.dropped = nil
+	conns := b.connections()
+	b.mu.Unlock()
+	for _, c := range conns {
+		c.restored()
+	}
+}
+
+func (b *Broker) connections() []*Connection {
+	conns := make([]*Connection, 0, len(b.conns))
+	for _, c := range b.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (b *Broker) attach(c *Connection) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.dropped != nil {
+		return b.dropped
+	}
+	if old, ok := b.conns[c.clientID]; ok && old != c {
+		// AWS IoT disconnects the older connection of a client id.
+		go old.lost(fmt.Errorf("client id %s connected elsewhere", c.clientID))
+	}
+	b.conns[c.clientID] = c
+	return nil
+}
+
+func (b *Broker) detach(c *Connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conns[c.clientID] == c {
+		delete(b.conns, c.clientID)
+	}
+}
+
+func (b *Broker) publish(m *Message) {
+	b.mu.Lock()
+	b.nextID++
+	m.id = b.nextID
+	m.Time = time.Now()
+	b.published = append(b.published, m)
+	if m.retained {
+		if len(m.payload) == 0 {
+			delete(b.retained, m.topic)
+		} else {
+			b.retained[m.topic] = m
+		}
+	}
+	conns := b.connections()
+	var hooks []*hook
+	for _, h := range b.hooks {
+		if Match(h.filter, m.topic) {
+			hooks = append(hooks, h)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, c := range conns {
+		c.deliver(m)
+	}
+	for _, h := range hooks {
+		h := h
+		h.inbox.push(func() { h.handler(m) })
+	}
+}
+
+// retainedFor returns the retained messages matching filter.
+func (b *Broker) retainedFor(filter string) []*Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var msgs []*Message
+	for topic, m := range b.retained {
+		if Match(filter, topic) {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+// Match reports whether topic matches the MQTT topic filter.
+func Match(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	// Wildcards in the first level do not match topics starting with $.
+	if strings.HasPrefix(topic, "$") && (f[0] == "+" || f[0] == "#") {
+		return false
+	}
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func encode(payload interface{}) ([]byte, error) {
+	switch p := payload.(type) {
+	case []byte:
+		return p, nil
+	case string:
+		return []byte(p), nil
+	default:
+		data, err := json.Marshal(p)
+		if err != nil {
+			return nil, fmt.Errorf("marshaling payload %v", err)
+		}
+		return data, nil
+	}
+}
+
+// inbox runs functions in order on a goroutine of its own, like the
+// delivery of messages to a client.
+type inbox struct {
+	mu      sync.Mutex
+	pending []func()
+	running bool
+}
+
+func (i *inbox) push(fn func()) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.pending = append(i.pending, fn)
+	if !i.running {
+		i.running = true
+		go i.run()
+	}
+}
+
+func (i *inbox) run() {
+	for {
+		i.mu.Lock()
+		if len(i.pending) == 0 {
+			i.running = false
+			i.mu.Unlock()
+			return
+		}
+		fn := i.pending[0]
+		i.pending = i.pending[1:]
+		i.mu.Unlock()
+		fn()
+	}
+}
@@ -0,0 +1,309 @@
+package connecttest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+)
+
+// Connection is a connect.Connection attached to a Broker. Messages
+// published while it is not connected are lost, as with QoS 0.
+type Connection struct {
+	broker   *Broker
+	clientID string
+
+	mu          sync.Mutex
+	state       connect.State
+	subs        map[string]connect.Subscription
+	handlers    []stateHandler
+	nextHandler int
+	onError     func(error)
+	metrics     connect.Metrics
+	keyPairs    []connect.KeyPair
+	connectErr  error
+	keyPairErr  error
+	events      *inbox
+	messages    *inbox
+}
+
+type stateHandler struct {
+	id int
+	fn func(connect.Event)
+}
+
+var _ connect.Connection = (*Connection)(nil)
+
+// ClientID returns the client id of the connection.
+func (c *Connection) ClientID() string {
+	return c.clientID
+}
+
+// FailConnect makes the following calls to Connect fail with err, or
+// succeed again if err is nil.
+func (c *Connection) FailConnect(err error) {
+	c.mu.Lock()
+	c.connectErr = err
+	c.mu.Unlock()
+}
+
+// GiveUp ends the reconnection of a connection cut by Broker.Drop as a
+// connection out of reconnect attempts does: it is disconnected with
+// connect.ErrReconnectFailed.
+func (c *Connection) GiveUp() {
+	if c.State() != connect.StateReconnecting {
+		return
+	}
+	c.broker.detach(c)
+	c.setState(connect.StateDisconnected, connect.ErrReconnectFailed)
+}
+
+func (c *Connection) Connect() error {
+	c.mu.Lock()
+	err := c.connectErr
+	c.mu.Unlock()
+	if err == nil {
+		err = c.broker.attach(c)
+	}
+	if err != nil {
+		c.setState(connect.StateDisconnected, err)
+		return err
+	}
+	c.setState(connect.StateConnected, nil)
+	return nil
+}
+
+func (c *Connection) Disconnect(timeout uint) {
+	c.broker.detach(c)
+	c.setState(connect.StateDisconnected, nil)
+}
+
+func (c *Connection) Publish(topic string, payload interface{}, opts ...connect.PublishOption) mqtt.Token {
+	o := connect.ApplyPublishOptions(opts...)
+	topic, err := connect.PublishTopic(topic, opts...)
+	if err != nil {
+		return &token{err: err}
+	}
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	case bytes.Buffer:
+		data = p.Bytes()
+	case *bytes.Buffer:
+		data = p.Bytes()
+	default:
+		return &token{err: fmt.Errorf("unknown payload type %T", payload)}
+	}
+	if c.State() != connect.StateConnected {
+		return &token{err: ErrNotConnected}
+	}
+	c.broker.publish(&Message{
+		topic:    topic,
+		payload:  append([]byte(nil), data...),
+		qos:      o.QoS,
+		retained: o.Retain,
+		ClientID: c.clientID,
+	})
+	return &token{}
+}
+
+func (c *Connection) Subscribe(topic string, handler mqtt.MessageHandler, opts ...connect.SubscribeOption) error {
+	o := connect.ApplySubscribeOptions(opts...)
+	return c.SubscribeMultiple([]connect.Subscription{{Topic: topic, QoS: o.QoS, Handler: handler}}, opts...)
+}
+
+func (c *Connection) SubscribeMultiple(subs []connect.Subscription, opts ...connect.SubscribeOption) error {
+	if c.State() != connect.StateConnected {
+		return fmt.Errorf("registering message handlers %v", ErrNotConnected)
+	}
+	c.mu.Lock()
+	for _, sub := range subs {
+		c.subs[sub.Topic] = sub
+	}
+	c.mu.Unlock()
+	for _, sub := range subs {
+		for _, m := range c.broker.retainedFor(sub.Topic) {
+			handler, m := sub.Handler, m
+			c.messages.push(func() { handler(nil, m) })
+		}
+	}
+	return nil
+}
+
+func (c *Connection) Unsubscribe(topics ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		delete(c.subs, topic)
+	}
+	return nil
+}
+
+// Subscriptions returns the subscribed topic filters in order.
+func (c *Connection) Subscriptions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topics := make([]string, 0, len(c.subs))
+	for topic := range c.subs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func (c *Connection) State() connect.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *Connection) OnStateChange(handler func(connect.Event)) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.nextHandler
+	c.nextHandler++
+	c.handlers = append(c.handlers, stateHandler{id: id, fn: handler})
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, h := range c.handlers {
+			if h.id == id {
+				c.handlers = append(c.handlers[:i:i], c.handlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (c *Connection) OnError(handler func(error)) {
+	c.mu.Lock()
+	c.onError = handler
+	c.mu.Unlock()
+}
+
+// ReportError passes err to the OnError handler, as a connection does for
+// asynchronous errors.
+func (c *Connection) ReportError(err error) {
+	c.mu.Lock()
+	cb := c.onError
+	c.mu.Unlock()
+	if cb != nil {
+		c.events.push(func() { cb(err) })
+	}
+}
+
+func (c *Connection) Metrics() connect.Metrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.metrics
+}
+
+func (c *Connection) UpdateKeyPair(kp connect.KeyPair) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keyPairs = append(c.keyPairs, kp)
+	err := c.keyPairErr
+	// Only the new key pair is rejected, the fallback to the previous one
+	// succeeds.
+	c.keyPairErr = nil
+	return err
+}
+
+// FailUpdateKeyPair makes the next call to UpdateKeyPair fail with err, as
+// if the broker rejected the new certificate.
+func (c *Connection) FailUpdateKeyPair(err error) {
+	c.mu.Lock()
+	c.keyPairErr = err
+	c.mu.Unlock()
+}
+
+// KeyPairs returns the key pairs passed to UpdateKeyPair.
+func (c *Connection) KeyPairs() []connect.KeyPair {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]connect.KeyPair(nil), c.keyPairs...)
+}
+
+func (c *Connection) setState(state connect.State, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == state {
+		return
+	}
+	ev := connect.Event{State: state, Previous: c.state, Err: err, Time: time.Now()}
+	c.state = state
+	handlers := c.handlers
+	c.events.push(func() {
+		for _, h := range handlers {
+			h.fn(ev)
+		}
+	})
+}
+
+// deliver passes m to the handlers of the matching subscriptions.
+func (c *Connection) deliver(m *Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != connect.StateConnected {
+		return
+	}
+	for _, sub := range c.subs {
+		if Match(sub.Topic, m.topic) {
+			handler := sub.Handler
+			c.messages.push(func() { handler(nil, m) })
+		}
+	}
+}
+
+// subscribed reports whether a subscription matches topic.
+func (c *Connection) subscribed(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, sub := range c.subs {
+		if Match(sub.Topic, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Connection) lost(err error) {
+	if c.State() != connect.StateConnected {
+		return
+	}
+	c.setState(connect.StateReconnecting, err)
+}
+
+func (c *Connection) restored() {
+	if c.State() != connect.StateReconnecting {
+		return
+	}
+	c.mu.Lock()
+	c.metrics.Attempts++
+	c.metrics.Reconnects++
+	c.metrics.LastAttempt = time.Now()
+	c.mu.Unlock()
+	c.setState(connect.StateConnected, nil)
+}
+
+// token is a completed mqtt.Token.
+type token struct {
+	err error
+}
+
+func (t *token) Wait() bool                     { return true }
+func (t *token) WaitTimeout(time.Duration) bool { return true }
+func (t *token) Error() error                   { return t.err }
+
+func (t *token) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
@@ -0,0 +1,191 @@
+package connecttest
+
+import (
+	"fmt"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+)
+
+// MismatchError is reported by a Replay when the device publishes a
+// message that does not match the next one of the recording.
+type MismatchError struct {
+	Expected  connect.Record
+	Published connect.Record
+}
+
+func (e *MismatchError) Error() string {
+	if e.Expected.Direction == "" {
+		return fmt.Sprintf("published %s after the end of the recording", e.Published.Topic)
+	}
+	return fmt.Sprintf("published %s but the recording continues with %s %s", e.Published.Topic, e.Expected.Direction, e.Expected.Topic)
+}
+
+// Replay is a Connection that plays back a recording made with
+// connect.Recorder. Received messages are delivered in recorded order
+// once the device has made the publishes preceding them and subscribed
+// to their topic, so the exchange repeats deterministically whatever its
+// original timing was. Publishes that do not match the recording are
+// reported to the OnError handler as *MismatchError and not consumed.
+// Mismatches returns them as well.
+type Replay struct {
+	*Connection
+
+	// Match reports whether a publish of the device matches the recorded
+	// one. It defaults to comparing the topics, since payloads such as
+	// certificate signing requests differ between runs.
+	Match func(recorded, published connect.Record) bool
+
+	mu         sync.Mutex
+	records    []connect.Record
+	next       int
+	mismatches []*MismatchError
+}
+
+var _ connect.Connection = (*Replay)(nil)
+
+// NewReplay creates a disconnected Replay of records.
+func NewReplay(records []connect.Record) *Replay {
+	return &Replay{
+		Connection: &Connection{
+			subs:     make(map[string]connect.Subscription),
+			events:   &inbox{},
+			messages: &inbox{},
+		},
+		records: records,
+	}
+}
+
+// NewConnection returns the Replay. It has the signature of connect.New
+// so it can replace it in tests.
+func (r *Replay) NewConnection(config *connect.ConnectionConfiguration) (connect.Connection, error) {
+	return r, nil
+}
+
+func (r *Replay) Connect() error {
+	r.Connection.mu.Lock()
+	err := r.connectErr
+	r.Connection.mu.Unlock()
+	if err != nil {
+		r.setState(connect.StateDisconnected, err)
+		return err
+	}
+	r.setState(connect.StateConnected, nil)
+	r.advance()
+	return nil
+}
+
+func (r *Replay) Disconnect(timeout uint) {
+	r.setState(connect.StateDisconnected, nil)
+}
+
+func (r *Replay) Publish(topic string, payload interface{}, opts ...connect.PublishOption) mqtt.Token {
+	topic, err := connect.PublishTopic(topic, opts...)
+	if err != nil {
+		return &token{err: err}
+	}
+	data, err := encode(payload)
+	if err != nil {
+		return &token{err: err}
+	}
+	if r.State() != connect.StateConnected {
+		return &token{err: ErrNotConnected}
+	}
+	o := connect.ApplyPublishOptions(opts...)
+	published := connect.Record{
+		Direction: connect.DirectionPublish,
+		Topic:     topic,
+		QoS:       o.QoS,
+		Retained:  o.Retain,
+		Payload:   data,
+	}
+
+	r.mu.Lock()
+	var expected connect.Record
+	if r.next < len(r.records) {
+		expected = r.records[r.next]
+	}
+	match := r.Match
+	if match == nil {
+		match = sameTopic
+	}
+	if expected.Direction != connect.DirectionPublish || !match(expected, published) {
+		mismatch := &MismatchError{Expected: expected, Published: published}
+		r.mismatches = append(r.mismatches, mismatch)
+		r.mu.Unlock()
+		r.ReportError(mismatch)
+		return &token{}
+	}
+	r.next++
+	r.mu.Unlock()
+	r.advance()
+	return &token{}
+}
+
+func (r *Replay) Subscribe(topic string, handler mqtt.MessageHandler, opts ...connect.SubscribeOption) error {
+	o := connect.ApplySubscribeOptions(opts...)
+	return r.SubscribeMultiple([]connect.Subscription{{Topic: topic, QoS: o.QoS, Handler: handler}}, opts...)
+}
+
+func (r *Replay) SubscribeMultiple(subs []connect.Subscription, opts ...connect.SubscribeOption) error {
+	if r.State() != connect.StateConnected {
+		return fmt.Errorf("registering message handlers %v", ErrNotConnected)
+	}
+	r.Connection.mu.Lock()
+	for _, sub := range subs {
+		r.subs[sub.Topic] = sub
+	}
+	r.Connection.mu.Unlock()
+	r.advance()
+	return nil
+}
+
+// Remaining returns the records that have not been replayed yet.
+func (r *Replay) Remaining() []connect.Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]connect.Record(nil), r.records[r.next:]...)
+}
+
+// Mismatches returns the publishes that did not match the recording.
+func (r *Replay) Mismatches() []*MismatchError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*MismatchError(nil), r.mismatches...)
+}
+
+// Done reports whether the whole recording has been replayed.
+func (r *Replay) Done() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.next == len(r.records)
+}
+
+// advance delivers the received records up to the next publish of the
+// device, or to the first one nobody subscribed to yet.
+func (r *Replay) advance() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.next < len(r.records) {
+		rec := r.records[r.next]
+		if rec.Direction != connect.DirectionReceive {
+			return
+		}
+		if r.State() != connect.StateConnected || !r.subscribed(rec.Topic) {
+			return
+		}
+		r.deliver(&Message{
+			topic:    rec.Topic,
+			payload:  rec.Payload,
+			qos:      rec.QoS,
+			retained: rec.Retained,
+			Time:     rec.Time,
+		})
+		r.next++
+	}
+}
+
+func sameTopic(recorded, published connect.Record) bool {
+	return recorded.Topic == published.Topic
+}
@@ -0,0 +1,163 @@
+package connecttest
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+)
+
+func publish(topic string) connect.Record {
+	return connect.Record{Direction: connect.DirectionPublish, Topic: topic}
+}
+
+func receive(topic string) connect.Record {
+	return connect.Record{Direction: connect.DirectionReceive, Topic: topic, Payload: []byte(topic)}
+}
+
+// subscribe subscribes r to filter and returns the topics it receives.
+func subscribe(t *testing.T, r *Replay, filter string) <-chan string {
+	t.Helper()
+	received := make(chan string, 10)
+	if err := r.Subscribe(filter, func(_ mqtt.Client, msg mqtt.Message) {
+		received <- msg.Topic()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return received
+}
+
+// expect waits for the topics to be received in order.
+func expect(t *testing.T, received <-chan string, topics ...string) {
+	t.Helper()
+	var got []string
+	timeout := time.After(time.Second)
+	for len(got) < len(topics) {
+		select {
+		case topic := <-received:
+			got = append(got, topic)
+		case <-timeout:
+			t.Fatalf("received %v, want %v", got, topics)
+		}
+	}
+	if !reflect.DeepEqual(got, topics) {
+		t.Fatalf("received %v, want %v", got, topics)
+	}
+	select {
+	case topic := <-received:
+		t.Fatalf("received %s after %v", topic, topics)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestReplayOrdering(t *testing.T) {
+	r := NewReplay([]connect.Record{
+		publish("dev/hello"),
+		receive("dev/reply/1"),
+		receive("dev/reply/2"),
+		publish("dev/ack"),
+		receive("dev/reply/3"),
+	})
+	if err := r.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	received := subscribe(t, r, "dev/reply/#")
+
+	// Nothing is received before the device made the preceding publish.
+	expect(t, received)
+	if err := r.Publish("dev/hello", "hello").Error(); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, received, "dev/reply/1", "dev/reply/2")
+	if got := r.Remaining(); len(got) != 2 || got[0].Topic != "dev/ack" {
+		t.Fatalf("Remaining() = %v", got)
+	}
+
+	if err := r.Publish("dev/ack", "ack").Error(); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, received, "dev/reply/3")
+	if !r.Done() {
+		t.Errorf("Done() = false, remaining %v", r.Remaining())
+	}
+}
+
+func TestReplayWaitsForSubscription(t *testing.T) {
+	r := NewReplay([]connect.Record{
+		receive("dev/a"),
+		receive("dev/b"),
+	})
+	if err := r.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	other := subscribe(t, r, "other/#")
+	expect(t, other)
+
+	received := subscribe(t, r, "dev/+")
+	expect(t, received, "dev/a", "dev/b")
+	if !r.Done() {
+		t.Errorf("Done() = false, remaining %v", r.Remaining())
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	r := NewReplay([]connect.Record{
+		publish("dev/hello"),
+	})
+	reported := make(chan error, 10)
+	r.OnError(func(err error) { reported <- err })
+	if err := r.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Publish("dev/other", "hello").Error(); err != nil {
+		t.Fatal(err)
+	}
+	var mismatch *MismatchError
+	select {
+	case err := <-reported:
+		if !errors.As(err, &mismatch) || mismatch.Published.Topic != "dev/other" || mismatch.Expected.Topic != "dev/hello" {
+			t.Fatalf("reported %v, want a mismatch of dev/other", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("mismatch was not reported")
+	}
+	if n := len(r.Mismatches()); n != 1 {
+		t.Errorf("%d mismatches, want 1", n)
+	}
+
+	// The mismatch is not consumed, so the expected publish still matches.
+	if err := r.Publish("dev/hello", "hello").Error(); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Done() {
+		t.Errorf("Done() = false, remaining %v", r.Remaining())
+	}
+	r.Publish("dev/hello", "hello")
+	if n := len(r.Mismatches()); n != 2 {
+		t.Errorf("%d mismatches after the end of the recording, want 2", n)
+	}
+}
+
+func TestReplayMatch(t *testing.T) {
+	r := NewReplay([]connect.Record{
+		{Direction: connect.DirectionPublish, Topic: "dev/hello", Payload: []byte("hello")},
+	})
+	r.Match = func(recorded, published connect.Record) bool {
+		return recorded.Topic == published.Topic && string(recorded.Payload) == string(published.Payload)
+	}
+	if err := r.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	r.Publish("dev/hello", "bye")
+	if r.Done() || len(r.Mismatches()) != 1 {
+		t.Fatalf("publish with another payload matched")
+	}
+	r.Publish("dev/hello", "hello")
+	if !r.Done() {
+		t.Errorf("Done() = false, remaining %v", r.Remaining())
+	}
+}
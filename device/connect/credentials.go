@@ -0,0 +1,140 @@
+package connect
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoCredentials is returned if a CredentialsProvider found no AWS
+// credentials.
+var ErrNoCredentials = errors.New("no AWS credentials found")
+
+// Credentials are AWS IAM credentials used to sign websocket connections.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// CredentialsProvider returns the current AWS credentials. It is asked
+// every time a connection is signed, so it may return rotated credentials.
+type CredentialsProvider interface {
+	Retrieve() (Credentials, error)
+}
+
+type staticCredentials struct {
+	creds Credentials
+}
+
+// StaticCredentials always returns creds.
+func StaticCredentials(creds Credentials) CredentialsProvider {
+	return &staticCredentials{creds: creds}
+}
+
+func (p *staticCredentials) Retrieve() (Credentials, error) {
+	if p.creds.AccessKeyID == "" || p.creds.SecretAccessKey == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	return p.creds, nil
+}
+
+type envCredentials struct{}
+
+// EnvCredentials reads AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN from the environment.
+func EnvCredentials() CredentialsProvider {
+	return &envCredentials{}
+}
+
+func (p *envCredentials) Retrieve() (Credentials, error) {
+	creds := Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	return creds, nil
+}
+
+type fileCredentials struct {
+	path    string
+	profile string
+}
+
+// FileCredentials reads a profile of an AWS shared credentials file. The
+// path defaults to AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials and
+// the profile to AWS_PROFILE or default. The file is read on every
+// Retrieve so updates by an external process are picked up.
+func FileCredentials(path, profile string) CredentialsProvider {
+	return &fileCredentials{path: path, profile: profile}
+}
+
+func (p *fileCredentials) Retrieve() (Credentials, error) {
+	path := p.path
+	if path == "" {
+		path = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Credentials{}, fmt.Errorf("locating credentials file %v", err)
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := p.profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("opening credentials file %v", err)
+	}
+	defer f.Close()
+
+	var creds Credentials
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Credentials{}, fmt.Errorf("reading credentials file %v", err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return Credentials{}, fmt.Errorf("profile %s in %s: %w", profile, path, ErrNoCredentials)
+	}
+	return creds, nil
+}
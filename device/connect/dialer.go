@@ -0,0 +1,152 @@
+package connect
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// dialer holds what is needed to reach the broker: its URL, the TLS
+// configuration and the credentials. It is shared by the MQTT 3.1.1 and
+// MQTT 5 connections.
+type dialer struct {
+	Config     ConnectionConfiguration
+	cert       atomic.Value // *tls.Certificate
+	server     *url.URL
+	tlsConfig  *tls.Config
+	authorizer *authorizer
+
+	// The port and ALPN chosen by selectPort.
+	probed bool
+	alpn   bool
+}
+
+// newDialer validates config and builds the broker URL, using tlsScheme for
+// TransportMQTTS.
+func newDialer(config *ConnectionConfiguration, tlsScheme string) (*dialer, error) {
+	d := &dialer{}
+	var tlsCert tls.Certificate
+	var scheme string
+	switch config.Transport {
+	case "", TransportMQTTS:
+		if config.Authorizer != nil {
+			a, err := newAuthorizer(*config.Authorizer)
+			if err != nil {
+				return nil, err
+			}
+			// AWS IoT only accepts custom authorizers on port 443 with
+			// the "mqtt" ALPN protocol.
+			if config.Port != 0 && config.Port != ALPNPort {
+				return nil, fmt.Errorf("custom authorizer requires port %d, not %d", ALPNPort, config.Port)
+			}
+			config.Port = ALPNPort
+			config.ALPN = true
+			d.authorizer = a
+		} else {
+			cert, err := config.KeyPair.load()
+			if err != nil {
+				return nil, fmt.Errorf("failed to load certs: %v", err)
+			}
+			tlsCert = cert
+		}
+		scheme = tlsScheme
+	case TransportWSS, TransportWS:
+		if config.Credentials == nil {
+			return nil, fmt.Errorf("%s transport requires AWS credentials", config.Transport)
+		}
+		if config.Region == "" {
+			config.Region = regionFromEndpoint(config.Endpoint)
+		}
+		if config.Region == "" {
+			return nil, fmt.Errorf("cannot derive AWS region from endpoint %s", config.Endpoint)
+		}
+		scheme = config.Transport
+	default:
+		return nil, fmt.Errorf("unknown transport %q", config.Transport)
+	}
+
+	// Without a CA bundle the system roots are used.
+	var certs *x509.CertPool
+	if config.KeyPair.CACertificatePath != "" {
+		caPEM, err := ioutil.ReadFile(config.KeyPair.CACertificatePath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		certs = x509.NewCertPool()
+		certs.AppendCertsFromPEM(caPEM)
+	}
+
+	d.Config = *config
+	d.cert.Store(&tlsCert)
+	// The certificate is looked up on every handshake so it can be rotated
+	// without recreating the client.
+	d.tlsConfig = &tls.Config{
+		GetClientCertificate: d.clientCertificate,
+		RootCAs:              certs,
+	}
+
+	serverURL := fmt.Sprintf("%s://%s:%v", scheme, config.Endpoint, config.Port)
+	if scheme == TransportWSS || scheme == TransportWS {
+		serverURL += websocketPath
+	}
+	fmt.Printf("Preparing connection to %s\n", serverURL)
+	server, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing broker URL %v", err)
+	}
+	d.server = server
+	return d, nil
+}
+
+func (d *dialer) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return d.cert.Load().(*tls.Certificate), nil
+}
+
+// setKeyPair replaces the client certificate used by the next handshake.
+func (d *dialer) setKeyPair(kp KeyPair) error {
+	tlsCert, err := kp.load()
+	if err != nil {
+		return fmt.Errorf("failed to load certs: %v", err)
+	}
+	d.cert.Store(&tlsCert)
+	d.Config.KeyPair = kp
+	return nil
+}
+
+func (d *dialer) signed() bool {
+	return d.Config.Transport == TransportWSS || d.Config.Transport == TransportWS
+}
+
+// prepare updates the broker URL and credentials before every connection
+// attempt. The clients keep a pointer to the URL, so the changes are used
+// by the next attempt, which takes its TLS configuration from
+// attemptTLSConfig.
+func (d *dialer) prepare() error {
+	if d.signed() {
+		// The signature and temporary credentials expire.
+		return d.sign()
+	}
+	if d.authorizer != nil {
+		if err := d.authorizer.refresh(); err != nil {
+			return err
+		}
+	}
+	d.selectPort()
+	return nil
+}
+
+// sign replaces the SigV4 query of the broker URL.
+func (d *dialer) sign() error {
+	creds, err := d.Config.Credentials.Retrieve()
+	if err != nil {
+		return fmt.Errorf("retrieving AWS credentials %v", err)
+	}
+	d.server.RawQuery = presign(d.Config.Endpoint, d.Config.Region, creds, time.Now())
+	return nil
+}
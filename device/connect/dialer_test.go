@@ -0,0 +1,37 @@
+package connect
+
+import "testing"
+
+func authorizerConfig(port int) *ConnectionConfiguration {
+	return &ConnectionConfiguration{
+		Endpoint: "example-ats.iot.us-east-1.amazonaws.com",
+		Port:     port,
+		Authorizer: &AuthorizerConfiguration{
+			Name:         "authorizer",
+			TokenKeyName: "token",
+			Token:        StaticToken(AuthorizerToken{Token: "secret"}),
+		},
+	}
+}
+
+func TestAuthorizerUsesALPN(t *testing.T) {
+	for _, port := range []int{0, ALPNPort} {
+		d, err := newDialer(authorizerConfig(port), "tcps")
+		if err != nil {
+			t.Fatalf("port %d: %v", port, err)
+		}
+		d.selectPort()
+		if d.server.Port() != "443" || !d.alpn {
+			t.Errorf("port %d: dialing %s with ALPN %v", port, d.server.Host, d.alpn)
+		}
+		if protos := d.attemptTLSConfig().NextProtos; len(protos) != 1 || protos[0] != AuthorizerALPNProtocol {
+			t.Errorf("port %d: negotiating %v", port, protos)
+		}
+	}
+}
+
+func TestAuthorizerRejectsOtherPorts(t *testing.T) {
+	if _, err := newDialer(authorizerConfig(8883), "tcps"); err == nil {
+		t.Error("newDialer() with a custom authorizer on port 8883 succeeded")
+	}
+}
@@ -0,0 +1,91 @@
+package connect
+
+import (
+	"fmt"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// UserProperty is an MQTT 5 user property.
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// MessageProperties are the MQTT 5 properties of a received message.
+type MessageProperties struct {
+	CorrelationData []byte
+	ResponseTopic   string
+	ContentType     string
+	// MessageExpiry is the remaining lifetime in seconds, or nil if the
+	// message does not expire.
+	MessageExpiry *uint32
+	User          []UserProperty
+}
+
+// Properties returns the MQTT 5 properties of msg, or nil if msg was
+// received over MQTT 3.1.1.
+func Properties(msg mqtt.Message) *MessageProperties {
+	switch m := msg.(type) {
+	case *message:
+		return m.properties
+	case *Message:
+		return Properties(m.Message)
+	}
+	return nil
+}
+
+// message adapts an MQTT 5 publish to mqtt.Message, so the same handlers
+// serve both protocol versions.
+type message struct {
+	publish    *paho.Publish
+	properties *MessageProperties
+}
+
+func newMessage(p *paho.Publish) *message {
+	m := &message{publish: p, properties: &MessageProperties{}}
+	if p.Properties != nil {
+		m.properties.CorrelationData = p.Properties.CorrelationData
+		m.properties.ResponseTopic = p.Properties.ResponseTopic
+		m.properties.ContentType = p.Properties.ContentType
+		m.properties.MessageExpiry = p.Properties.MessageExpiry
+		for _, u := range p.Properties.User {
+			m.properties.User = append(m.properties.User, UserProperty{Key: u.Key, Value: u.Value})
+		}
+	}
+	return m
+}
+
+func (m *message) Duplicate() bool   { return false }
+func (m *message) Qos() byte         { return m.publish.QoS }
+func (m *message) Retained() bool    { return m.publish.Retain }
+func (m *message) Topic() string     { return m.publish.Topic }
+func (m *message) MessageID() uint16 { return m.publish.PacketID }
+func (m *message) Payload() []byte   { return m.publish.Payload }
+
+// Ack is a no-op as the MQTT 5 client acknowledges messages itself.
+func (m *message) Ack() {}
+
+// ReasonCodeError is returned when an MQTT 5 broker refuses a request.
+type ReasonCodeError struct {
+	Code   byte
+	Reason string
+}
+
+// Error implements error interface.
+func (e *ReasonCodeError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("reason code 0x%02x", e.Code)
+	}
+	return fmt.Sprintf("reason code 0x%02x: %s", e.Code, e.Reason)
+}
+
+// reasonCode returns a ReasonCodeError for failure codes, which are 0x80
+// and above.
+func reasonCode(code byte, reason string) error {
+	if code < 0x80 {
+		return nil
+	}
+	return &ReasonCodeError{Code: code, Reason: reason}
+}
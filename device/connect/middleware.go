@@ -0,0 +1,107 @@
+package connect
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Logger logs every routed message with the time its handler took.
+func Logger() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(msg *Message) error {
+			started := time.Now()
+			err := next(msg)
+			if err != nil {
+				fmt.Printf("[%s] %s failed after %v: %v\n", msg.Pattern, msg.Topic(), time.Since(started), err)
+				return err
+			}
+			fmt.Printf("[%s] %s handled in %v\n", msg.Pattern, msg.Topic(), time.Since(started))
+			return nil
+		}
+	}
+}
+
+// Recover turns a panic of a handler into an error, so one faulty handler
+// does not take down the device.
+func Recover() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(msg *Message) (err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					err = fmt.Errorf("handler panic %v\n%s", p, debug.Stack())
+				}
+			}()
+			return next(msg)
+		}
+	}
+}
+
+// DecodeJSON decodes the payload into the value returned by newValue and
+// stores it in Message.Value. Payloads that are not valid JSON are
+// rejected before reaching the handler.
+func DecodeJSON(newValue func() interface{}) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(msg *Message) error {
+			v := newValue()
+			if err := json.Unmarshal(msg.Payload(), v); err != nil {
+				return fmt.Errorf("decoding payload %v", err)
+			}
+			msg.Value = v
+			return next(msg)
+		}
+	}
+}
+
+// RouteStats are the counters of a route.
+type RouteStats struct {
+	Messages    uint64
+	Errors      uint64
+	LastMessage time.Time
+	// Duration is the total time spent in the handler.
+	Duration time.Duration
+}
+
+// RouterMetrics counts the messages handled per pattern. Add it to a
+// Router with Count.
+type RouterMetrics struct {
+	mu    sync.Mutex
+	stats map[string]RouteStats
+}
+
+// Count returns middleware that records every routed message in m.
+func (m *RouterMetrics) Count() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(msg *Message) error {
+			started := time.Now()
+			err := next(msg)
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if m.stats == nil {
+				m.stats = make(map[string]RouteStats)
+			}
+			s := m.stats[msg.Pattern]
+			s.Messages++
+			if err != nil {
+				s.Errors++
+			}
+			s.LastMessage = started
+			s.Duration += time.Since(started)
+			m.stats[msg.Pattern] = s
+			return err
+		}
+	}
+}
+
+// Stats returns the counters of every pattern that received a message.
+func (m *RouterMetrics) Stats() map[string]RouteStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make(map[string]RouteStats, len(m.stats))
+	for pattern, s := range m.stats {
+		stats[pattern] = s
+	}
+	return stats
+}
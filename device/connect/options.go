@@ -0,0 +1,225 @@
+package connect
+
+import (
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultQoS            = 1
+	defaultRequestTimeout = 30 * time.Second
+)
+
+// PublishOption configures a single publish.
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	qos             byte
+	retain          bool
+	timeout         time.Duration
+	ttl             time.Duration
+	priority        int
+	user            []UserProperty
+	responseTopic   string
+	correlationData []byte
+	contentType     string
+	basicIngestRule string
+	queue           bool
+}
+
+func newPublishOptions(opts []PublishOption) publishOptions {
+	o := publishOptions{qos: defaultQoS}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithQoS publishes the message with the given QoS level instead of 1.
+func WithQoS(qos byte) PublishOption {
+	return func(o *publishOptions) {
+		o.qos = qos
+	}
+}
+
+// WithRetain asks the broker to keep the message for future subscribers
+// of the topic.
+func WithRetain(retain bool) PublishOption {
+	return func(o *publishOptions) {
+		o.retain = retain
+	}
+}
+
+// WithQueue stores the message in the outbound queue, if one is
+// configured, when it cannot be sent right away and sends it once the
+// connection is back. Requests that expect a timely answer, such as those
+// of the shadow and jobs topics, should not be queued.
+func WithQueue() PublishOption {
+	return func(o *publishOptions) {
+		o.queue = true
+	}
+}
+
+// WithTimeout fails the publish with ErrTimeout if the broker has not
+// acknowledged it within timeout. Queued messages are not affected.
+func WithTimeout(timeout time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithTTL discards the message if it is still queued after ttl. Over
+// MQTT 5 it also sets the message expiry interval.
+func WithTTL(ttl time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.ttl = ttl
+	}
+}
+
+// WithPriority sets the priority used by the DropPriority policy. Messages
+// with a higher priority are kept longer.
+func WithPriority(priority int) PublishOption {
+	return func(o *publishOptions) {
+		o.priority = priority
+	}
+}
+
+// WithUserProperty adds an MQTT 5 user property. It is ignored over
+// MQTT 3.1.1.
+func WithUserProperty(key, value string) PublishOption {
+	return func(o *publishOptions) {
+		o.user = append(o.user, UserProperty{Key: key, Value: value})
+	}
+}
+
+// WithResponseTopic sets the MQTT 5 response topic. It is ignored over
+// MQTT 3.1.1.
+func WithResponseTopic(topic string) PublishOption {
+	return func(o *publishOptions) {
+		o.responseTopic = topic
+	}
+}
+
+// WithCorrelationData sets the MQTT 5 correlation data, which is returned
+// with the response to a request. It is ignored over MQTT 3.1.1.
+func WithCorrelationData(data []byte) PublishOption {
+	return func(o *publishOptions) {
+		o.correlationData = data
+	}
+}
+
+// WithContentType sets the MQTT 5 content type. It is ignored over
+// MQTT 3.1.1.
+func WithContentType(contentType string) PublishOption {
+	return func(o *publishOptions) {
+		o.contentType = contentType
+	}
+}
+
+// PublishSettings are the values set by publish options, for
+// implementations of Connection outside this package.
+type PublishSettings struct {
+	QoS             byte
+	Retain          bool
+	Timeout         time.Duration
+	TTL             time.Duration
+	Priority        int
+	User            []UserProperty
+	ResponseTopic   string
+	CorrelationData []byte
+	ContentType     string
+	Queue           bool
+}
+
+// ApplyPublishOptions returns the settings of opts.
+func ApplyPublishOptions(opts ...PublishOption) PublishSettings {
+	o := newPublishOptions(opts)
+	return PublishSettings{
+		QoS:             o.qos,
+		Retain:          o.retain,
+		Timeout:         o.timeout,
+		TTL:             o.ttl,
+		Priority:        o.priority,
+		User:            o.user,
+		ResponseTopic:   o.responseTopic,
+		CorrelationData: o.correlationData,
+		ContentType:     o.contentType,
+		Queue:           o.queue,
+	}
+}
+
+// queued creates the message stored in the outbound queue.
+func (o publishOptions) queued(topic string, payload []byte, defaultTTL time.Duration) *queuedMessage {
+	m := &queuedMessage{
+		Topic:           topic,
+		Payload:         payload,
+		QoS:             o.qos,
+		Retain:          o.retain,
+		Priority:        o.priority,
+		User:            o.user,
+		ResponseTopic:   o.responseTopic,
+		CorrelationData: o.correlationData,
+		ContentType:     o.contentType,
+	}
+	if ttl := o.ttl; ttl > 0 || defaultTTL > 0 {
+		if ttl == 0 {
+			ttl = defaultTTL
+		}
+		m.Expires = time.Now().Add(ttl)
+	}
+	return m
+}
+
+// SubscribeOption configures a subscription.
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	qos     byte
+	timeout time.Duration
+}
+
+func newSubscribeOptions(opts []SubscribeOption) subscribeOptions {
+	o := subscribeOptions{qos: defaultQoS, timeout: defaultRequestTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithSubscribeQoS subscribes with the given maximum QoS instead of 1.
+// It does not apply to SubscribeMultiple, where every Subscription has
+// its own QoS.
+func WithSubscribeQoS(qos byte) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.qos = qos
+	}
+}
+
+// WithSubscribeTimeout sets how long to wait for the broker to confirm the
+// subscription.
+func WithSubscribeTimeout(timeout time.Duration) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.timeout = timeout
+	}
+}
+
+// SubscribeSettings are the values set by subscribe options, for
+// implementations of Connection outside this package.
+type SubscribeSettings struct {
+	QoS     byte
+	Timeout time.Duration
+}
+
+// ApplySubscribeOptions returns the settings of opts.
+func ApplySubscribeOptions(opts ...SubscribeOption) SubscribeSettings {
+	o := newSubscribeOptions(opts)
+	return SubscribeSettings{QoS: o.qos, Timeout: o.timeout}
+}
+
+// Subscription is a topic filter subscribed with SubscribeMultiple.
+type Subscription struct {
+	Topic   string
+	QoS     byte
+	Handler mqtt.MessageHandler
+}
@@ -0,0 +1,366 @@
+package connect
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Drop policies of a full outbound queue.
+const (
+	// DropOldest discards the oldest queued message.
+	DropOldest = "oldest"
+	// DropNewest rejects the message being published.
+	DropNewest = "newest"
+	// DropPriority discards the oldest message with the lowest priority.
+	DropPriority = "priority"
+)
+
+const (
+	defaultQueueMaxMessages = 1000
+	defaultQueueMaxBytes    = 10 * 1024 * 1024
+	queueRetryInterval      = 5 * time.Second
+	queueFileSuffix         = ".msg"
+)
+
+// ErrQueueFull is returned for messages dropped because the outbound queue
+// is full.
+var ErrQueueFull = errors.New("outbound queue is full")
+
+// QueueConfiguration configures the outbound queue. The queue is disabled
+// if Directory is empty.
+type QueueConfiguration struct {
+	// Directory holds one file per queued message.
+	Directory string
+	// MaxMessages is the maximum number of queued messages.
+	MaxMessages int
+	// MaxBytes is the maximum size of all queued payloads.
+	MaxBytes int64
+	// DropPolicy decides which message is dropped when the queue is full.
+	DropPolicy string
+	// TTL is the default time to live of queued messages. Zero keeps them
+	// until they are sent.
+	TTL time.Duration
+}
+
+type queuedMessage struct {
+	Seq      uint64    `json:"seq"`
+	Topic    string    `json:"topic"`
+	Payload  []byte    `json:"payload"`
+	QoS      byte      `json:"qos"`
+	Retain   bool      `json:"retain,omitempty"`
+	Priority int       `json:"priority"`
+	Expires  time.Time `json:"expires,omitempty"`
+
+	// MQTT 5 properties.
+	User            []UserProperty `json:"user,omitempty"`
+	ResponseTopic   string         `json:"responseTopic,omitempty"`
+	CorrelationData []byte         `json:"correlationData,omitempty"`
+	ContentType     string         `json:"contentType,omitempty"`
+}
+
+func (m *queuedMessage) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && now.After(m.Expires)
+}
+
+// queue is a bounded, disk backed FIFO of messages published while the
+// connection is down. Messages are kept in memory as well and the files
+// are only read on startup.
+type queue struct {
+	config   QueueConfiguration
+	mu       sync.Mutex
+	messages []*queuedMessage
+	size     int64
+	seq      uint64
+	notify   chan struct{}
+}
+
+func newQueue(config QueueConfiguration) (*queue, error) {
+	if config.MaxMessages == 0 {
+		config.MaxMessages = defaultQueueMaxMessages
+	}
+	if config.MaxBytes == 0 {
+		config.MaxBytes = defaultQueueMaxBytes
+	}
+	switch config.DropPolicy {
+	case "":
+		config.DropPolicy = DropOldest
+	case DropOldest, DropNewest, DropPriority:
+	default:
+		return nil, fmt.Errorf("unknown queue drop policy %q", config.DropPolicy)
+	}
+	if err := os.MkdirAll(config.Directory, 0700); err != nil {
+		return nil, fmt.Errorf("creating queue directory %v", err)
+	}
+
+	q := &queue{
+		config: config,
+		notify: make(chan struct{}, 1),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// load reads the messages left over from a previous run.
+func (q *queue) load() error {
+	files, err := ioutil.ReadDir(q.config.Directory)
+	if err != nil {
+		return fmt.Errorf("reading queue directory %v", err)
+	}
+	now := time.Now()
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), queueFileSuffix) {
+			continue
+		}
+		path := filepath.Join(q.config.Directory, f.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading queued message %v", err)
+		}
+		var m queuedMessage
+		if err := json.Unmarshal(data, &m); err != nil || m.expired(now) {
+			if err != nil {
+				fmt.Printf("Discarding corrupt queued message %s %v\n", f.Name(), err)
+			}
+			os.Remove(path)
+			continue
+		}
+		q.messages = append(q.messages, &m)
+		q.size += int64(len(m.Payload))
+	}
+	sort.Slice(q.messages, func(i, j int) bool {
+		return q.messages[i].Seq < q.messages[j].Seq
+	})
+	if n := len(q.messages); n > 0 {
+		q.seq = q.messages[n-1].Seq
+		fmt.Printf("Loaded %d queued messages\n", n)
+	}
+	return nil
+}
+
+func (q *queue) path(seq uint64) string {
+	return filepath.Join(q.config.Directory, fmt.Sprintf("%020d%s", seq, queueFileSuffix))
+}
+
+// reserve gives m its place in the queue before it is published directly,
+// so that it is queued ahead of later messages if it has to be requeued.
+func (q *queue) reserve(m *queuedMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	m.Seq = q.seq
+}
+
+// push persists m at its place in the queue, making room according to
+// the drop policy. Messages without a reserved place go to the end.
+func (q *queue) push(m *queuedMessage) error {
+	if int64(len(m.Payload)) > q.config.MaxBytes {
+		return ErrQueueFull
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.purge(time.Now())
+	for len(q.messages) >= q.config.MaxMessages || q.size+int64(len(m.Payload)) > q.config.MaxBytes {
+		i := 0
+		switch q.config.DropPolicy {
+		case DropNewest:
+			return ErrQueueFull
+		case DropPriority:
+			for j, queued := range q.messages {
+				if queued.Priority < q.messages[i].Priority {
+					i = j
+				}
+			}
+			if q.messages[i].Priority > m.Priority {
+				return ErrQueueFull
+			}
+		}
+		fmt.Printf("Outbound queue full, dropping message for %s\n", q.messages[i].Topic)
+		q.removeAt(i)
+	}
+
+	if m.Seq == 0 {
+		q.seq++
+		m.Seq = q.seq
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshaling queued message %v", err)
+	}
+	if err := writeFile(q.path(m.Seq), data); err != nil {
+		return fmt.Errorf("writing queued message %v", err)
+	}
+	i := sort.Search(len(q.messages), func(i int) bool {
+		return q.messages[i].Seq > m.Seq
+	})
+	q.messages = append(q.messages, nil)
+	copy(q.messages[i+1:], q.messages[i:])
+	q.messages[i] = m
+	q.size += int64(len(m.Payload))
+
+	q.signal()
+	return nil
+}
+
+// signal wakes up the flush loop.
+func (q *queue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the queued messages in order with send whenever online
+// reports the connection is up, until stop is closed.
+func (q *queue) run(stop <-chan struct{}, online func() bool, send func(m *queuedMessage) error) {
+	ticker := time.NewTicker(queueRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-q.notify:
+		case <-ticker.C:
+		}
+
+		for online() {
+			m := q.peek()
+			if m == nil {
+				break
+			}
+			if err := send(m); err != nil {
+				if err != ErrClosed {
+					fmt.Printf("publishing queued message %v\n", err)
+				}
+				break
+			}
+			q.remove(m)
+		}
+	}
+}
+
+// expire applies the default TTL of q to m if it has none.
+func (q *queue) expire(m *queuedMessage) {
+	if m.Expires.IsZero() && q.config.TTL > 0 {
+		m.Expires = time.Now().Add(q.config.TTL)
+	}
+}
+
+// requeue pushes m to q if publishing it directly failed with err, as
+// the connection went down in the meantime. m goes back to the place it
+// reserved, ahead of the messages queued while it was in flight.
+// Messages that timed out may still arrive and are not sent again.
+func (q *queue) requeue(m *queuedMessage, err error) error {
+	if err == nil || errors.Is(err, ErrTimeout) || errors.Is(err, ErrClosed) {
+		return err
+	}
+	var rc *ReasonCodeError
+	if errors.As(err, &rc) {
+		// Refused by the broker, sending it again would not help.
+		return err
+	}
+	fmt.Printf("publishing %v, queueing message for %s\n", err, m.Topic)
+	return q.push(m)
+}
+
+// peek returns the oldest message that has not expired.
+func (q *queue) peek() *queuedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.purge(time.Now())
+	if len(q.messages) == 0 {
+		return nil
+	}
+	return q.messages[0]
+}
+
+// remove deletes m once it has been sent. It may already have been dropped.
+func (q *queue) remove(m *queuedMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, queued := range q.messages {
+		if queued.Seq == m.Seq {
+			q.removeAt(i)
+			return
+		}
+	}
+}
+
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+func (q *queue) purge(now time.Time) {
+	for i := 0; i < len(q.messages); {
+		if q.messages[i].expired(now) {
+			q.removeAt(i)
+			continue
+		}
+		i++
+	}
+}
+
+func (q *queue) removeAt(i int) {
+	m := q.messages[i]
+	if err := os.Remove(q.path(m.Seq)); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("removing queued message %v\n", err)
+	}
+	q.messages = append(q.messages[:i], q.messages[i+1:]...)
+	q.size -= int64(len(m.Payload))
+}
+
+// writeFile writes data through a temporary file so a crash never leaves
+// a partial message behind.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// payloadBytes converts the payload types accepted by paho to bytes.
+func payloadBytes(payload interface{}) ([]byte, error) {
+	switch p := payload.(type) {
+	case []byte:
+		return p, nil
+	case string:
+		return []byte(p), nil
+	case bytes.Buffer:
+		return p.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported payload type %T", payload)
+	}
+}
@@ -0,0 +1,242 @@
+package connect
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T, config QueueConfiguration) *queue {
+	t.Helper()
+	config.Directory = t.TempDir()
+	q, err := newQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func pushTopics(t *testing.T, q *queue, topics ...string) {
+	t.Helper()
+	for _, topic := range topics {
+		if err := q.push(&queuedMessage{Topic: topic, Payload: []byte(topic)}); err != nil {
+			t.Fatalf("push(%s) %v", topic, err)
+		}
+	}
+}
+
+// queuedTopics returns the topics of the queued messages in order.
+func queuedTopics(q *queue) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	topics := []string{}
+	for _, m := range q.messages {
+		topics = append(topics, m.Topic)
+	}
+	return topics
+}
+
+func TestQueueDropPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   []string
+		err    error
+	}{
+		{DropOldest, []string{"b", "c", "d"}, nil},
+		{DropNewest, []string{"a", "b", "c"}, ErrQueueFull},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			q := newTestQueue(t, QueueConfiguration{MaxMessages: 3, DropPolicy: tt.policy})
+			pushTopics(t, q, "a", "b", "c")
+			if err := q.push(&queuedMessage{Topic: "d"}); err != tt.err {
+				t.Errorf("push() = %v, want %v", err, tt.err)
+			}
+			if got := queuedTopics(q); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("queued %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueDropPriority(t *testing.T) {
+	q := newTestQueue(t, QueueConfiguration{MaxMessages: 3, DropPolicy: DropPriority})
+	for i, priority := range []int{1, 0, 0} {
+		m := &queuedMessage{Topic: fmt.Sprint(i), Priority: priority}
+		if err := q.push(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The oldest message with the lowest priority makes room.
+	if err := q.push(&queuedMessage{Topic: "3", Priority: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queuedTopics(q), []string{"0", "2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+
+	// A message with a lower priority than all queued ones is rejected.
+	q.push(&queuedMessage{Topic: "4", Priority: 1})
+	if err := q.push(&queuedMessage{Topic: "5", Priority: 0}); err != ErrQueueFull {
+		t.Errorf("push() = %v, want %v", err, ErrQueueFull)
+	}
+	if got, want := queuedTopics(q), []string{"0", "3", "4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+}
+
+func TestQueueMaxBytes(t *testing.T) {
+	q := newTestQueue(t, QueueConfiguration{MaxBytes: 4})
+	if err := q.push(&queuedMessage{Topic: "big", Payload: []byte("12345")}); err != ErrQueueFull {
+		t.Errorf("push() = %v, want %v", err, ErrQueueFull)
+	}
+	pushTopics(t, q, "ab", "cd", "ef")
+	if got, want := queuedTopics(q), []string{"cd", "ef"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+}
+
+func TestQueueTTL(t *testing.T) {
+	q := newTestQueue(t, QueueConfiguration{TTL: time.Hour})
+	old := &queuedMessage{Topic: "old", Expires: time.Now().Add(-time.Second)}
+	if err := q.push(old); err != nil {
+		t.Fatal(err)
+	}
+	m := &queuedMessage{Topic: "new"}
+	q.expire(m)
+	if m.Expires.IsZero() {
+		t.Fatal("expire() did not apply the default TTL")
+	}
+	if err := q.push(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := q.peek(); got == nil || got.Topic != "new" {
+		t.Errorf("peek() = %v, want the message for new", got)
+	}
+	if n := q.len(); n != 1 {
+		t.Errorf("len() = %d, want 1", n)
+	}
+}
+
+func TestQueueReload(t *testing.T) {
+	config := QueueConfiguration{Directory: t.TempDir()}
+	q, err := newQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushTopics(t, q, "a", "b", "c")
+	q.remove(q.peek())
+	q.push(&queuedMessage{Topic: "expired", Expires: time.Now().Add(-time.Second)})
+
+	q, err = newQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queuedTopics(q), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("reloaded %v, want %v", got, want)
+	}
+	pushTopics(t, q, "d")
+	if got, want := queuedTopics(q), []string{"b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+}
+
+func TestQueueRunSendsInOrder(t *testing.T) {
+	q := newTestQueue(t, QueueConfiguration{})
+	pushTopics(t, q, "a", "b", "c")
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	sent := make(chan string, 10)
+	failed := false
+	go func() {
+		defer close(done)
+		q.run(stop, func() bool { return true }, func(m *queuedMessage) error {
+			// The first attempt of b fails and is retried before c without
+			// waiting for the retry interval.
+			if m.Topic == "b" && !failed {
+				failed = true
+				q.signal()
+				return errors.New("connection lost")
+			}
+			sent <- m.Topic
+			return nil
+		})
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	var got []string
+	timeout := time.After(2 * queueRetryInterval)
+	for len(got) < 3 {
+		select {
+		case topic := <-sent:
+			got = append(got, topic)
+		case <-timeout:
+			t.Fatalf("sent %v before timing out", got)
+		}
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
+
+func TestQueueRequeue(t *testing.T) {
+	q := newTestQueue(t, QueueConfiguration{})
+	for _, err := range []error{nil, ErrTimeout, ErrClosed, &ReasonCodeError{}} {
+		if got := q.requeue(&queuedMessage{Topic: "a"}, err); got != err {
+			t.Errorf("requeue(%v) = %v", err, got)
+		}
+	}
+	if n := q.len(); n != 0 {
+		t.Fatalf("len() = %d, want 0", n)
+	}
+	if err := q.requeue(&queuedMessage{Topic: "a"}, errors.New("connection lost")); err != nil {
+		t.Errorf("requeue() = %v", err)
+	}
+	if n := q.len(); n != 1 {
+		t.Errorf("len() = %d, want 1", n)
+	}
+}
+
+func TestQueueRequeueKeepsOrder(t *testing.T) {
+	config := QueueConfiguration{Directory: t.TempDir()}
+	q, err := newQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a and b are published directly, c is queued while they are in
+	// flight and both fail.
+	a, b := &queuedMessage{Topic: "a"}, &queuedMessage{Topic: "b"}
+	q.reserve(a)
+	q.reserve(b)
+	pushTopics(t, q, "c")
+	lost := errors.New("connection lost")
+	if err := q.requeue(b, lost); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.requeue(a, lost); err != nil {
+		t.Fatal(err)
+	}
+	pushTopics(t, q, "d")
+	want := []string{"a", "b", "c", "d"}
+	if got := queuedTopics(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+	if m := q.peek(); m != a {
+		t.Errorf("peek() = %+v, want a", m)
+	}
+
+	q, err = newQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := queuedTopics(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("reloaded %v, want %v", got, want)
+	}
+}
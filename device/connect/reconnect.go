@@ -0,0 +1,152 @@
+package connect
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInitialInterval = 1 * time.Second
+	defaultMaxInterval     = 2 * time.Minute
+	defaultMultiplier      = 2
+	defaultConnectTimeout  = 30 * time.Second
+)
+
+// ErrReconnectFailed is reported if the connection gave up reconnecting
+// after ReconnectPolicy.MaxAttempts attempts.
+var ErrReconnectFailed = errors.New("giving up reconnecting")
+
+// ReconnectPolicy controls how a lost connection is re-established. The
+// delay before every attempt is drawn at random up to an exponentially
+// growing bound, so devices that lost their connection at the same time
+// do not reconnect in lockstep.
+type ReconnectPolicy struct {
+	// InitialInterval bounds the delay of the first attempt. It defaults
+	// to 1s.
+	InitialInterval time.Duration
+	// MaxInterval bounds the delay of all attempts. It defaults to 2m.
+	MaxInterval time.Duration
+	// Multiplier grows the bound after every failed attempt. It defaults
+	// to 2.
+	Multiplier float64
+	// MaxAttempts is the number of attempts before giving up. Zero retries
+	// forever.
+	MaxAttempts int
+	// ConnectTimeout bounds a single connection attempt. It defaults to
+	// 30s.
+	ConnectTimeout time.Duration
+}
+
+func (p *ReconnectPolicy) initialInterval() time.Duration {
+	if p.InitialInterval <= 0 {
+		return defaultInitialInterval
+	}
+	return p.InitialInterval
+}
+
+func (p *ReconnectPolicy) maxInterval() time.Duration {
+	if p.MaxInterval <= 0 {
+		return defaultMaxInterval
+	}
+	return p.MaxInterval
+}
+
+func (p *ReconnectPolicy) multiplier() float64 {
+	if p.Multiplier < 1 {
+		return defaultMultiplier
+	}
+	return p.Multiplier
+}
+
+func (p *ReconnectPolicy) connectTimeout() time.Duration {
+	if p.ConnectTimeout <= 0 {
+		return defaultConnectTimeout
+	}
+	return p.ConnectTimeout
+}
+
+// bound returns the upper bound of the delay before the nth attempt,
+// counting from 1.
+func (p *ReconnectPolicy) bound(n int) time.Duration {
+	max := p.maxInterval()
+	d := float64(p.initialInterval())
+	for i := 1; i < n && d < float64(max); i++ {
+		d *= p.multiplier()
+	}
+	if d > float64(max) {
+		return max
+	}
+	return time.Duration(d)
+}
+
+// Metrics counts the reconnect attempts of a Connection.
+type Metrics struct {
+	// Attempts is the number of reconnect attempts.
+	Attempts uint64
+	// Failures is the number of attempts that failed.
+	Failures uint64
+	// Reconnects is the number of times the connection was re-established.
+	Reconnects uint64
+	// LastAttempt is the time of the latest attempt.
+	LastAttempt time.Time
+	// LastError is the reason the latest attempt failed.
+	LastError error
+}
+
+// reconnector schedules the reconnect attempts of a connection according
+// to its policy and keeps the metrics.
+type reconnector struct {
+	policy   ReconnectPolicy
+	mu       sync.Mutex
+	rand     *rand.Rand
+	attempts int
+	metrics  Metrics
+}
+
+func newReconnector(policy ReconnectPolicy) reconnector {
+	return reconnector{
+		policy: policy,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next counts an attempt and returns the delay to wait before making it,
+// or ErrReconnectFailed if there are no attempts left.
+func (r *reconnector) next() (time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.policy.MaxAttempts > 0 && r.attempts >= r.policy.MaxAttempts {
+		return 0, ErrReconnectFailed
+	}
+	r.attempts++
+	r.metrics.Attempts++
+	r.metrics.LastAttempt = time.Now()
+	bound := r.policy.bound(r.attempts)
+	return time.Duration(r.rand.Int63n(int64(bound) + 1)), nil
+}
+
+func (r *reconnector) failed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics.Failures++
+	r.metrics.LastError = err
+}
+
+// succeeded resets the attempts once the connection is up.
+func (r *reconnector) succeeded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.attempts > 0 {
+		r.metrics.Reconnects++
+	}
+	r.attempts = 0
+}
+
+// Metrics returns the reconnect metrics of the connection.
+func (r *reconnector) Metrics() Metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.metrics
+}
@@ -0,0 +1,94 @@
+package connect
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestReconnectPolicyBound(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ReconnectPolicy
+		want   []time.Duration
+	}{
+		{
+			name: "defaults",
+			want: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		{
+			name:   "capped",
+			policy: ReconnectPolicy{InitialInterval: time.Second, MaxInterval: 5 * time.Second, Multiplier: 3},
+			want:   []time.Duration{time.Second, 3 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:   "multiplier below one",
+			policy: ReconnectPolicy{InitialInterval: 100 * time.Millisecond, Multiplier: 0.5},
+			want:   []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond},
+		},
+		{
+			name:   "initial above max",
+			policy: ReconnectPolicy{InitialInterval: time.Minute, MaxInterval: time.Second},
+			want:   []time.Duration{time.Second, time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.want {
+				if got := tt.policy.bound(i + 1); got != want {
+					t.Errorf("bound(%d) = %v, want %v", i+1, got, want)
+				}
+			}
+		})
+	}
+
+	// Large attempt counts do not overflow.
+	var p ReconnectPolicy
+	if got := p.bound(10000); got != defaultMaxInterval {
+		t.Errorf("bound(10000) = %v, want %v", got, defaultMaxInterval)
+	}
+}
+
+func TestReconnectorJitter(t *testing.T) {
+	r := newReconnector(ReconnectPolicy{InitialInterval: time.Second, MaxInterval: 4 * time.Second})
+	r.rand = rand.New(rand.NewSource(1))
+
+	distinct := map[time.Duration]bool{}
+	for i := 1; i <= 100; i++ {
+		d, err := r.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bound := r.policy.bound(i); d < 0 || d > bound {
+			t.Fatalf("delay %v of attempt %d is outside [0, %v]", d, i, bound)
+		}
+		distinct[d] = true
+	}
+	if len(distinct) < 90 {
+		t.Errorf("only %d distinct delays in 100 attempts", len(distinct))
+	}
+}
+
+func TestReconnectorMaxAttempts(t *testing.T) {
+	r := newReconnector(ReconnectPolicy{InitialInterval: time.Millisecond, MaxAttempts: 2})
+	for i := 0; i < 2; i++ {
+		if _, err := r.next(); err != nil {
+			t.Fatalf("attempt %d %v", i+1, err)
+		}
+		r.failed(errors.New("refused"))
+	}
+	if _, err := r.next(); err != ErrReconnectFailed {
+		t.Fatalf("next() = %v, want %v", err, ErrReconnectFailed)
+	}
+
+	// A successful attempt makes the attempts available again.
+	r.succeeded()
+	if _, err := r.next(); err != nil {
+		t.Fatalf("next() after success %v", err)
+	}
+	m := r.Metrics()
+	if m.Attempts != 3 || m.Failures != 2 || m.Reconnects != 1 || m.LastError == nil {
+		t.Errorf("Metrics() = %+v", m)
+	}
+}
@@ -0,0 +1,252 @@
+package connect
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/randyridgley/simple-go-iot-device/device/codec"
+)
+
+// Directions of recorded messages.
+const (
+	// DirectionPublish is a message published by the device.
+	DirectionPublish = "publish"
+	// DirectionReceive is a message received by the device.
+	DirectionReceive = "receive"
+)
+
+// Record is a message published or received on a connection.
+type Record struct {
+	Time      time.Time
+	Direction string
+	Topic     string
+	QoS       byte
+	Retained  bool
+	Payload   []byte
+}
+
+// recordJSON is a line of a recording. Payloads are kept as text when
+// they are valid UTF-8 so recordings of JSON APIs stay readable.
+type recordJSON struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Topic     string    `json:"topic"`
+	QoS       byte      `json:"qos"`
+	Retained  bool      `json:"retained,omitempty"`
+	Payload   *string   `json:"payload,omitempty"`
+	Binary    []byte    `json:"binary,omitempty"`
+}
+
+func (r Record) MarshalJSON() ([]byte, error) {
+	j := recordJSON{
+		Time:      r.Time,
+		Direction: r.Direction,
+		Topic:     r.Topic,
+		QoS:       r.QoS,
+		Retained:  r.Retained,
+	}
+	if utf8.Valid(r.Payload) {
+		s := string(r.Payload)
+		j.Payload = &s
+	} else {
+		j.Binary = r.Payload
+	}
+	return json.Marshal(j)
+}
+
+func (r *Record) UnmarshalJSON(data []byte) error {
+	var j recordJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*r = Record{
+		Time:      j.Time,
+		Direction: j.Direction,
+		Topic:     j.Topic,
+		QoS:       j.QoS,
+		Retained:  j.Retained,
+		Payload:   j.Binary,
+	}
+	if j.Payload != nil {
+		r.Payload = []byte(*j.Payload)
+	}
+	return nil
+}
+
+// ReadRecording reads the records written by a Recorder.
+func ReadRecording(r io.Reader) ([]Record, error) {
+	var records []Record
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1<<28)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("reading record on line %d %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("reading recording %v", err)
+	}
+	return records, nil
+}
+
+// redacted is the value recorded in place of credentials.
+const redacted = "REDACTED"
+
+// credentialTopics are the prefixes of the topics whose payloads carry
+// credentials, and credentialFields the fields holding them.
+var (
+	credentialTopics = []string{"$aws/certificates/", "$aws/provisioning-templates/"}
+	credentialFields = map[string]bool{"privateKey": true, "certificateOwnershipToken": true}
+)
+
+// Recorder is a Connection that writes every message published and
+// received on the wrapped connection to w, one JSON record per line.
+// Private keys and certificate ownership tokens of the provisioning topics
+// are recorded as REDACTED, so replayed provisioning yields unusable
+// credentials. Errors writing the recording are passed to the OnError
+// handler.
+type Recorder struct {
+	Connection
+
+	mu      sync.Mutex
+	w       io.Writer
+	onError func(error)
+}
+
+// NewRecorder wraps conn to record its messages to w.
+func NewRecorder(conn Connection, w io.Writer) *Recorder {
+	return &Recorder{Connection: conn, w: w}
+}
+
+func (r *Recorder) Publish(topic string, payload interface{}, opts ...PublishOption) mqtt.Token {
+	o := newPublishOptions(opts)
+	// Publishes that fail these checks fail below and are not recorded.
+	sent, topicErr := o.topic(topic)
+	if data, err := payloadBytes(payload); err == nil && topicErr == nil {
+		r.record(Record{
+			Time:      time.Now(),
+			Direction: DirectionPublish,
+			Topic:     sent,
+			QoS:       o.qos,
+			Retained:  o.retain,
+			Payload:   data,
+		})
+	}
+	return r.Connection.Publish(topic, payload, opts...)
+}
+
+func (r *Recorder) Subscribe(topic string, handler mqtt.MessageHandler, opts ...SubscribeOption) error {
+	return r.Connection.Subscribe(topic, r.handler(handler), opts...)
+}
+
+func (r *Recorder) SubscribeMultiple(subs []Subscription, opts ...SubscribeOption) error {
+	recorded := make([]Subscription, len(subs))
+	for i, sub := range subs {
+		sub.Handler = r.handler(sub.Handler)
+		recorded[i] = sub
+	}
+	return r.Connection.SubscribeMultiple(recorded, opts...)
+}
+
+func (r *Recorder) OnError(handler func(error)) {
+	r.mu.Lock()
+	r.onError = handler
+	r.mu.Unlock()
+	r.Connection.OnError(handler)
+}
+
+// handler records the messages passed to handler.
+func (r *Recorder) handler(handler mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		r.record(Record{
+			Time:      time.Now(),
+			Direction: DirectionReceive,
+			Topic:     msg.Topic(),
+			QoS:       msg.Qos(),
+			Retained:  msg.Retained(),
+			Payload:   msg.Payload(),
+		})
+		handler(client, msg)
+	}
+}
+
+func (r *Recorder) record(rec Record) {
+	rec.Payload = redact(rec.Topic, rec.Payload)
+	data, err := json.Marshal(rec)
+	if err != nil {
+		r.handleError(fmt.Errorf("encoding record %v", err))
+		return
+	}
+	r.mu.Lock()
+	_, err = r.w.Write(append(data, '\n'))
+	r.mu.Unlock()
+	if err != nil {
+		r.handleError(fmt.Errorf("writing recording %v", err))
+	}
+}
+
+func (r *Recorder) handleError(err error) {
+	r.mu.Lock()
+	cb := r.onError
+	r.mu.Unlock()
+	if cb == nil {
+		fmt.Println(err)
+		return
+	}
+	cb(err)
+}
+
+// redact replaces the credentials in payloads of the credential topics.
+// Payloads that cannot be decoded are not recorded at all.
+func redact(topic string, payload []byte) []byte {
+	sensitive := false
+	for _, prefix := range credentialTopics {
+		sensitive = sensitive || strings.HasPrefix(topic, prefix)
+	}
+	if !sensitive || len(payload) == 0 {
+		return payload
+	}
+	c := codec.JSON
+	if strings.Contains(topic+"/", "/cbor/") {
+		c = codec.CBOR
+	}
+	var v interface{}
+	if err := c.Unmarshal(payload, &v); err != nil {
+		return []byte(redacted)
+	}
+	data, err := c.Marshal(redactValue(v))
+	if err != nil {
+		return []byte(redacted)
+	}
+	return data
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if credentialFields[key] {
+				v[key] = redacted
+			} else {
+				v[key] = redactValue(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactValue(value)
+		}
+	}
+	return v
+}
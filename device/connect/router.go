@@ -0,0 +1,268 @@
+package connect
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ErrInvalidPattern is returned for topic patterns a Router cannot
+// subscribe to.
+var ErrInvalidPattern = errors.New("invalid topic pattern")
+
+// Params are the values of the topic variables of a matched pattern.
+type Params map[string]string
+
+// Message is a message delivered by a Router.
+type Message struct {
+	mqtt.Message
+	// Pattern is the pattern of the route that matched.
+	Pattern string
+	// Params holds the topic variables of Pattern.
+	Params Params
+	// Value is the payload decoded by a decoding middleware, if any.
+	Value interface{}
+}
+
+// HandlerFunc handles a message delivered by a Router. A returned error is
+// reported to the OnError handler of the router.
+type HandlerFunc func(msg *Message) error
+
+// Middleware wraps a HandlerFunc, for example to log or decode messages.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Router dispatches messages to handlers registered on topic patterns.
+//
+// A pattern is an MQTT topic filter whose levels may also be variables
+// in braces, which match a single level like + and are passed to the
+// handler in Message.Params:
+//
+//	$aws/things/{thingName}/jobs/{jobId}/get/accepted
+type Router interface {
+	// Use adds middleware to the routes registered afterwards. Middleware
+	// runs in the order it was added.
+	Use(mw ...Middleware)
+	// Handle subscribes to pattern and routes its messages to handler.
+	// Patterns that share a topic filter share its subscription and
+	// fail together if it cannot be made.
+	Handle(pattern string, handler HandlerFunc, opts ...SubscribeOption) error
+	// Remove unsubscribes from pattern.
+	Remove(pattern string) error
+	// OnError sets handler of errors returned by handlers.
+	OnError(func(error))
+}
+
+type router struct {
+	conn       Connection
+	mu         sync.Mutex
+	middleware []Middleware
+	filters    map[string]*subscription
+	onError    func(error)
+}
+
+// subscription holds the routes of a topic filter. Routes added while
+// the filter is being subscribed wait for the result with done.
+type subscription struct {
+	routes []*route
+	done   chan struct{}
+	// err is the error of the SUBSCRIBE, set before done is closed.
+	err error
+}
+
+type route struct {
+	*pattern
+	handler HandlerFunc
+}
+
+// NewRouter creates a Router that subscribes with conn.
+func NewRouter(conn Connection) Router {
+	return &router{
+		conn:    conn,
+		filters: make(map[string]*subscription),
+	}
+}
+
+func (r *router) Use(mw ...Middleware) {
+	r.mu.Lock()
+	r.middleware = append(r.middleware, mw...)
+	r.mu.Unlock()
+}
+
+func (r *router) Handle(pattern string, handler HandlerFunc, opts ...SubscribeOption) error {
+	p, err := parsePattern(pattern)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](handler)
+	}
+	rt := &route{pattern: p, handler: handler}
+	if sub, ok := r.filters[p.filter]; ok {
+		for _, other := range sub.routes {
+			if other.raw == pattern {
+				r.mu.Unlock()
+				return fmt.Errorf("routing %s already registered", pattern)
+			}
+		}
+		sub.routes = append(sub.routes, rt)
+		r.mu.Unlock()
+		// The filter may still be being subscribed to.
+		<-sub.done
+		return sub.err
+	}
+	sub := &subscription{routes: []*route{rt}, done: make(chan struct{})}
+	r.filters[p.filter] = sub
+	r.mu.Unlock()
+
+	filter := p.filter
+	err = r.conn.Subscribe(filter, func(_ mqtt.Client, msg mqtt.Message) {
+		r.dispatch(filter, msg)
+	}, opts...)
+	r.mu.Lock()
+	if err != nil {
+		// The routes added in the meantime fail with this one, so the
+		// next Handle subscribes again.
+		sub.err = err
+		if r.filters[filter] == sub {
+			delete(r.filters, filter)
+		}
+	}
+	close(sub.done)
+	r.mu.Unlock()
+	return err
+}
+
+func (r *router) Remove(pattern string) error {
+	p, err := parsePattern(pattern)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	sub, ok := r.filters[p.filter]
+	if !ok {
+		r.mu.Unlock()
+		return r.conn.Unsubscribe(p.filter)
+	}
+	for i, rt := range sub.routes {
+		if rt.raw == pattern {
+			sub.routes = append(sub.routes[:i:i], sub.routes[i+1:]...)
+			break
+		}
+	}
+	if len(sub.routes) > 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	delete(r.filters, p.filter)
+	r.mu.Unlock()
+	return r.conn.Unsubscribe(p.filter)
+}
+
+func (r *router) OnError(cb func(error)) {
+	r.mu.Lock()
+	r.onError = cb
+	r.mu.Unlock()
+}
+
+// dispatch delivers msg to the routes of the filter it was received on.
+// Several patterns share a filter if they differ in variable names only.
+func (r *router) dispatch(filter string, msg mqtt.Message) {
+	var routes []*route
+	r.mu.Lock()
+	if sub, ok := r.filters[filter]; ok {
+		routes = sub.routes
+	}
+	r.mu.Unlock()
+	for _, rt := range routes {
+		params, ok := rt.match(msg.Topic())
+		if !ok {
+			continue
+		}
+		if err := rt.handler(&Message{Message: msg, Pattern: rt.raw, Params: params}); err != nil {
+			r.handleError(fmt.Errorf("handling %s %v", msg.Topic(), err))
+		}
+	}
+}
+
+func (r *router) handleError(err error) {
+	r.mu.Lock()
+	cb := r.onError
+	r.mu.Unlock()
+	if cb == nil {
+		fmt.Println(err)
+		return
+	}
+	cb(err)
+}
+
+// pattern is a parsed topic pattern.
+type pattern struct {
+	raw    string
+	filter string
+	levels []string
+	// vars maps the index of a variable level to its name.
+	vars map[int]string
+}
+
+func parsePattern(raw string) (*pattern, error) {
+	if raw == "" {
+		return nil, fmt.Errorf("%q %w", raw, ErrInvalidPattern)
+	}
+	p := &pattern{raw: raw, vars: make(map[int]string)}
+	p.levels = strings.Split(raw, "/")
+	filter := make([]string, len(p.levels))
+	for i, level := range p.levels {
+		switch {
+		case level == "#":
+			if i != len(p.levels)-1 {
+				return nil, fmt.Errorf("%q %w: # must be the last level", raw, ErrInvalidPattern)
+			}
+		case level == "+":
+		case strings.HasPrefix(level, "{") && strings.HasSuffix(level, "}"):
+			name := level[1 : len(level)-1]
+			if name == "" || strings.ContainsAny(name, "{}+#") {
+				return nil, fmt.Errorf("%q %w: bad variable %s", raw, ErrInvalidPattern, level)
+			}
+			p.vars[i] = name
+			level = "+"
+		case strings.ContainsAny(level, "{}+#"):
+			return nil, fmt.Errorf("%q %w: bad level %s", raw, ErrInvalidPattern, level)
+		}
+		filter[i] = level
+	}
+	p.filter = strings.Join(filter, "/")
+	return p, nil
+}
+
+// match reports whether topic matches the pattern and returns the values
+// of its variables.
+func (p *pattern) match(topic string) (Params, bool) {
+	levels := strings.Split(topic, "/")
+	// Wildcards in the first level do not match topics starting with $.
+	if strings.HasPrefix(topic, "$") && (p.levels[0] == "#" || p.filter[0] == '+') {
+		return nil, false
+	}
+	params := make(Params, len(p.vars))
+	for i, level := range p.levels {
+		if level == "#" {
+			return params, true
+		}
+		if i >= len(levels) {
+			return nil, false
+		}
+		if name, ok := p.vars[i]; ok {
+			params[name] = levels[i]
+			continue
+		}
+		if level != "+" && level != levels[i] {
+			return nil, false
+		}
+	}
+	return params, len(levels) == len(p.levels)
+}
@@ -0,0 +1,178 @@
+package connect
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		filter  string
+		err     bool
+	}{
+		{pattern: "fleet/status", filter: "fleet/status"},
+		{pattern: "fleet/+/status", filter: "fleet/+/status"},
+		{pattern: "fleet/#", filter: "fleet/#"},
+		{pattern: "#", filter: "#"},
+		{pattern: "$aws/things/{thingName}/jobs/{jobId}/get", filter: "$aws/things/+/jobs/+/get"},
+		{pattern: "", err: true},
+		{pattern: "fleet/#/status", err: true},
+		{pattern: "fleet/{}", err: true},
+		{pattern: "fleet/{a{b}", err: true},
+		{pattern: "fleet/a+", err: true},
+		{pattern: "fleet/{name", err: true},
+	}
+	for _, tt := range tests {
+		p, err := parsePattern(tt.pattern)
+		if tt.err {
+			if !errors.Is(err, ErrInvalidPattern) {
+				t.Errorf("parsePattern(%q) error = %v, want %v", tt.pattern, err, ErrInvalidPattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePattern(%q) %v", tt.pattern, err)
+			continue
+		}
+		if p.filter != tt.filter {
+			t.Errorf("parsePattern(%q) filter = %q, want %q", tt.pattern, p.filter, tt.filter)
+		}
+	}
+}
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		params  Params
+		ok      bool
+	}{
+		{"fleet/status", "fleet/status", Params{}, true},
+		{"fleet/status", "fleet/status/extra", nil, false},
+		{"fleet/+/status", "fleet/a/status", Params{}, true},
+		{"fleet/+/status", "fleet/status", nil, false},
+
+		// # matches the parent level and any number of levels below.
+		{"fleet/#", "fleet", Params{}, true},
+		{"fleet/#", "fleet/a/b/c", Params{}, true},
+		{"fleet/#", "other/a", nil, false},
+
+		// Wildcards in the first level do not match topics starting with $.
+		{"#", "fleet/a", Params{}, true},
+		{"#", "$aws/things/a/shadow", nil, false},
+		{"+/things/#", "$aws/things/a", nil, false},
+		{"{prefix}/things/#", "$aws/things/a", nil, false},
+		{"$aws/#", "$aws/things/a/shadow", Params{}, true},
+		{"$aws/things/+/shadow", "$aws/things/a/shadow", Params{}, true},
+
+		{
+			"$aws/things/{thingName}/jobs/{jobId}/get/accepted",
+			"$aws/things/thing-1/jobs/job-1/get/accepted",
+			Params{"thingName": "thing-1", "jobId": "job-1"},
+			true,
+		},
+		{
+			"$aws/things/{thingName}/jobs/{jobId}/get/accepted",
+			"$aws/things/thing-1/jobs/job-1/get/rejected",
+			nil,
+			false,
+		},
+		{"fleet/{id}/#", "fleet/a/b/c", Params{"id": "a"}, true},
+	}
+	for _, tt := range tests {
+		p, err := parsePattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("parsePattern(%q) %v", tt.pattern, err)
+		}
+		params, ok := p.match(tt.topic)
+		if ok != tt.ok || (ok && !reflect.DeepEqual(params, tt.params)) {
+			t.Errorf("%q match(%q) = %v, %t, want %v, %t", tt.pattern, tt.topic, params, ok, tt.params, tt.ok)
+		}
+	}
+}
+
+// subscribeConn is a Connection whose subscriptions wait for a result
+// from the test.
+type subscribeConn struct {
+	Connection
+	mu         sync.Mutex
+	subscribes []string
+	results    chan error
+}
+
+func (c *subscribeConn) Subscribe(topic string, handler mqtt.MessageHandler, opts ...SubscribeOption) error {
+	c.mu.Lock()
+	c.subscribes = append(c.subscribes, topic)
+	c.mu.Unlock()
+	return <-c.results
+}
+
+func (c *subscribeConn) Unsubscribe(topics ...string) error {
+	return nil
+}
+
+func (c *subscribeConn) subscribed() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.subscribes...)
+}
+
+func TestRouterSubscribeFails(t *testing.T) {
+	conn := &subscribeConn{results: make(chan error, 1)}
+	r := NewRouter(conn).(*router)
+	noop := func(msg *Message) error { return nil }
+
+	// Both patterns share a filter and wait for the same SUBSCRIBE.
+	errs := make(chan error, 2)
+	go func() { errs <- r.Handle("things/{thingName}/status", noop) }()
+	for len(conn.subscribed()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() { errs <- r.Handle("things/{id}/status", noop) }()
+	for {
+		r.mu.Lock()
+		n := len(r.filters["things/+/status"].routes)
+		r.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	refused := errors.New("refused")
+	conn.results <- refused
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != refused {
+				t.Errorf("Handle() = %v, want %v", err, refused)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Handle() did not return")
+		}
+	}
+	if len(r.filters) != 0 {
+		t.Errorf("routes %v were kept", r.filters)
+	}
+
+	// The filter is subscribed again by the next route.
+	conn.results <- nil
+	if err := r.Handle("things/{id}/status", noop); err != nil {
+		t.Fatal(err)
+	}
+	conn.results <- errors.New("not subscribed again")
+	if err := r.Handle("things/{thingName}/status", noop); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := conn.subscribed(), []string{"things/+/status", "things/+/status"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subscribed %v, want %v", got, want)
+	}
+	if n := len(r.filters["things/+/status"].routes); n != 2 {
+		t.Errorf("%d routes, want 2", n)
+	}
+}
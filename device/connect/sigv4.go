@@ -0,0 +1,87 @@
+package connect
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	sigV4Service   = "iotdevicegateway"
+	sigV4Expires   = 24 * time.Hour
+	websocketPath  = "/mqtt"
+)
+
+// presign signs the websocket upgrade request of host with SigV4 query
+// parameters as described for AWS IoT MQTT over WebSocket.
+func presign(host, region string, creds Credentials, now time.Time) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/" + sigV4Service + "/aws4_request"
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", creds.AccessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", fmt.Sprint(int(sigV4Expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	// url.Values.Encode sorts by key as SigV4 requires, but encodes spaces
+	// as + where SigV4 expects %20.
+	canonicalQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		websocketPath,
+		canonicalQuery,
+		"host:" + host + "\n",
+		"host",
+		hashHex(""),
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		now.Format("20060102T150405Z"),
+		scope,
+		hashHex(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, sigV4Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	signed := canonicalQuery + "&X-Amz-Signature=" + signature
+	// AWS IoT expects the session token to be added after signing.
+	if creds.SessionToken != "" {
+		signed += "&X-Amz-Security-Token=" + url.QueryEscape(creds.SessionToken)
+	}
+	return signed
+}
+
+// regionFromEndpoint extracts the region of an AWS IoT data endpoint such
+// as xxxxxxxx-ats.iot.us-east-1.amazonaws.com.
+func regionFromEndpoint(endpoint string) string {
+	parts := strings.Split(endpoint, ".")
+	for i, p := range parts {
+		if p == "iot" && i+1 < len(parts) {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+func hashHex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
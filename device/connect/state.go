@@ -0,0 +1,129 @@
+package connect
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State is the state of a Connection.
+type State int
+
+// Connection states.
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateConnected
+	// StateReconnecting is entered when an established connection is lost
+	// and left once it is back.
+	StateReconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+}
+
+// Event reports a change of the connection state.
+type Event struct {
+	State    State
+	Previous State
+	// Err is the reason the connection was lost or could not be
+	// established, if any.
+	Err  error
+	Time time.Time
+}
+
+// lifecycle tracks the state of a connection and delivers its events to
+// the registered handlers. Events are delivered in order on a separate
+// goroutine so handlers may call back into the connection.
+type lifecycle struct {
+	mu         sync.Mutex
+	state      State
+	handlers   []stateHandler
+	nextID     int
+	pending    []Event
+	delivering bool
+}
+
+// State returns the current state of the connection.
+func (l *lifecycle) State() State {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
+
+// OnStateChange registers handler for state changes and returns a function
+// that removes it again.
+func (l *lifecycle) OnStateChange(handler func(Event)) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id := l.nextID
+	l.nextID++
+	l.handlers = append(l.handlers, stateHandler{id: id, fn: handler})
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, h := range l.handlers {
+			if h.id == id {
+				l.handlers = append(l.handlers[:i:i], l.handlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+type stateHandler struct {
+	id int
+	fn func(Event)
+}
+
+// setState changes the state and queues an event unless the connection is
+// already in state.
+func (l *lifecycle) setState(state State, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.state == state {
+		return
+	}
+	l.pending = append(l.pending, Event{
+		State:    state,
+		Previous: l.state,
+		Err:      err,
+		Time:     time.Now(),
+	})
+	l.state = state
+	if !l.delivering {
+		l.delivering = true
+		go l.deliver()
+	}
+}
+
+func (l *lifecycle) deliver() {
+	for {
+		l.mu.Lock()
+		if len(l.pending) == 0 {
+			l.delivering = false
+			l.mu.Unlock()
+			return
+		}
+		ev := l.pending[0]
+		l.pending = l.pending[1:]
+		handlers := l.handlers
+		l.mu.Unlock()
+
+		for _, h := range handlers {
+			h.fn(ev)
+		}
+	}
+}
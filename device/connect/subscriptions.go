@@ -0,0 +1,94 @@
+package connect
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrRefused is returned if the broker refused a subscription.
+var ErrRefused = errors.New("subscription refused")
+
+// SubscriptionError is reported to the OnError handler if subscriptions
+// could not be restored after a reconnect.
+type SubscriptionError struct {
+	Topics []string
+	Err    error
+}
+
+// Error implements error interface.
+func (e *SubscriptionError) Error() string {
+	return fmt.Sprintf("restoring subscriptions to %s %v", strings.Join(e.Topics, ", "), e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *SubscriptionError) Unwrap() error {
+	return e.Err
+}
+
+// subscriptions is the registry of the active subscriptions of a
+// connection, which are restored after every reconnect.
+type subscriptions struct {
+	mu      sync.Mutex
+	subs    map[string]Subscription
+	onError func(error)
+}
+
+func (s *subscriptions) add(subs []Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs == nil {
+		s.subs = make(map[string]Subscription)
+	}
+	for _, sub := range subs {
+		s.subs[sub.Topic] = sub
+	}
+}
+
+func (s *subscriptions) remove(topics []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, topic := range topics {
+		delete(s.subs, topic)
+	}
+}
+
+// all returns the registered subscriptions ordered by topic.
+func (s *subscriptions) all() []Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := make([]Subscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Topic < subs[j].Topic })
+	return subs
+}
+
+// OnError sets handler of asynchronous errors.
+func (s *subscriptions) OnError(cb func(error)) {
+	s.mu.Lock()
+	s.onError = cb
+	s.mu.Unlock()
+}
+
+func (s *subscriptions) handleError(err error) {
+	s.mu.Lock()
+	cb := s.onError
+	s.mu.Unlock()
+	if cb == nil {
+		fmt.Println(err)
+		return
+	}
+	cb(err)
+}
+
+func topicsOf(subs []Subscription) []string {
+	topics := make([]string, len(subs))
+	for i, sub := range subs {
+		topics[i] = sub.Topic
+	}
+	return topics
+}
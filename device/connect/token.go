@@ -0,0 +1,81 @@
+package connect
+
+import (
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// doneToken is an mqtt.Token that has already completed.
+type doneToken struct {
+	err error
+}
+
+func (t *doneToken) Wait() bool                     { return true }
+func (t *doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t *doneToken) Error() error                   { return t.err }
+
+func (t *doneToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// asyncToken is an mqtt.Token completed by a background request.
+type asyncToken struct {
+	done chan struct{}
+	err  error
+}
+
+func newAsyncToken() *asyncToken {
+	return &asyncToken{done: make(chan struct{})}
+}
+
+func (t *asyncToken) complete(err error) {
+	t.err = err
+	close(t.done)
+}
+
+func (t *asyncToken) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *asyncToken) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *asyncToken) Done() <-chan struct{} { return t.done }
+
+func (t *asyncToken) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// withTimeout returns a token that fails with ErrTimeout if t has not
+// completed within timeout.
+func withTimeout(t mqtt.Token, timeout time.Duration) mqtt.Token {
+	if timeout <= 0 {
+		return t
+	}
+	at := newAsyncToken()
+	go func() {
+		if !t.WaitTimeout(timeout) {
+			at.complete(ErrTimeout)
+			return
+		}
+		at.complete(t.Error())
+	}()
+	return at
+}
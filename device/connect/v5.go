@@ -0,0 +1,551 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// v5SessionExpiry keeps the session of a connection that was not cleanly
+// disconnected for an hour, the maximum of AWS IoT.
+const v5SessionExpiry = 3600
+
+// connectionV5 implements Connection with MQTT 5. The network connection
+// is kept up by an autopaho connection manager.
+type connectionV5 struct {
+	*dialer
+	lifecycle
+	subscriptions
+	reconnector
+	router  *paho.StandardRouter
+	aliases *topicAliases
+	mu      sync.Mutex
+	cm      *autopaho.ConnectionManager
+	queue   *queue
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// NewV5 creates a Connection that speaks MQTT 5. Publish options for user
+// properties, response topics, correlation data and message expiry are
+// sent as MQTT 5 properties, and received messages carry theirs, see
+// Properties. The websocket transports are not supported.
+func NewV5(config *ConnectionConfiguration) (Connection, error) {
+	if config.Transport == TransportWSS || config.Transport == TransportWS {
+		return nil, fmt.Errorf("%s transport is not supported with MQTT 5", config.Transport)
+	}
+	d, err := newDialer(config, "tls")
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &connectionV5{
+		dialer:      d,
+		reconnector: newReconnector(config.Reconnect),
+		router:      paho.NewStandardRouter(),
+		aliases:     &topicAliases{},
+		stop:        make(chan struct{}),
+	}
+	if config.Queue.Directory != "" {
+		q, err := newQueue(config.Queue)
+		if err != nil {
+			return nil, err
+		}
+		conn.queue = q
+		go q.run(conn.stop, conn.isOnline, conn.send)
+	}
+	return conn, nil
+}
+
+func (c *connectionV5) isOnline() bool {
+	return c.State() == StateConnected
+}
+
+func (c *connectionV5) manager() *autopaho.ConnectionManager {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cm
+}
+
+func (c *connectionV5) clientConfig(errs chan<- error) autopaho.ClientConfig {
+	policy := &c.Config.Reconnect
+	cfg := autopaho.ClientConfig{
+		BrokerUrls: []*url.URL{c.server},
+		TlsCfg:     c.tlsConfig,
+		KeepAlive:  uint16(c.Config.keepAlive() / time.Second),
+		// The delays of the reconnect policy are waited for in attempt,
+		// within the timeout of the attempt.
+		ConnectRetryDelay: time.Millisecond,
+		ConnectTimeout:    policy.connectTimeout() + policy.maxInterval(),
+		AttemptConnection: c.attempt,
+		OnConnectionUp:    c.onConnectionUp,
+		OnConnectError: func(err error) {
+			fmt.Printf("connecting %v\n", err)
+			if c.State() == StateReconnecting {
+				c.failed(err)
+			}
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:    c.Config.ClientId,
+			Router:      c.router,
+			PublishHook: c.aliases.hook,
+			OnClientError: func(err error) {
+				fmt.Printf("connection lost %v\n", err)
+				// Errors after Disconnect are not a lost connection.
+				if c.State() == StateConnected {
+					c.setState(StateReconnecting, err)
+				}
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				err := reasonCode(d.ReasonCode, disconnectReason(d))
+				fmt.Printf("disconnected by server %v\n", err)
+				c.setState(StateReconnecting, err)
+			},
+		},
+	}
+	if w := c.Config.Will; w != nil {
+		cfg.SetWillMessage(w.Topic, w.Payload, w.QoS, w.Retain)
+	}
+	cfg.SetConnectPacketConfigurator(func(cp *paho.Connect) *paho.Connect {
+		cp.CleanStart = c.Config.CleanSession
+		if !cp.CleanStart {
+			expiry := uint32(v5SessionExpiry)
+			cp.Properties = &paho.ConnectProperties{SessionExpiryInterval: &expiry}
+		}
+		if c.authorizer != nil {
+			username, password := c.authorizer.credentials()
+			cp.Username, cp.UsernameFlag = username, username != ""
+			cp.Password, cp.PasswordFlag = []byte(password), password != ""
+		}
+		return cp
+	})
+	return cfg
+}
+
+func disconnectReason(d *paho.Disconnect) string {
+	if d.Properties == nil {
+		return ""
+	}
+	return d.Properties.ReasonString
+}
+
+// attempt dials the broker after preparing the URL and credentials for the
+// attempt.
+func (c *connectionV5) attempt(ctx context.Context, cfg autopaho.ClientConfig, u *url.URL) (net.Conn, error) {
+	if c.State() == StateReconnecting {
+		delay, err := c.next()
+		if err != nil {
+			go c.giveUp(err)
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	if err := c.prepare(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.Config.Reconnect.connectTimeout())
+	defer cancel()
+	d := tls.Dialer{Config: c.attemptTLSConfig()}
+	conn, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		c.dialFailed()
+		return nil, err
+	}
+	return packets.NewThreadSafeConn(conn), nil
+}
+
+// giveUp closes a connection that is out of reconnect attempts.
+func (c *connectionV5) giveUp(err error) {
+	c.setState(StateDisconnected, err)
+	c.handleError(err)
+	c.disconnect(250)
+}
+
+// onConnectionUp subscribes again, as the session may not have been kept
+// by the broker, and resets the topic aliases, which only live as long as the network
+// connection.
+func (c *connectionV5) onConnectionUp(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+	var aliasMax uint16
+	if connack.Properties != nil && connack.Properties.TopicAliasMaximum != nil {
+		aliasMax = *connack.Properties.TopicAliasMaximum
+	}
+	if c.Config.TopicAliasMaximum < aliasMax {
+		aliasMax = c.Config.TopicAliasMaximum
+	}
+	c.aliases.reset(aliasMax)
+
+	// Connected first, like the MQTT 3 connection, so that subscriptions
+	// registered during the restore are sent rather than left for the
+	// next reconnect.
+	c.succeeded()
+	c.setState(StateConnected, nil)
+	c.restore(cm)
+	fmt.Printf("Connected with MQTT 5 to %s\n", c.server.Host)
+	if c.queue != nil {
+		c.queue.signal()
+	}
+}
+
+// restore subscribes to the registered topics again.
+func (c *connectionV5) restore(cm *autopaho.ConnectionManager) {
+	subs := c.all()
+	if len(subs) == 0 {
+		return
+	}
+	sub := &paho.Subscribe{}
+	for _, s := range subs {
+		sub.Subscriptions = append(sub.Subscriptions, paho.SubscribeOptions{Topic: s.Topic, QoS: s.QoS})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+	suback, err := cm.Subscribe(ctx, sub)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = ErrTimeout
+	}
+	if err != nil {
+		c.handleError(&SubscriptionError{Topics: topicsOf(subs), Err: err})
+		return
+	}
+	var refused []string
+	for i, code := range suback.Reasons {
+		if code >= 0x80 && i < len(subs) {
+			refused = append(refused, subs[i].Topic)
+		}
+	}
+	if len(refused) > 0 {
+		c.handleError(&SubscriptionError{Topics: refused, Err: subackError(suback)})
+	}
+}
+
+func (c *connectionV5) Connect() error {
+	if c.manager() == nil {
+		c.setState(StateConnecting, nil)
+	}
+	return c.connect(false)
+}
+
+// connect starts the connection manager and waits for the first attempt.
+// If it fails, the manager is stopped, or with retry is kept trying in the
+// background with the reconnect policy.
+func (c *connectionV5) connect(retry bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cm != nil {
+		return nil
+	}
+
+	errs := make(chan error, 1)
+	cm, err := autopaho.NewConnection(context.Background(), c.clientConfig(errs))
+	if err != nil {
+		return fmt.Errorf("creating MQTT 5 connection %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Config.Reconnect.connectTimeout())
+	defer cancel()
+	up := make(chan error, 1)
+	go func() { up <- cm.AwaitConnection(ctx) }()
+	select {
+	case err = <-up:
+	case err = <-errs:
+	}
+	if err != nil && !retry {
+		cm.Disconnect(context.Background())
+		c.setState(StateDisconnected, err)
+		return err
+	}
+	c.cm = cm
+	return err
+}
+
+func (c *connectionV5) Disconnect(timeout uint) {
+	c.once.Do(func() { close(c.stop) })
+	c.setState(StateDisconnected, nil)
+	c.disconnect(timeout)
+}
+
+func (c *connectionV5) disconnect(timeout uint) {
+	c.mu.Lock()
+	cm := c.cm
+	c.cm = nil
+	c.mu.Unlock()
+	if cm == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+	cm.Disconnect(ctx)
+}
+
+func (c *connectionV5) Publish(topic string, payload interface{}, opts ...PublishOption) mqtt.Token {
+	o := newPublishOptions(opts)
+	topic, err := o.topic(topic)
+	if err != nil {
+		return &doneToken{err: err}
+	}
+	fmt.Printf("Publishing %v to %v", payload, topic)
+	data, err := payloadBytes(payload)
+	if err != nil {
+		return &doneToken{err: err}
+	}
+	queued := c.queue != nil && o.queue
+	if !queued && !c.isOnline() {
+		return &doneToken{err: ErrNotConnected}
+	}
+	m := o.queued(topic, data, 0)
+	// Publish directly unless older messages are still waiting, which
+	// would otherwise be overtaken.
+	if queued && (!c.isOnline() || c.queue.len() > 0) {
+		c.queue.expire(m)
+		return &doneToken{err: c.queue.push(m)}
+	}
+	if queued {
+		c.queue.reserve(m)
+	}
+
+	t := newAsyncToken()
+	go func() {
+		timeout := o.timeout
+		if timeout <= 0 {
+			timeout = defaultRequestTimeout
+		}
+		err := c.publish(m, timeout)
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = ErrTimeout
+		}
+		if queued {
+			c.queue.expire(m)
+			err = c.queue.requeue(m, err)
+		}
+		t.complete(err)
+	}()
+	return t
+}
+
+// send publishes a queued message.
+func (c *connectionV5) send(m *queuedMessage) error {
+	return c.publish(m, defaultRequestTimeout)
+}
+
+func (c *connectionV5) publish(m *queuedMessage, timeout time.Duration) error {
+	cm := c.manager()
+	if cm == nil {
+		return autopaho.ConnectionDownError
+	}
+
+	p := &paho.Publish{
+		Topic:   m.Topic,
+		QoS:     m.QoS,
+		Retain:  m.Retain,
+		Payload: m.Payload,
+		Properties: &paho.PublishProperties{
+			ResponseTopic:   m.ResponseTopic,
+			CorrelationData: m.CorrelationData,
+			ContentType:     m.ContentType,
+		},
+	}
+	for _, u := range m.User {
+		p.Properties.User.Add(u.Key, u.Value)
+	}
+	if !m.Expires.IsZero() {
+		remaining := time.Until(m.Expires)
+		if remaining <= 0 {
+			return nil
+		}
+		expiry := uint32((remaining + time.Second - 1) / time.Second)
+		p.Properties.MessageExpiry = &expiry
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// The topic alias hook rewrites the packet it is given, so it gets a
+	// copy and p keeps its topic for a retransmission.
+	resp, err := cm.Publish(ctx, copyPublish(p))
+	if err != nil {
+		return err
+	}
+	if resp == nil {
+		// QoS 0 publishes are not acknowledged.
+		return nil
+	}
+	var reason string
+	if resp.Properties != nil {
+		reason = resp.Properties.ReasonString
+	}
+	return reasonCode(resp.ReasonCode, reason)
+}
+
+func (c *connectionV5) Subscribe(topic string, handler mqtt.MessageHandler, opts ...SubscribeOption) error {
+	o := newSubscribeOptions(opts)
+	return c.SubscribeMultiple([]Subscription{{Topic: topic, QoS: o.qos, Handler: handler}}, opts...)
+}
+
+func (c *connectionV5) SubscribeMultiple(subs []Subscription, opts ...SubscribeOption) error {
+	o := newSubscribeOptions(opts)
+	sub := &paho.Subscribe{}
+	for _, s := range subs {
+		fmt.Printf("Subscribing to %v\n", s.Topic)
+		handler := s.Handler
+		c.router.RegisterHandler(s.Topic, func(p *paho.Publish) {
+			handler(nil, newMessage(p))
+		})
+		sub.Subscriptions = append(sub.Subscriptions, paho.SubscribeOptions{Topic: s.Topic, QoS: s.QoS})
+	}
+	// Registered first so that they are restored if the connection is
+	// down or goes down during the request.
+	c.add(subs)
+
+	cm := c.manager()
+	if cm == nil || !c.isOnline() {
+		// Subscribed once the connection is up.
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	suback, err := cm.Subscribe(ctx, sub)
+	if errors.Is(err, autopaho.ConnectionDownError) {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = ErrTimeout
+	}
+	if err == nil {
+		err = subackError(suback)
+	}
+	if err != nil {
+		topics := topicsOf(subs)
+		c.remove(topics)
+		for _, topic := range topics {
+			c.router.UnregisterHandler(topic)
+		}
+		return fmt.Errorf("registering message handlers %v", err)
+	}
+	return nil
+}
+
+func subackError(suback *paho.Suback) error {
+	var reason string
+	if suback.Properties != nil {
+		reason = suback.Properties.ReasonString
+	}
+	for _, code := range suback.Reasons {
+		if err := reasonCode(code, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *connectionV5) Unsubscribe(topics ...string) error {
+	fmt.Printf("Unsubscribing from %v\n", topics)
+	c.remove(topics)
+	for _, topic := range topics {
+		c.router.UnregisterHandler(topic)
+	}
+
+	cm := c.manager()
+	if cm == nil || !c.isOnline() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+	unsuback, err := cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+	if errors.Is(err, autopaho.ConnectionDownError) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unsubscribing %v", err)
+	}
+	var reason string
+	if unsuback.Properties != nil {
+		reason = unsuback.Properties.ReasonString
+	}
+	for _, code := range unsuback.Reasons {
+		if err := reasonCode(code, reason); err != nil {
+			return fmt.Errorf("unsubscribing %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *connectionV5) UpdateKeyPair(kp KeyPair) error {
+	if err := c.setKeyPair(kp); err != nil {
+		return err
+	}
+	if c.manager() == nil {
+		return nil
+	}
+	fmt.Println("Reconnecting with new certificate")
+	c.setState(StateReconnecting, errKeyPairUpdated)
+	c.disconnect(250)
+	// Keeps reconnecting if the key pair fails, so a fallback to the
+	// previous key pair finds the connection still in use.
+	return c.connect(true)
+}
+
+// topicAliases replaces the topics of repeated publishes with aliases, up
+// to the maximum accepted by both sides.
+type topicAliases struct {
+	mu      sync.Mutex
+	max     uint16
+	aliases map[string]uint16
+}
+
+func (t *topicAliases) reset(max uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.max = max
+	t.aliases = make(map[string]uint16)
+}
+
+// copyPublish returns a copy of p that can be changed without changing p.
+func copyPublish(p *paho.Publish) *paho.Publish {
+	cp := *p
+	if p.Properties != nil {
+		props := *p.Properties
+		cp.Properties = &props
+	}
+	return &cp
+}
+
+// hook sets the topic alias of p. It blanks the topic of p once the alias
+// is known to the broker, so p must not be sent again on another network
+// connection, where the alias is unknown.
+func (t *topicAliases) hook(p *paho.Publish) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.max == 0 || p.Topic == "" {
+		return
+	}
+	if p.Properties == nil {
+		p.Properties = &paho.PublishProperties{}
+	}
+	if alias, ok := t.aliases[p.Topic]; ok {
+		p.Properties.TopicAlias = &alias
+		p.Topic = ""
+		return
+	}
+	if len(t.aliases) < int(t.max) {
+		// The first publish carries both the topic and the new alias.
+		alias := uint16(len(t.aliases) + 1)
+		t.aliases[p.Topic] = alias
+		p.Properties.TopicAlias = &alias
+	}
+}
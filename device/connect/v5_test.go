@@ -0,0 +1,154 @@
+package connect
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// v5Broker is an MQTT 5 broker on the other end of a pipe that refuses
+// subscriptions to the topic "refused".
+type v5Broker struct {
+	conn       net.Conn
+	mu         sync.Mutex
+	subscribed []string
+}
+
+func (b *v5Broker) serve() {
+	for {
+		cp, err := packets.ReadPacket(b.conn)
+		if err != nil {
+			return
+		}
+		var reply *packets.ControlPacket
+		switch p := cp.Content.(type) {
+		case *packets.Connect:
+			reply = packets.NewControlPacket(packets.CONNACK)
+		case *packets.Subscribe:
+			reply = packets.NewControlPacket(packets.SUBACK)
+			suback := reply.Content.(*packets.Suback)
+			suback.PacketID = p.PacketID
+			b.mu.Lock()
+			for _, s := range p.Subscriptions {
+				b.subscribed = append(b.subscribed, s.Topic)
+				code := s.QoS
+				if s.Topic == "refused" {
+					code = packets.SubackNotauthorized
+				}
+				suback.Reasons = append(suback.Reasons, code)
+			}
+			b.mu.Unlock()
+		case *packets.Pingreq:
+			reply = packets.NewControlPacket(packets.PINGRESP)
+		case *packets.Disconnect:
+			return
+		default:
+			continue
+		}
+		if _, err := reply.WriteTo(b.conn); err != nil {
+			return
+		}
+	}
+}
+
+func (b *v5Broker) publish(t *testing.T, topic string) {
+	t.Helper()
+	cp := packets.NewControlPacket(packets.PUBLISH)
+	p := cp.Content.(*packets.Publish)
+	p.Topic, p.Payload = topic, []byte(topic)
+	if _, err := cp.WriteTo(b.conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (b *v5Broker) subscriptions() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.subscribed...)
+}
+
+// connectV5 connects c to a v5Broker through a pipe.
+func connectV5(t *testing.T, c *connectionV5) *v5Broker {
+	t.Helper()
+	client, server := net.Pipe()
+	b := &v5Broker{conn: server}
+	go b.serve()
+	t.Cleanup(func() {
+		c.Disconnect(100)
+		server.Close()
+	})
+
+	cfg := c.clientConfig(make(chan error, 1))
+	cfg.AttemptConnection = func(context.Context, autopaho.ClientConfig, *url.URL) (net.Conn, error) {
+		return packets.NewThreadSafeConn(client), nil
+	}
+	cm, err := autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := cm.AwaitConnection(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	c.cm = cm
+	c.mu.Unlock()
+	for !c.isOnline() {
+		time.Sleep(time.Millisecond)
+	}
+	return b
+}
+
+func TestV5Subscribe(t *testing.T) {
+	conn, err := NewV5(authorizerConfig(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := conn.(*connectionV5)
+	received := make(chan string, 10)
+	handler := func(_ mqtt.Client, msg mqtt.Message) { received <- msg.Topic() }
+
+	// Subscriptions made offline are sent once the connection is up.
+	if err := c.Subscribe("offline", handler); err != nil {
+		t.Fatalf("Subscribe() offline = %v", err)
+	}
+	b := connectV5(t, c)
+	deadline := time.Now().Add(time.Second)
+	for len(b.subscriptions()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := b.subscriptions(), []string{"offline"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("subscribed to %v, want %v", got, want)
+	}
+
+	// A refused subscription leaves neither a handler nor a subscription
+	// to restore behind.
+	if err := c.Subscribe("refused", handler); err == nil {
+		t.Error("Subscribe() of a refused topic succeeded")
+	}
+	if err := c.Subscribe("granted", handler); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := topicsOf(c.all()), []string{"granted", "offline"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("registered %v, want %v", got, want)
+	}
+	b.publish(t, "refused")
+	b.publish(t, "granted")
+	select {
+	case topic := <-received:
+		if topic != "granted" {
+			t.Errorf("received %s", topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+}
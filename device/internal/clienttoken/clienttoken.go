@@ -0,0 +1,45 @@
+// Package clienttoken correlates the requests and responses of the AWS IoT
+// shadow and jobs APIs.
+package clienttoken
+
+import (
+	"reflect"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+)
+
+// Get returns the ClientToken field of the struct i points to.
+func Get(i interface{}) (string, bool) {
+	v := reflect.ValueOf(i).Elem().FieldByName("ClientToken")
+	if !v.IsValid() {
+		return "", false
+	}
+	if v.Kind() != reflect.String {
+		return "", false
+	}
+	return v.String(), true
+}
+
+// Set sets the ClientToken field of the struct i points to.
+func Set(i interface{}, token string) bool {
+	v := reflect.ValueOf(i).Elem().FieldByName("ClientToken")
+	if !v.IsValid() {
+		return false
+	}
+	if v.Kind() != reflect.String {
+		return false
+	}
+	v.Set(reflect.ValueOf(token))
+	return true
+}
+
+// Response returns the token correlating a response with its request.
+// MQTT 5 responses carry it as correlation data, otherwise it is read from
+// the ClientToken field of r.
+func Response(msg mqtt.Message, r interface{}) (string, bool) {
+	if p := connect.Properties(msg); p != nil && len(p.CorrelationData) != 0 {
+		return string(p.CorrelationData), true
+	}
+	return Get(r)
+}
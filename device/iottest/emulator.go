@@ -0,0 +1,205 @@
+// Package iottest emulates the MQTT APIs of AWS IoT Core on a
+// connecttest.Broker: device shadows, fleet provisioning, jobs and file
+// streams. The responses of the emulator can be scripted to test failures.
+package iottest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device/connect/connecttest"
+)
+
+// Reply is a message the emulator publishes in response to a request.
+// Payloads other than []byte and string are marshaled to JSON.
+type Reply struct {
+	Topic   string
+	Payload interface{}
+}
+
+// Responder answers a request. Returning no replies drops the request,
+// as if AWS IoT never answered.
+type Responder func(req *connecttest.Message) []Reply
+
+type script struct {
+	filter    string
+	remaining int
+	respond   Responder
+}
+
+// Emulator answers the AWS IoT requests published on a broker.
+type Emulator struct {
+	broker *connecttest.Broker
+	remove []func()
+
+	mu      sync.Mutex
+	scripts []*script
+	shadows map[string]*shadowDocument
+	jobs    map[string][]*Job
+	certs   map[string]*Certificate
+	tokens  map[string]string
+	things  map[string]*RegisteredThing
+	streams map[string]map[int][]byte
+	ca      *authority
+
+	// ThingName returns the name of the thing registered by a
+	// provisioning template. It defaults to the thingName parameter, or
+	// the serialNumber parameter prefixed with "thing_".
+	ThingName func(template string, parameters map[string]string) string
+	// Now returns the time of responses. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// New creates an Emulator that serves the requests published on broker.
+func New(broker *connecttest.Broker) (*Emulator, error) {
+	ca, err := newAuthority()
+	if err != nil {
+		return nil, err
+	}
+	e := &Emulator{
+		broker:  broker,
+		shadows: make(map[string]*shadowDocument),
+		jobs:    make(map[string][]*Job),
+		certs:   make(map[string]*Certificate),
+		tokens:  make(map[string]string),
+		things:  make(map[string]*RegisteredThing),
+		streams: make(map[string]map[int][]byte),
+		ca:      ca,
+		Now:     time.Now,
+	}
+	for filter, handler := range map[string]func(*connecttest.Message) []Reply{
+		"$aws/things/+/shadow/#":                    e.shadowRequest,
+		"$aws/things/+/jobs/#":                      e.jobsRequest,
+		"$aws/things/+/streams/+/get/+":             e.streamRequest,
+		"$aws/certificates/create/+":                e.provisioning(e.createKeysAndCertificate),
+		"$aws/certificates/create-from-csr/+":       e.provisioning(e.createCertificateFromCSR),
+		"$aws/provisioning-templates/+/provision/+": e.provisioning(e.registerThing),
+	} {
+		handler := handler
+		e.remove = append(e.remove, broker.Handle(filter, func(msg *connecttest.Message) {
+			e.serve(msg, handler)
+		}))
+	}
+	return e, nil
+}
+
+// Close stops answering requests.
+func (e *Emulator) Close() {
+	for _, remove := range e.remove {
+		remove()
+	}
+}
+
+// Script answers the next n requests on topics matching filter with
+// respond instead of the emulated service, or all of them if n is zero.
+// Scripts are tried in the order they were added.
+func (e *Emulator) Script(filter string, n int, respond Responder) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.scripts = append(e.scripts, &script{filter: filter, remaining: n, respond: respond})
+}
+
+// ClearScripts removes all scripts.
+func (e *Emulator) ClearScripts() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.scripts = nil
+}
+
+// scripted returns the responder scripted for msg, if any.
+func (e *Emulator) scripted(msg *connecttest.Message) (Responder, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, s := range e.scripts {
+		if !connecttest.Match(s.filter, msg.Topic()) {
+			continue
+		}
+		if s.remaining > 0 {
+			s.remaining--
+			if s.remaining == 0 {
+				e.scripts = append(e.scripts[:i:i], e.scripts[i+1:]...)
+			}
+		}
+		return s.respond, true
+	}
+	return nil, false
+}
+
+func (e *Emulator) serve(msg *connecttest.Message, handler func(*connecttest.Message) []Reply) {
+	if msg.ClientID == "" {
+		// Published by the cloud side, for example a response.
+		return
+	}
+	respond, ok := e.scripted(msg)
+	if !ok {
+		respond = handler
+	}
+	for _, r := range respond(msg) {
+		if err := e.broker.Publish(r.Topic, r.Payload); err != nil {
+			fmt.Printf("publishing reply to %s %v\n", r.Topic, err)
+		}
+	}
+}
+
+func (e *Emulator) timestamp() int64 {
+	return e.Now().Unix()
+}
+
+// Drop is a Responder that never answers, so the request times out.
+func Drop() Responder {
+	return func(*connecttest.Message) []Reply { return nil }
+}
+
+// RejectShadow is a Responder that rejects shadow requests with code.
+func RejectShadow(code int, message string) Responder {
+	return func(req *connecttest.Message) []Reply {
+		return []Reply{{Topic: req.Topic() + "/rejected", Payload: map[string]interface{}{
+			"code":        code,
+			"message":     message,
+			"timestamp":   time.Now().Unix(),
+			"clientToken": clientToken(req),
+		}}}
+	}
+}
+
+// RejectJob is a Responder that rejects jobs requests with code, e.g.
+// "InvalidRequest" or "VersionMismatch".
+func RejectJob(code, message string) Responder {
+	return func(req *connecttest.Message) []Reply {
+		return []Reply{{Topic: req.Topic() + "/rejected", Payload: map[string]interface{}{
+			"code":        code,
+			"message":     message,
+			"timestamp":   time.Now().Unix(),
+			"clientToken": clientToken(req),
+		}}}
+	}
+}
+
+// RejectProvisioning is a Responder that rejects fleet provisioning
+// requests with statusCode, e.g. 429 or 500 for transient failures.
+func RejectProvisioning(statusCode int, errorCode, message string) Responder {
+	return func(req *connecttest.Message) []Reply {
+		return encodeReplies(formatOf(req), []Reply{{Topic: req.Topic() + "/rejected", Payload: map[string]interface{}{
+			"statusCode":   statusCode,
+			"errorCode":    errorCode,
+			"errorMessage": message,
+		}}})
+	}
+}
+
+// clientToken returns the client token of a JSON request.
+func clientToken(msg *connecttest.Message) string {
+	var r struct {
+		ClientToken string `json:"clientToken"`
+	}
+	json.Unmarshal(msg.Payload(), &r)
+	return r.ClientToken
+}
+
+// levels splits topic into its levels.
+func levels(topic string) []string {
+	return strings.Split(topic, "/")
+}
@@ -0,0 +1,310 @@
+package iottest
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/randyridgley/simple-go-iot-device/device/connect/connecttest"
+)
+
+// Job execution statuses of AWS IoT Jobs.
+const (
+	JobQueued     = "QUEUED"
+	JobInProgress = "IN_PROGRESS"
+	JobSucceeded  = "SUCCEEDED"
+	JobFailed     = "FAILED"
+	JobRejected   = "REJECTED"
+	JobCanceled   = "CANCELED"
+	JobRemoved    = "REMOVED"
+	JobTimedOut   = "TIMED_OUT"
+)
+
+// Job is an emulated job execution of a thing.
+type Job struct {
+	ID              string
+	Document        json.RawMessage
+	Status          string
+	StatusDetails   map[string]string
+	VersionNumber   int
+	ExecutionNumber int64
+	QueuedAt        int64
+	StartedAt       int64
+	LastUpdatedAt   int64
+}
+
+func (j *Job) terminal() bool {
+	switch j.Status {
+	case JobQueued, JobInProgress:
+		return false
+	}
+	return true
+}
+
+func (j *Job) execution(thing string, withDocument bool) map[string]interface{} {
+	ex := map[string]interface{}{
+		"jobId":           j.ID,
+		"thingName":       thing,
+		"status":          j.Status,
+		"statusDetails":   j.StatusDetails,
+		"queuedAt":        j.QueuedAt,
+		"lastUpdatedAt":   j.LastUpdatedAt,
+		"versionNumber":   j.VersionNumber,
+		"executionNumber": j.ExecutionNumber,
+	}
+	if j.StartedAt != 0 {
+		ex["startedAt"] = j.StartedAt
+	}
+	if withDocument {
+		ex["jobDocument"] = j.Document
+	}
+	return ex
+}
+
+func (j *Job) state() map[string]interface{} {
+	return map[string]interface{}{
+		"status":        j.Status,
+		"statusDetails": j.StatusDetails,
+		"versionNumber": j.VersionNumber,
+	}
+}
+
+func jobsTopic(thing, operation string) string {
+	return "$aws/things/" + thing + "/jobs/" + operation
+}
+
+// AddJob queues a job execution with document for thing and notifies the
+// thing if it is the next one to run.
+func (e *Emulator) AddJob(thing, jobID string, document interface{}) error {
+	doc, err := json.Marshal(document)
+	if err != nil {
+		return fmt.Errorf("marshaling job document %v", err)
+	}
+	e.mu.Lock()
+	for _, j := range e.jobs[thing] {
+		if j.ID == jobID {
+			e.mu.Unlock()
+			return fmt.Errorf("job %s already exists", jobID)
+		}
+	}
+	now := e.timestamp()
+	j := &Job{
+		ID:              jobID,
+		Document:        doc,
+		Status:          JobQueued,
+		VersionNumber:   1,
+		ExecutionNumber: 1,
+		QueuedAt:        now,
+		LastUpdatedAt:   now,
+	}
+	e.jobs[thing] = append(e.jobs[thing], j)
+	if e.next(thing) != j {
+		e.mu.Unlock()
+		return nil
+	}
+	n := e.nextNotification(thing)
+	e.mu.Unlock()
+	return e.broker.Publish(n.Topic, n.Payload)
+}
+
+// Job returns a copy of a job execution of thing.
+func (e *Emulator) Job(thing, jobID string) (*Job, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	j := e.job(thing, jobID)
+	if j == nil {
+		return nil, false
+	}
+	c := *j
+	return &c, true
+}
+
+func (e *Emulator) job(thing, jobID string) *Job {
+	if jobID == "$next" {
+		return e.next(thing)
+	}
+	for _, j := range e.jobs[thing] {
+		if j.ID == jobID {
+			return j
+		}
+	}
+	return nil
+}
+
+// next returns the job execution to run next: the first in progress or
+// else the first queued one.
+func (e *Emulator) next(thing string) *Job {
+	var queued *Job
+	for _, j := range e.jobs[thing] {
+		switch j.Status {
+		case JobInProgress:
+			return j
+		case JobQueued:
+			if queued == nil {
+				queued = j
+			}
+		}
+	}
+	return queued
+}
+
+// nextNotification returns the notify-next message of thing. The caller
+// holds e.mu.
+func (e *Emulator) nextNotification(thing string) Reply {
+	payload := map[string]interface{}{"timestamp": e.timestamp()}
+	if j := e.next(thing); j != nil {
+		payload["execution"] = j.execution(thing, true)
+	}
+	return Reply{Topic: jobsTopic(thing, "notify-next"), Payload: payload}
+}
+
+func (e *Emulator) jobsRequest(msg *connecttest.Message) []Reply {
+	lv := levels(msg.Topic())
+	if len(lv) < 5 || lv[3] != "jobs" {
+		return nil
+	}
+	thing := lv[2]
+	switch {
+	case len(lv) == 5 && lv[4] == "start-next":
+		return e.startNext(thing, msg)
+	case len(lv) == 5 && lv[4] == "get":
+		return e.pendingJobs(thing, msg)
+	case len(lv) == 6 && lv[5] == "get":
+		return e.describeJob(thing, lv[4], msg)
+	case len(lv) == 6 && lv[5] == "update":
+		return e.updateJob(thing, lv[4], msg)
+	}
+	return nil
+}
+
+func (e *Emulator) startNext(thing string, msg *connecttest.Message) []Reply {
+	var req struct {
+		StatusDetails map[string]string `json:"statusDetails"`
+		ClientToken   string            `json:"clientToken"`
+	}
+	if err := json.Unmarshal(msg.Payload(), &req); err != nil {
+		return RejectJob("InvalidJson", "Payload contains invalid json")(msg)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	res := map[string]interface{}{"timestamp": e.timestamp(), "clientToken": req.ClientToken}
+	if j := e.next(thing); j != nil {
+		if j.Status == JobQueued {
+			j.Status = JobInProgress
+			j.StartedAt = e.timestamp()
+			j.VersionNumber++
+		}
+		if req.StatusDetails != nil {
+			j.StatusDetails = req.StatusDetails
+		}
+		j.LastUpdatedAt = e.timestamp()
+		res["execution"] = j.execution(thing, true)
+	}
+	return []Reply{{Topic: msg.Topic() + "/accepted", Payload: res}}
+}
+
+func (e *Emulator) pendingJobs(thing string, msg *connecttest.Message) []Reply {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	inProgress, queued := []interface{}{}, []interface{}{}
+	for _, j := range e.jobs[thing] {
+		summary := map[string]interface{}{
+			"jobId":           j.ID,
+			"queuedAt":        j.QueuedAt,
+			"lastUpdatedAt":   j.LastUpdatedAt,
+			"versionNumber":   j.VersionNumber,
+			"executionNumber": j.ExecutionNumber,
+		}
+		switch j.Status {
+		case JobInProgress:
+			summary["startedAt"] = j.StartedAt
+			inProgress = append(inProgress, summary)
+		case JobQueued:
+			queued = append(queued, summary)
+		}
+	}
+	return []Reply{{Topic: msg.Topic() + "/accepted", Payload: map[string]interface{}{
+		"inProgressJobs": inProgress,
+		"queuedJobs":     queued,
+		"timestamp":      e.timestamp(),
+		"clientToken":    clientToken(msg),
+	}}}
+}
+
+func (e *Emulator) describeJob(thing, jobID string, msg *connecttest.Message) []Reply {
+	var req struct {
+		IncludeJobDocument *bool  `json:"includeJobDocument"`
+		ClientToken        string `json:"clientToken"`
+	}
+	if err := json.Unmarshal(msg.Payload(), &req); err != nil {
+		return RejectJob("InvalidJson", "Payload contains invalid json")(msg)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	j := e.job(thing, jobID)
+	if j == nil {
+		return RejectJob("ResourceNotFound", fmt.Sprintf("Job execution %s not found", jobID))(msg)
+	}
+	withDocument := req.IncludeJobDocument == nil || *req.IncludeJobDocument
+	return []Reply{{Topic: msg.Topic() + "/accepted", Payload: map[string]interface{}{
+		"execution":   j.execution(thing, withDocument),
+		"timestamp":   e.timestamp(),
+		"clientToken": req.ClientToken,
+	}}}
+}
+
+func (e *Emulator) updateJob(thing, jobID string, msg *connecttest.Message) []Reply {
+	var req struct {
+		Status                   string            `json:"status"`
+		StatusDetails            map[string]string `json:"statusDetails"`
+		ExpectedVersion          int               `json:"expectedVersion"`
+		IncludeJobExecutionState bool              `json:"includeJobExecutionState"`
+		IncludeJobDocument       bool              `json:"includeJobDocument"`
+		ClientToken              string            `json:"clientToken"`
+	}
+	if err := json.Unmarshal(msg.Payload(), &req); err != nil {
+		return RejectJob("InvalidJson", "Payload contains invalid json")(msg)
+	}
+
+	e.mu.Lock()
+	j := e.job(thing, jobID)
+	var rejected []Reply
+	switch {
+	case j == nil:
+		rejected = RejectJob("ResourceNotFound", fmt.Sprintf("Job execution %s not found", jobID))(msg)
+	case j.terminal():
+		rejected = RejectJob("InvalidStateTransition", fmt.Sprintf("Job execution %s is %s", jobID, j.Status))(msg)
+	case req.ExpectedVersion != 0 && req.ExpectedVersion != j.VersionNumber:
+		rejected = []Reply{{Topic: msg.Topic() + "/rejected", Payload: map[string]interface{}{
+			"code":           "VersionMismatch",
+			"message":        "Expected version does not match",
+			"timestamp":      e.timestamp(),
+			"clientToken":    req.ClientToken,
+			"executionState": j.state(),
+		}}}
+	}
+	if rejected != nil {
+		e.mu.Unlock()
+		return rejected
+	}
+
+	if j.Status == JobQueued && req.Status != JobQueued {
+		j.StartedAt = e.timestamp()
+	}
+	j.Status = req.Status
+	j.StatusDetails = req.StatusDetails
+	j.VersionNumber++
+	j.LastUpdatedAt = e.timestamp()
+	res := map[string]interface{}{"timestamp": e.timestamp(), "clientToken": req.ClientToken}
+	if req.IncludeJobExecutionState {
+		res["executionState"] = j.state()
+	}
+	if req.IncludeJobDocument {
+		res["jobDocument"] = j.Document
+	}
+	replies := []Reply{{Topic: msg.Topic() + "/accepted", Payload: res}}
+	if j.terminal() {
+		replies = append(replies, e.nextNotification(thing))
+	}
+	e.mu.Unlock()
+	return replies
+}
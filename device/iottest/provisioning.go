@@ -0,0 +1,251 @@
+package iottest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device/codec"
+	"github.com/randyridgley/simple-go-iot-device/device/connect/connecttest"
+)
+
+// Certificate is a certificate issued by the emulator.
+type Certificate struct {
+	ID  string
+	PEM string
+	// ThingName is the thing the certificate was registered with, empty
+	// until RegisterThing succeeded.
+	ThingName string
+}
+
+// RegisteredThing is a thing registered by a provisioning template.
+type RegisteredThing struct {
+	Name          string
+	Template      string
+	Parameters    map[string]string
+	CertificateID string
+}
+
+// authority signs the certificates of the emulator.
+type authority struct {
+	key    *ecdsa.PrivateKey
+	cert   *x509.Certificate
+	serial int64
+}
+
+func newAuthority() (*authority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating CA key %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "iottest CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("creating CA certificate %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CA certificate %v", err)
+	}
+	return &authority{key: key, cert: cert, serial: 1}, nil
+}
+
+// sign issues a certificate for pub and returns its id and PEM.
+func (a *authority) sign(pub interface{}) (string, string, error) {
+	a.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(a.serial),
+		Subject:      pkix.Name{CommonName: "AWS IoT Certificate"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, pub, a.key)
+	if err != nil {
+		return "", "", fmt.Errorf("creating certificate %v", err)
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+}
+
+// CACertificatePEM returns the certificate that signed the issued
+// certificates.
+func (e *Emulator) CACertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: e.ca.cert.Raw})
+}
+
+// Certificates returns the issued certificates.
+func (e *Emulator) Certificates() []Certificate {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	certs := make([]Certificate, 0, len(e.certs))
+	for _, c := range e.certs {
+		certs = append(certs, *c)
+	}
+	return certs
+}
+
+// Thing returns the thing registered with name.
+func (e *Emulator) Thing(name string) (*RegisteredThing, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	t, ok := e.things[name]
+	if !ok {
+		return nil, false
+	}
+	c := *t
+	return &c, true
+}
+
+// formatOf returns the codec of a fleet provisioning request, named by
+// the last level of its topic.
+func formatOf(msg *connecttest.Message) codec.Codec {
+	lv := levels(msg.Topic())
+	c, err := codec.ByName(lv[len(lv)-1])
+	if err != nil {
+		return codec.JSON
+	}
+	return c
+}
+
+// encodeReplies marshals the payloads of replies with c.
+func encodeReplies(c codec.Codec, replies []Reply) []Reply {
+	for i, r := range replies {
+		if _, ok := r.Payload.([]byte); ok {
+			continue
+		}
+		data, err := c.Marshal(r.Payload)
+		if err != nil {
+			fmt.Printf("marshaling reply to %s %v\n", r.Topic, err)
+			continue
+		}
+		replies[i].Payload = data
+	}
+	return replies
+}
+
+// provisioning answers fleet provisioning requests with handler in the
+// payload format of the request.
+func (e *Emulator) provisioning(handler Responder) Responder {
+	return func(msg *connecttest.Message) []Reply {
+		return encodeReplies(formatOf(msg), handler(msg))
+	}
+}
+
+// issue signs pub and returns the accepted response of a create request.
+func (e *Emulator) issue(pub interface{}) (map[string]interface{}, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	id, certPEM, err := e.ca.sign(pub)
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	ownership := hex.EncodeToString(token)
+	e.certs[id] = &Certificate{ID: id, PEM: certPEM}
+	e.tokens[ownership] = id
+	return map[string]interface{}{
+		"certificateId":             id,
+		"certificatePem":            certPEM,
+		"certificateOwnershipToken": ownership,
+	}, nil
+}
+
+func (e *Emulator) createKeysAndCertificate(msg *connecttest.Message) []Reply {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return RejectProvisioning(500, "InternalError", err.Error())(msg)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return RejectProvisioning(500, "InternalError", err.Error())(msg)
+	}
+	res, err := e.issue(&key.PublicKey)
+	if err != nil {
+		return RejectProvisioning(500, "InternalError", err.Error())(msg)
+	}
+	res["privateKey"] = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	return []Reply{{Topic: msg.Topic() + "/accepted", Payload: res}}
+}
+
+func (e *Emulator) createCertificateFromCSR(msg *connecttest.Message) []Reply {
+	var req struct {
+		CertificateSigningRequest string `json:"certificateSigningRequest"`
+	}
+	if err := formatOf(msg).Unmarshal(msg.Payload(), &req); err != nil {
+		return RejectProvisioning(400, "InvalidPayload", "Payload contains invalid json")(msg)
+	}
+	block, _ := pem.Decode([]byte(req.CertificateSigningRequest))
+	if block == nil {
+		return RejectProvisioning(400, "InvalidCertificateSigningRequest", "CSR is not PEM encoded")(msg)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		return RejectProvisioning(400, "InvalidCertificateSigningRequest", err.Error())(msg)
+	}
+	res, err := e.issue(csr.PublicKey)
+	if err != nil {
+		return RejectProvisioning(500, "InternalError", err.Error())(msg)
+	}
+	return []Reply{{Topic: msg.Topic() + "/accepted", Payload: res}}
+}
+
+func (e *Emulator) registerThing(msg *connecttest.Message) []Reply {
+	template := levels(msg.Topic())[2]
+	var req struct {
+		CertificateOwnershipToken string            `json:"certificateOwnershipToken"`
+		Parameters                map[string]string `json:"parameters"`
+	}
+	if err := formatOf(msg).Unmarshal(msg.Payload(), &req); err != nil {
+		return RejectProvisioning(400, "InvalidPayload", "Payload contains invalid json")(msg)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	certID, ok := e.tokens[req.CertificateOwnershipToken]
+	if !ok {
+		return RejectProvisioning(400, "InvalidCertificateOwnershipToken", "Certificate ownership token is invalid")(msg)
+	}
+	delete(e.tokens, req.CertificateOwnershipToken)
+
+	name := req.Parameters["thingName"]
+	if e.ThingName != nil {
+		name = e.ThingName(template, req.Parameters)
+	} else if name == "" {
+		name = "thing_" + req.Parameters["serialNumber"]
+	}
+	e.things[name] = &RegisteredThing{
+		Name:          name,
+		Template:      template,
+		Parameters:    req.Parameters,
+		CertificateID: certID,
+	}
+	e.certs[certID].ThingName = name
+	return []Reply{{Topic: msg.Topic() + "/accepted", Payload: map[string]interface{}{
+		"thingName":           name,
+		"deviceConfiguration": map[string]string{},
+	}}}
+}
@@ -0,0 +1,278 @@
+package iottest
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/randyridgley/simple-go-iot-device/device/connect/connecttest"
+)
+
+// ShadowState is the state of an emulated shadow.
+type ShadowState struct {
+	Desired  map[string]interface{} `json:"desired,omitempty"`
+	Reported map[string]interface{} `json:"reported,omitempty"`
+	Delta    map[string]interface{} `json:"delta,omitempty"`
+}
+
+// ShadowDocument is an emulated shadow document.
+type ShadowDocument struct {
+	State   ShadowState `json:"state"`
+	Version int         `json:"version"`
+}
+
+type shadowDocument struct {
+	desired  map[string]interface{}
+	reported map[string]interface{}
+	version  int
+}
+
+func shadowKey(thing, name string) string {
+	return thing + "/" + name
+}
+
+func shadowTopic(thing, name, operation string) string {
+	if name != "" {
+		return "$aws/things/" + thing + "/shadow/name/" + name + "/" + operation
+	}
+	return "$aws/things/" + thing + "/shadow/" + operation
+}
+
+// Shadow returns a copy of the shadow of thing, or of its named shadow if
+// name is set.
+func (e *Emulator) Shadow(thing, name string) (*ShadowDocument, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	doc, ok := e.shadows[shadowKey(thing, name)]
+	if !ok {
+		return nil, false
+	}
+	return &ShadowDocument{
+		State: ShadowState{
+			Desired:  copyState(doc.desired),
+			Reported: copyState(doc.reported),
+			Delta:    delta(doc.desired, doc.reported),
+		},
+		Version: doc.version,
+	}, true
+}
+
+// Desire updates the desired state of a shadow as an application in the
+// cloud would, which publishes the accepted update and the delta.
+func (e *Emulator) Desire(thing, name string, desired map[string]interface{}) error {
+	raw, err := json.Marshal(desired)
+	if err != nil {
+		return fmt.Errorf("marshaling desired state %v", err)
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"state": map[string]json.RawMessage{"desired": raw},
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling update %v", err)
+	}
+	for _, r := range e.updateShadow(thing, name, shadowTopic(thing, name, "update"), payload) {
+		if err := e.broker.Publish(r.Topic, r.Payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Emulator) shadowRequest(msg *connecttest.Message) []Reply {
+	lv := levels(msg.Topic())
+	var thing, name, op string
+	switch {
+	case len(lv) == 5 && lv[3] == "shadow":
+		thing, op = lv[2], lv[4]
+	case len(lv) == 7 && lv[3] == "shadow" && lv[4] == "name":
+		thing, name, op = lv[2], lv[5], lv[6]
+	default:
+		return nil
+	}
+	switch op {
+	case "get":
+		return e.getShadow(thing, name, msg)
+	case "update":
+		return e.updateShadow(thing, name, msg.Topic(), msg.Payload())
+	case "delete":
+		return e.deleteShadow(thing, name, msg)
+	}
+	return nil
+}
+
+func (e *Emulator) noShadow(thing, name string, msg *connecttest.Message) []Reply {
+	if name == "" {
+		name = thing
+	}
+	return RejectShadow(404, fmt.Sprintf("No shadow exists with name: '%s'", name))(msg)
+}
+
+func (e *Emulator) getShadow(thing, name string, msg *connecttest.Message) []Reply {
+	doc, ok := e.Shadow(thing, name)
+	if !ok {
+		return e.noShadow(thing, name, msg)
+	}
+	return []Reply{{Topic: msg.Topic() + "/accepted", Payload: map[string]interface{}{
+		"state":       doc.State,
+		"version":     doc.Version,
+		"timestamp":   e.timestamp(),
+		"clientToken": clientToken(msg),
+	}}}
+}
+
+func (e *Emulator) deleteShadow(thing, name string, msg *connecttest.Message) []Reply {
+	e.mu.Lock()
+	key := shadowKey(thing, name)
+	doc, ok := e.shadows[key]
+	delete(e.shadows, key)
+	e.mu.Unlock()
+	if !ok {
+		return e.noShadow(thing, name, msg)
+	}
+	return []Reply{{Topic: msg.Topic() + "/accepted", Payload: map[string]interface{}{
+		"version":     doc.version,
+		"timestamp":   e.timestamp(),
+		"clientToken": clientToken(msg),
+	}}}
+}
+
+func (e *Emulator) updateShadow(thing, name, topic string, payload []byte) []Reply {
+	var req struct {
+		State struct {
+			Desired  json.RawMessage `json:"desired"`
+			Reported json.RawMessage `json:"reported"`
+		} `json:"state"`
+		Version     int    `json:"version"`
+		ClientToken string `json:"clientToken"`
+	}
+	reject := func(code int, message string) []Reply {
+		return []Reply{{Topic: topic + "/rejected", Payload: map[string]interface{}{
+			"code":        code,
+			"message":     message,
+			"timestamp":   e.timestamp(),
+			"clientToken": req.ClientToken,
+		}}}
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return reject(400, "Payload contains invalid json")
+	}
+	if req.State.Desired == nil && req.State.Reported == nil {
+		return reject(400, "Missing required node: state")
+	}
+
+	e.mu.Lock()
+	key := shadowKey(thing, name)
+	doc, ok := e.shadows[key]
+	if !ok {
+		doc = &shadowDocument{desired: map[string]interface{}{}, reported: map[string]interface{}{}}
+	}
+	if req.Version != 0 && req.Version != doc.version {
+		e.mu.Unlock()
+		return reject(409, "Version conflict")
+	}
+	desired, err := mergeRaw(doc.desired, req.State.Desired)
+	if err == nil {
+		doc.reported, err = mergeRaw(doc.reported, req.State.Reported)
+	}
+	if err != nil {
+		e.mu.Unlock()
+		return reject(400, err.Error())
+	}
+	doc.desired = desired
+	doc.version++
+	e.shadows[key] = doc
+	version := doc.version
+	d := delta(doc.desired, doc.reported)
+	e.mu.Unlock()
+
+	state := map[string]json.RawMessage{}
+	if req.State.Desired != nil {
+		state["desired"] = req.State.Desired
+	}
+	if req.State.Reported != nil {
+		state["reported"] = req.State.Reported
+	}
+	replies := []Reply{{Topic: topic + "/accepted", Payload: map[string]interface{}{
+		"state":       state,
+		"version":     version,
+		"timestamp":   e.timestamp(),
+		"clientToken": req.ClientToken,
+	}}}
+	if req.State.Desired != nil && len(d) > 0 {
+		replies = append(replies, Reply{Topic: strings.TrimSuffix(topic, "update") + "update/delta", Payload: map[string]interface{}{
+			"state":     d,
+			"version":   version,
+			"timestamp": e.timestamp(),
+		}})
+	}
+	return replies
+}
+
+// mergeRaw applies the JSON update to state. A null update clears the
+// state and null values remove their keys.
+func mergeRaw(state map[string]interface{}, update json.RawMessage) (map[string]interface{}, error) {
+	if update == nil {
+		return state, nil
+	}
+	if string(update) == "null" {
+		return map[string]interface{}{}, nil
+	}
+	var u map[string]interface{}
+	if err := json.Unmarshal(update, &u); err != nil {
+		return nil, fmt.Errorf("State node must be an object")
+	}
+	merge(state, u)
+	return state, nil
+}
+
+func merge(state, update map[string]interface{}) {
+	for k, v := range update {
+		if v == nil {
+			delete(state, k)
+			continue
+		}
+		if um, ok := v.(map[string]interface{}); ok {
+			if sm, ok := state[k].(map[string]interface{}); ok {
+				merge(sm, um)
+				continue
+			}
+			sm := map[string]interface{}{}
+			merge(sm, um)
+			state[k] = sm
+			continue
+		}
+		state[k] = v
+	}
+}
+
+// delta returns the desired values that differ from the reported ones.
+func delta(desired, reported map[string]interface{}) map[string]interface{} {
+	d := map[string]interface{}{}
+	for k, dv := range desired {
+		rv := reported[k]
+		dm, dok := dv.(map[string]interface{})
+		rm, rok := rv.(map[string]interface{})
+		if dok && rok {
+			if sub := delta(dm, rm); len(sub) > 0 {
+				d[k] = sub
+			}
+			continue
+		}
+		if !reflect.DeepEqual(dv, rv) {
+			d[k] = dv
+		}
+	}
+	return d
+}
+
+func copyState(state map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(state))
+	for k, v := range state {
+		if m, ok := v.(map[string]interface{}); ok {
+			v = copyState(m)
+		}
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,121 @@
+package iottest
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/randyridgley/simple-go-iot-device/device/connect/connecttest"
+)
+
+// Limits of the AWS IoT MQTT-based file delivery.
+const (
+	minStreamBlockSize    = 256
+	maxStreamBlockSize    = 128 * 1024
+	maxStreamBlockRequest = 128
+)
+
+func streamTopic(thing, stream, operation string) string {
+	return "$aws/things/" + thing + "/streams/" + stream + "/" + operation
+}
+
+// AddStream creates a file stream that serves files by their ID, as an OTA
+// update creates for its files.
+func (e *Emulator) AddStream(name string, files map[int][]byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	stream := make(map[int][]byte, len(files))
+	for id, data := range files {
+		stream[id] = append([]byte(nil), data...)
+	}
+	e.streams[name] = stream
+}
+
+func (e *Emulator) streamRequest(msg *connecttest.Message) []Reply {
+	lv := levels(msg.Topic())
+	if len(lv) != 7 || lv[3] != "streams" || lv[5] != "get" {
+		return nil
+	}
+	if lv[6] != "json" {
+		return RejectStream("InvalidRequest", "Only the json format is emulated")(msg)
+	}
+	return e.StreamBlocks(msg)
+}
+
+// StreamBlocks is the Responder of the emulated streams. It answers a
+// GetStream request with one message per requested block. Scripts can
+// call it and alter the replies, for example to drop, repeat or reorder
+// blocks.
+func (e *Emulator) StreamBlocks(req *connecttest.Message) []Reply {
+	lv := levels(req.Topic())
+	if len(lv) != 7 {
+		return nil
+	}
+	thing, name := lv[2], lv[4]
+	var r struct {
+		ClientToken  string `json:"c"`
+		FileID       int    `json:"f"`
+		BlockSize    int    `json:"l"`
+		BlockOffset  int    `json:"o"`
+		NumberBlocks int    `json:"n"`
+	}
+	if err := json.Unmarshal(req.Payload(), &r); err != nil {
+		return RejectStream("InvalidRequest", "Payload contains invalid json")(req)
+	}
+	e.mu.Lock()
+	stream, ok := e.streams[name]
+	var data []byte
+	if ok {
+		data, ok = stream[r.FileID]
+	}
+	e.mu.Unlock()
+	switch {
+	case !ok:
+		return RejectStream("ResourceNotFound", fmt.Sprintf("File %d of stream %s not found", r.FileID, name))(req)
+	case r.BlockSize < minStreamBlockSize || r.BlockSize > maxStreamBlockSize:
+		return RejectStream("BlockSizeOutOfBounds", fmt.Sprintf("Block size %d is out of bounds", r.BlockSize))(req)
+	case r.NumberBlocks > maxStreamBlockRequest:
+		return RejectStream("BlockCountLimitExceeded", fmt.Sprintf("Too many blocks requested: %d", r.NumberBlocks))(req)
+	case r.BlockOffset < 0 || r.BlockOffset*r.BlockSize >= len(data):
+		return RejectStream("OffsetOutOfBounds", fmt.Sprintf("Block offset %d is out of bounds", r.BlockOffset))(req)
+	}
+
+	n := r.NumberBlocks
+	if n == 0 {
+		n = 1
+	}
+	var replies []Reply
+	for id := r.BlockOffset; id < r.BlockOffset+n && id*r.BlockSize < len(data); id++ {
+		end := (id + 1) * r.BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		replies = append(replies, Reply{Topic: streamTopic(thing, name, "data/json"), Payload: map[string]interface{}{
+			"c": r.ClientToken,
+			"f": r.FileID,
+			"l": end - id*r.BlockSize,
+			"i": id,
+			"p": data[id*r.BlockSize : end],
+		}})
+	}
+	return replies
+}
+
+// RejectStream is a Responder that rejects GetStream requests with code,
+// e.g. "ResourceNotFound" or "Unauthorized".
+func RejectStream(code, message string) Responder {
+	return func(req *connecttest.Message) []Reply {
+		lv := levels(req.Topic())
+		if len(lv) != 7 {
+			return nil
+		}
+		var r struct {
+			ClientToken string `json:"c"`
+		}
+		json.Unmarshal(req.Payload(), &r)
+		return []Reply{{Topic: streamTopic(lv[2], lv[4], "rejected/json"), Payload: map[string]interface{}{
+			"o": code,
+			"m": message,
+			"c": r.ClientToken,
+		}}}
+	}
+}
@@ -0,0 +1,49 @@
+package iottest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/connect/connecttest"
+)
+
+const (
+	defaultThingName   = "thing-1"
+	defaultTestTimeout = 10 * time.Second
+)
+
+// NewThing connects a thing configured with config to an emulator on a new
+// broker. ThingName defaults to "thing-1". The connection of the thing is
+// a *connecttest.Connection and the emulator is closed when the test ends.
+func NewThing(t testing.TB, config device.ThingConfiguration) (device.Thing, *Emulator) {
+	t.Helper()
+	if config.ThingName == "" {
+		config.ThingName = defaultThingName
+	}
+	broker := connecttest.NewBroker()
+	emu, err := New(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(emu.Close)
+	conn := broker.Connection(config.ThingName)
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return device.Thing{Connection: conn, Config: config}, emu
+}
+
+// Broker returns the broker the emulator answers requests on.
+func (e *Emulator) Broker() *connecttest.Broker {
+	return e.broker
+}
+
+// Context returns a context for the requests of a test, which is canceled
+// when the test ends or after 10 seconds.
+func Context(t testing.TB) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	t.Cleanup(cancel)
+	return ctx
+}
@@ -0,0 +1,399 @@
+/*
+Copyright © 2020 Randy Ridgley randy.ridgley@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/codec"
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+	"github.com/randyridgley/simple-go-iot-device/device/internal/clienttoken"
+)
+
+// Jobs is an interface of the AWS IoT Jobs device API.
+type Jobs interface {
+	// StartNextPendingJobExecution starts the next pending job execution.
+	// It returns nil if there is no pending job.
+	StartNextPendingJobExecution(ctx context.Context, statusDetails map[string]string) (*JobExecution, error)
+	// DescribeJobExecution gets the job execution including its document.
+	DescribeJobExecution(ctx context.Context, jobID string) (*JobExecution, error)
+	// UpdateJobExecution updates the status of a job execution.
+	UpdateJobExecution(ctx context.Context, jobID string, status JobStatus, statusDetails map[string]string) (*JobExecutionState, error)
+	// Handle registers the handler of the jobs with the given operation.
+	Handle(operation string, h Handler)
+	// Run executes pending jobs with the registered handlers until ctx is
+	// cancelled.
+	Run(ctx context.Context) error
+	// OnError sets handler of asynchronous errors.
+	OnError(func(error))
+}
+
+// Handler executes a job. Progress reports intermediate status details
+// while the job is running. The returned status details are attached to
+// the final SUCCEEDED or FAILED update.
+type Handler func(ctx context.Context, job *JobExecution, progress Progress) (map[string]string, error)
+
+// Progress reports status details of a running job.
+type Progress func(ctx context.Context, statusDetails map[string]string) error
+
+// retryInterval is the delay before asking for the next job again after a
+// failed request.
+const retryInterval = 30 * time.Second
+
+const (
+	defaultRequestTimeout = 30 * time.Second
+	// requestAttempts is how often a request is sent before it fails with
+	// connect.ErrTimeout.
+	requestAttempts = 3
+)
+
+// Option configures the Jobs client.
+type Option func(*jobs)
+
+// WithRequestTimeout sets how long to wait for the response to a request
+// before sending it again. It defaults to 30s.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(j *jobs) {
+		j.requestTimeout = d
+	}
+}
+
+// ErrInvalidResponse is returned if failed to parse response from AWS IoT.
+var ErrInvalidResponse = errors.New("invalid response from AWS IoT")
+
+// payloadCodec encodes requests and responses. AWS IoT serves the Jobs
+// API in JSON only.
+var payloadCodec = codec.JSON
+
+type jobs struct {
+	thing     device.Thing
+	thingName string
+	handlers  map[string]Handler
+	onError   func(err error)
+	mu        sync.Mutex
+	chResps   map[string]chan interface{}
+	chNext    chan struct{}
+	msgToken  uint32
+
+	requestTimeout time.Duration
+}
+
+func (j *jobs) token() string {
+	token := atomic.AddUint32(&j.msgToken, 1)
+	return fmt.Sprintf("%x", token)
+}
+
+func (j *jobs) topic(operation string) string {
+	return "$aws/things/" + j.thingName + "/jobs/" + operation
+}
+
+// New creates the Jobs client of the thing.
+func New(ctx context.Context, thing device.Thing, opts ...Option) (Jobs, error) {
+	j := &jobs{
+		thing:          thing,
+		thingName:      thing.Config.ThingName,
+		handlers:       make(map[string]Handler),
+		chResps:        make(map[string]chan interface{}),
+		chNext:         make(chan struct{}, 1),
+		requestTimeout: defaultRequestTimeout,
+	}
+	for _, opt := range opts {
+		opt(j)
+	}
+
+	r := connect.NewRouter(thing.Connection)
+	r.Use(connect.Recover())
+	r.OnError(j.handleError)
+	var registered []string
+	for _, route := range []struct {
+		pattern string
+		handler connect.HandlerFunc
+	}{
+		{j.topic("notify-next"), j.notifyNext},
+		{j.topic("start-next/accepted"), j.executionAccepted},
+		{j.topic("start-next/rejected"), j.rejected},
+		{j.topic("{jobId}/get/accepted"), j.executionAccepted},
+		{j.topic("{jobId}/get/rejected"), j.rejected},
+		{j.topic("{jobId}/update/accepted"), j.updateAccepted},
+		{j.topic("{jobId}/update/rejected"), j.rejected},
+	} {
+		if err := r.Handle(route.pattern, route.handler); err != nil {
+			for _, pattern := range registered {
+				r.Remove(pattern)
+			}
+			return nil, fmt.Errorf("registering message handlers %v", err)
+		}
+		registered = append(registered, route.pattern)
+	}
+
+	return j, nil
+}
+
+func (j *jobs) handleResponse(msg *connect.Message, r interface{}) {
+	token, ok := clienttoken.Response(msg, r)
+	if !ok {
+		return
+	}
+	j.mu.Lock()
+	ch, ok := j.chResps[token]
+	j.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- r:
+	default:
+	}
+}
+
+func (j *jobs) notifyNext(msg *connect.Message) error {
+	n := &nextNotification{}
+	if err := payloadCodec.Unmarshal(msg.Payload(), n); err != nil {
+		return fmt.Errorf("unmarshaling next job notification %v", err)
+	}
+	if n.Execution == nil {
+		return nil
+	}
+	select {
+	case j.chNext <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (j *jobs) executionAccepted(msg *connect.Message) error {
+	r := &executionResponse{}
+	if err := payloadCodec.Unmarshal(msg.Payload(), r); err != nil {
+		return fmt.Errorf("unmarshaling job execution %v", err)
+	}
+	j.handleResponse(msg, r)
+	return nil
+}
+
+func (j *jobs) updateAccepted(msg *connect.Message) error {
+	r := &updateResponse{}
+	if err := payloadCodec.Unmarshal(msg.Payload(), r); err != nil {
+		return fmt.Errorf("unmarshaling job execution state %v", err)
+	}
+	j.handleResponse(msg, r)
+	return nil
+}
+
+func (j *jobs) rejected(msg *connect.Message) error {
+	e := &ErrorResponse{}
+	if err := payloadCodec.Unmarshal(msg.Payload(), e); err != nil {
+		return fmt.Errorf("unmarshaling error response %v", err)
+	}
+	j.handleResponse(msg, e)
+	return nil
+}
+
+// request publishes req to topic and waits for the response correlated by
+// token. A request without response is sent again with the same token,
+// so a late response to an earlier attempt completes it as well.
+func (j *jobs) request(ctx context.Context, topic, token string, req interface{}) (interface{}, error) {
+	data, err := payloadCodec.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling request %v", err)
+	}
+
+	ch := make(chan interface{}, 1)
+	j.mu.Lock()
+	j.chResps[token] = ch
+	j.mu.Unlock()
+	defer func() {
+		j.mu.Lock()
+		delete(j.chResps, token)
+		j.mu.Unlock()
+	}()
+
+	for attempt := 1; attempt <= requestAttempts; attempt++ {
+		if t := j.thing.Connection.Publish(topic, data, connect.WithCorrelationData([]byte(token))); t.Wait() && t.Error() != nil {
+			return nil, fmt.Errorf("sending request %v", t.Error())
+		}
+
+		timer := time.NewTimer(j.requestTimeout)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+			fmt.Printf("No response to %s in %v\n", topic, j.requestTimeout)
+		case res := <-ch:
+			timer.Stop()
+			if e, ok := res.(*ErrorResponse); ok {
+				return nil, e
+			}
+			return res, nil
+		}
+	}
+	return nil, connect.ErrTimeout
+}
+
+func (j *jobs) StartNextPendingJobExecution(ctx context.Context, statusDetails map[string]string) (*JobExecution, error) {
+	token := j.token()
+	res, err := j.request(ctx, j.topic("start-next"), token, &startNextRequest{
+		StatusDetails: statusDetails,
+		ClientToken:   token,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("starting next job execution %w", err)
+	}
+	r, ok := res.(*executionResponse)
+	if !ok {
+		return nil, fmt.Errorf("starting next job execution %v", ErrInvalidResponse)
+	}
+	return r.Execution, nil
+}
+
+func (j *jobs) DescribeJobExecution(ctx context.Context, jobID string) (*JobExecution, error) {
+	token := j.token()
+	res, err := j.request(ctx, j.topic(jobID+"/get"), token, &describeRequest{
+		IncludeJobDocument: true,
+		ClientToken:        token,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describing job execution %s %w", jobID, err)
+	}
+	r, ok := res.(*executionResponse)
+	if !ok || r.Execution == nil {
+		return nil, fmt.Errorf("describing job execution %s %v", jobID, ErrInvalidResponse)
+	}
+	return r.Execution, nil
+}
+
+func (j *jobs) UpdateJobExecution(ctx context.Context, jobID string, status JobStatus, statusDetails map[string]string) (*JobExecutionState, error) {
+	token := j.token()
+	res, err := j.request(ctx, j.topic(jobID+"/update"), token, &updateRequest{
+		Status:                   status,
+		StatusDetails:            statusDetails,
+		IncludeJobExecutionState: true,
+		ClientToken:              token,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("updating job execution %s %w", jobID, err)
+	}
+	r, ok := res.(*updateResponse)
+	if !ok {
+		return nil, fmt.Errorf("updating job execution %s %v", jobID, ErrInvalidResponse)
+	}
+	return r.ExecutionState, nil
+}
+
+func (j *jobs) Handle(operation string, h Handler) {
+	j.mu.Lock()
+	j.handlers[operation] = h
+	j.mu.Unlock()
+}
+
+func (j *jobs) Run(ctx context.Context) error {
+	for {
+		// Drain every pending job, then wait for AWS IoT to notify us of
+		// the next one.
+		var retry <-chan time.Time
+		for {
+			job, err := j.StartNextPendingJobExecution(ctx, nil)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				j.handleError(err)
+				retry = time.After(retryInterval)
+				break
+			}
+			if job == nil {
+				break
+			}
+			j.execute(ctx, job)
+			if ctx.Err() != nil {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-j.chNext:
+		case <-retry:
+		}
+	}
+}
+
+// execute dispatches job to the handler of its operation and reports the
+// outcome.
+func (j *jobs) execute(ctx context.Context, job *JobExecution) {
+	op, err := operation(job.JobDocument)
+	if err != nil {
+		j.finish(ctx, job, Rejected, map[string]string{"reason": err.Error()})
+		return
+	}
+	j.mu.Lock()
+	h, ok := j.handlers[op]
+	j.mu.Unlock()
+	if !ok {
+		j.finish(ctx, job, Rejected, map[string]string{"reason": fmt.Sprintf("unsupported operation %q", op)})
+		return
+	}
+
+	fmt.Printf("Executing job %s (%s)\n", job.JobID, op)
+	progress := func(ctx context.Context, statusDetails map[string]string) error {
+		_, err := j.UpdateJobExecution(ctx, job.JobID, InProgress, statusDetails)
+		return err
+	}
+	details, err := h(ctx, job, progress)
+	if ctx.Err() != nil {
+		// Shutting down; leave the execution in progress so it is resumed
+		// or timed out by AWS IoT.
+		return
+	}
+	if err != nil {
+		if details == nil {
+			details = map[string]string{}
+		}
+		details["reason"] = err.Error()
+		j.finish(ctx, job, Failed, details)
+		return
+	}
+	j.finish(ctx, job, Succeeded, details)
+}
+
+func (j *jobs) finish(ctx context.Context, job *JobExecution, status JobStatus, statusDetails map[string]string) {
+	fmt.Printf("Job %s %s %v\n", job.JobID, status, statusDetails)
+	if _, err := j.UpdateJobExecution(ctx, job.JobID, status, statusDetails); err != nil {
+		j.handleError(err)
+	}
+}
+
+func (j *jobs) OnError(cb func(err error)) {
+	j.mu.Lock()
+	j.onError = cb
+	j.mu.Unlock()
+}
+
+func (j *jobs) handleError(err error) {
+	j.mu.Lock()
+	cb := j.onError
+	j.mu.Unlock()
+	if cb != nil {
+		cb(err)
+	}
+}
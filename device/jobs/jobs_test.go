@@ -0,0 +1,194 @@
+package jobs_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+	"github.com/randyridgley/simple-go-iot-device/device/iottest"
+	"github.com/randyridgley/simple-go-iot-device/device/jobs"
+)
+
+const thingName = "thing-1"
+
+// newJobs connects a thing to an emulated AWS IoT and creates its jobs
+// client.
+func newJobs(t *testing.T, opts ...jobs.Option) (jobs.Jobs, *iottest.Emulator) {
+	t.Helper()
+	thing, emu := iottest.NewThing(t, device.ThingConfiguration{ThingName: thingName})
+	j, err := jobs.New(context.Background(), thing, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j, emu
+}
+
+func TestStartNextAndUpdate(t *testing.T) {
+	j, emu := newJobs(t)
+	ctx := iottest.Context(t)
+
+	job, err := j.StartNextPendingJobExecution(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job != nil {
+		t.Fatalf("started %+v without pending jobs", job)
+	}
+
+	if err := emu.AddJob(thingName, "job-1", map[string]string{"operation": "reboot"}); err != nil {
+		t.Fatal(err)
+	}
+	job, err = j.StartNextPendingJobExecution(ctx, map[string]string{"step": "download"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil || job.JobID != "job-1" || job.Status != jobs.InProgress {
+		t.Fatalf("started %+v", job)
+	}
+	var doc map[string]string
+	if err := json.Unmarshal(job.JobDocument, &doc); err != nil || doc["operation"] != "reboot" {
+		t.Errorf("job document %s", job.JobDocument)
+	}
+
+	described, err := j.DescribeJobExecution(ctx, "job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if described.StatusDetails["step"] != "download" {
+		t.Errorf("described %+v", described)
+	}
+
+	state, err := j.UpdateJobExecution(ctx, "job-1", jobs.Succeeded, map[string]string{"step": "done"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != jobs.Succeeded || state.StatusDetails["step"] != "done" {
+		t.Errorf("updated %+v", state)
+	}
+	if remote, _ := emu.Job(thingName, "job-1"); remote.Status != iottest.JobSucceeded {
+		t.Errorf("emulated job %+v", remote)
+	}
+
+	// A finished execution cannot be updated again.
+	_, err = j.UpdateJobExecution(ctx, "job-1", jobs.InProgress, nil)
+	var rejected *jobs.ErrorResponse
+	if !errors.As(err, &rejected) || rejected.Code != "InvalidStateTransition" {
+		t.Errorf("UpdateJobExecution() of a finished job = %v", err)
+	}
+	_, err = j.DescribeJobExecution(ctx, "job-2")
+	if !errors.As(err, &rejected) || rejected.Code != "ResourceNotFound" {
+		t.Errorf("DescribeJobExecution() of a missing job = %v", err)
+	}
+}
+
+func TestRejected(t *testing.T) {
+	j, emu := newJobs(t)
+	ctx := iottest.Context(t)
+
+	emu.Script("$aws/things/+/jobs/start-next", 1, iottest.RejectJob("ThrottlingException", "Rate exceeded"))
+	_, err := j.StartNextPendingJobExecution(ctx, nil)
+	var rejected *jobs.ErrorResponse
+	if !errors.As(err, &rejected) || rejected.Code != "ThrottlingException" {
+		t.Errorf("StartNextPendingJobExecution() = %v, want the rejection", err)
+	}
+	if _, err := j.StartNextPendingJobExecution(ctx, nil); err != nil {
+		t.Errorf("StartNextPendingJobExecution() after the rejection %v", err)
+	}
+}
+
+func TestRetriesLostResponses(t *testing.T) {
+	j, emu := newJobs(t, jobs.WithRequestTimeout(50*time.Millisecond))
+	ctx := iottest.Context(t)
+	if err := emu.AddJob(thingName, "job-1", map[string]string{"operation": "reboot"}); err != nil {
+		t.Fatal(err)
+	}
+
+	emu.Script("$aws/things/+/jobs/start-next", 1, iottest.Drop())
+	job, err := j.StartNextPendingJobExecution(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil || job.JobID != "job-1" {
+		t.Fatalf("started %+v", job)
+	}
+
+	emu.Script("$aws/things/+/jobs/+/update", 2, iottest.Drop())
+	if _, err := j.UpdateJobExecution(ctx, "job-1", jobs.Succeeded, nil); err != nil {
+		t.Fatal(err)
+	}
+	if remote, _ := emu.Job(thingName, "job-1"); remote.Status != iottest.JobSucceeded {
+		t.Errorf("emulated job %+v", remote)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	j, emu := newJobs(t, jobs.WithRequestTimeout(10*time.Millisecond))
+	emu.Script("$aws/things/+/jobs/start-next", 0, iottest.Drop())
+
+	_, err := j.StartNextPendingJobExecution(iottest.Context(t), nil)
+	if !errors.Is(err, connect.ErrTimeout) {
+		t.Errorf("StartNextPendingJobExecution() = %v, want %v", err, connect.ErrTimeout)
+	}
+}
+
+func TestRun(t *testing.T) {
+	j, emu := newJobs(t)
+	ctx, cancel := context.WithCancel(iottest.Context(t))
+	defer cancel()
+
+	j.Handle("reboot", func(ctx context.Context, job *jobs.JobExecution, progress jobs.Progress) (map[string]string, error) {
+		if err := progress(ctx, map[string]string{"step": "rebooting"}); err != nil {
+			return nil, err
+		}
+		return map[string]string{"step": "rebooted"}, nil
+	})
+	j.Handle("fail", func(ctx context.Context, job *jobs.JobExecution, progress jobs.Progress) (map[string]string, error) {
+		return nil, errors.New("broken")
+	})
+
+	// The first job is pending when Run starts, the others are notified.
+	emu.AddJob(thingName, "job-1", map[string]string{"operation": "reboot"})
+	done := make(chan error, 1)
+	go func() { done <- j.Run(ctx) }()
+	emu.AddJob(thingName, "job-2", map[string]string{"operation": "fail"})
+	emu.AddJob(thingName, "job-3", map[string]string{"operation": "unknown"})
+
+	want := map[string]string{
+		"job-1": iottest.JobSucceeded,
+		"job-2": iottest.JobFailed,
+		"job-3": iottest.JobRejected,
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for id, status := range want {
+		for {
+			job, _ := emu.Job(thingName, id)
+			if job.Status == status {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s is %s, want %s", id, job.Status, status)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if job, _ := emu.Job(thingName, "job-1"); job.StatusDetails["step"] != "rebooted" {
+		t.Errorf("job-1 status details %v", job.StatusDetails)
+	}
+	if job, _ := emu.Job(thingName, "job-2"); job.StatusDetails["reason"] != "broken" {
+		t.Errorf("job-2 status details %v", job.StatusDetails)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run() did not return")
+	}
+}
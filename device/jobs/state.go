@@ -0,0 +1,115 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JobStatus is the status of a job execution.
+type JobStatus string
+
+// Job execution statuses defined by AWS IoT Jobs.
+const (
+	Queued     JobStatus = "QUEUED"
+	InProgress JobStatus = "IN_PROGRESS"
+	Succeeded  JobStatus = "SUCCEEDED"
+	Failed     JobStatus = "FAILED"
+	TimedOut   JobStatus = "TIMED_OUT"
+	Rejected   JobStatus = "REJECTED"
+	Removed    JobStatus = "REMOVED"
+	Canceled   JobStatus = "CANCELED"
+)
+
+// JobExecution represents a job execution of the thing.
+type JobExecution struct {
+	JobID           string            `json:"jobId"`
+	ThingName       string            `json:"thingName"`
+	JobDocument     json.RawMessage   `json:"jobDocument,omitempty"`
+	Status          JobStatus         `json:"status"`
+	StatusDetails   map[string]string `json:"statusDetails,omitempty"`
+	QueuedAt        int64             `json:"queuedAt,omitempty"`
+	StartedAt       int64             `json:"startedAt,omitempty"`
+	LastUpdatedAt   int64             `json:"lastUpdatedAt,omitempty"`
+	VersionNumber   int               `json:"versionNumber,omitempty"`
+	ExecutionNumber int64             `json:"executionNumber,omitempty"`
+}
+
+// JobExecutionState represents the state of a job execution.
+type JobExecutionState struct {
+	Status        JobStatus         `json:"status"`
+	StatusDetails map[string]string `json:"statusDetails,omitempty"`
+	VersionNumber int               `json:"versionNumber,omitempty"`
+}
+
+// ErrorResponse represents error response from AWS IoT Jobs.
+type ErrorResponse struct {
+	Code           string             `json:"code"`
+	Message        string             `json:"message"`
+	Timestamp      int64              `json:"timestamp"`
+	ClientToken    string             `json:"clientToken"`
+	ExecutionState *JobExecutionState `json:"executionState,omitempty"`
+}
+
+// Error implements error interface.
+func (e *ErrorResponse) Error() string {
+	return fmt.Sprintf("%s (%s): %s", e.Code, e.ClientToken, e.Message)
+}
+
+type startNextRequest struct {
+	StatusDetails        map[string]string `json:"statusDetails,omitempty"`
+	StepTimeoutInMinutes int               `json:"stepTimeoutInMinutes,omitempty"`
+	ClientToken          string            `json:"clientToken"`
+}
+
+type describeRequest struct {
+	ExecutionNumber    int64  `json:"executionNumber,omitempty"`
+	IncludeJobDocument bool   `json:"includeJobDocument"`
+	ClientToken        string `json:"clientToken"`
+}
+
+type updateRequest struct {
+	Status                   JobStatus         `json:"status"`
+	StatusDetails            map[string]string `json:"statusDetails,omitempty"`
+	ExpectedVersion          int               `json:"expectedVersion,omitempty"`
+	ExecutionNumber          int64             `json:"executionNumber,omitempty"`
+	IncludeJobExecutionState bool              `json:"includeJobExecutionState"`
+	StepTimeoutInMinutes     int               `json:"stepTimeoutInMinutes,omitempty"`
+	ClientToken              string            `json:"clientToken"`
+}
+
+type executionResponse struct {
+	Execution   *JobExecution `json:"execution,omitempty"`
+	Timestamp   int64         `json:"timestamp"`
+	ClientToken string        `json:"clientToken"`
+}
+
+type updateResponse struct {
+	ExecutionState *JobExecutionState `json:"executionState,omitempty"`
+	JobDocument    json.RawMessage    `json:"jobDocument,omitempty"`
+	Timestamp      int64              `json:"timestamp"`
+	ClientToken    string             `json:"clientToken"`
+}
+
+type nextNotification struct {
+	Execution *JobExecution `json:"execution,omitempty"`
+	Timestamp int64         `json:"timestamp"`
+}
+
+// OperationOTA is the operation of the job documents created by AWS IoT
+// OTA updates, which carry an "afr_ota" object instead of an operation.
+const OperationOTA = "afr_ota"
+
+// operation returns the operation name of a job document.
+func operation(doc json.RawMessage) (string, error) {
+	var d struct {
+		Operation string          `json:"operation"`
+		OTA       json.RawMessage `json:"afr_ota"`
+	}
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return "", fmt.Errorf("unmarshaling job document %v", err)
+	}
+	if d.Operation == "" && len(d.OTA) != 0 {
+		return OperationOTA, nil
+	}
+	return d.Operation, nil
+}
@@ -0,0 +1,110 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type encryptedKeystore struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+// NewEncryptedKeystore creates a Keystore that keeps the credentials of
+// each name in a single <name>.credentials.enc file in dir, encrypted with
+// AES-256-GCM under key.
+func NewEncryptedKeystore(dir string, key []byte) (Keystore, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("keystore key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher %v", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating keystore directory %v", err)
+	}
+	return &encryptedKeystore{dir: dir, aead: aead}, nil
+}
+
+// LoadKey reads a base64 encoded keystore key from path.
+func LoadKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("keystore key file is not configured")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading keystore key %v", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding keystore key %v", err)
+	}
+	return key, nil
+}
+
+func (k *encryptedKeystore) path(name string) string {
+	return filepath.Join(k.dir, name+".credentials.enc")
+}
+
+func (k *encryptedKeystore) Load(name string) (*Credentials, error) {
+	data, err := ioutil.ReadFile(k.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading credentials %v", err)
+	}
+	size := k.aead.NonceSize()
+	if len(data) < size {
+		return nil, fmt.Errorf("credentials of %s are truncated", name)
+	}
+	// The name is authenticated so files cannot be swapped between names.
+	plain, err := k.aead.Open(nil, data[:size], data[size:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting credentials of %s %v", name, err)
+	}
+	c := &Credentials{}
+	if err := json.Unmarshal(plain, c); err != nil {
+		return nil, fmt.Errorf("unmarshaling credentials %v", err)
+	}
+	return c, nil
+}
+
+func (k *encryptedKeystore) Store(name string, c *Credentials) error {
+	plain, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("marshaling credentials %v", err)
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("generating nonce %v", err)
+	}
+	data := k.aead.Seal(nonce, nonce, plain, []byte(name))
+	return writeFileAtomic(k.path(name), data, 0600)
+}
+
+func (k *encryptedKeystore) Exists(name string) bool {
+	_, err := os.Stat(k.path(name))
+	return err == nil
+}
+
+func (k *encryptedKeystore) Delete(name string) error {
+	if err := os.Remove(k.path(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing credentials of %s %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type fileKeystore struct {
+	dir string
+}
+
+// NewFileKeystore creates a Keystore that keeps the certificate and private
+// key of each name in a single <name>.credentials.pem file in dir, so they
+// are replaced together. The files are only readable by the owner.
+// Credentials in the separate <name>.certificate.pem and <name>.private.key
+// files of earlier versions are still loaded and replaced on the next
+// Store.
+func NewFileKeystore(dir string) (Keystore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating keystore directory %v", err)
+	}
+	return &fileKeystore{dir: dir}, nil
+}
+
+func (k *fileKeystore) path(name string) string {
+	return filepath.Join(k.dir, name+".credentials.pem")
+}
+
+func (k *fileKeystore) certificatePath(name string) string {
+	return filepath.Join(k.dir, name+".certificate.pem")
+}
+
+func (k *fileKeystore) privateKeyPath(name string) string {
+	return filepath.Join(k.dir, name+".private.key")
+}
+
+func (k *fileKeystore) Load(name string) (*Credentials, error) {
+	data, err := ioutil.ReadFile(k.path(name))
+	if os.IsNotExist(err) {
+		return k.loadSeparate(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading credentials %v", err)
+	}
+	c := &Credentials{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			c.CertificatePEM = append(c.CertificatePEM, pem.EncodeToMemory(block)...)
+		} else {
+			c.PrivateKeyPEM = append(c.PrivateKeyPEM, pem.EncodeToMemory(block)...)
+		}
+	}
+	if len(c.CertificatePEM) == 0 || len(c.PrivateKeyPEM) == 0 {
+		return nil, fmt.Errorf("credentials of %s are incomplete", name)
+	}
+	return c, nil
+}
+
+// loadSeparate reads credentials stored in two files.
+func (k *fileKeystore) loadSeparate(name string) (*Credentials, error) {
+	cert, err := ioutil.ReadFile(k.certificatePath(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading certificate %v", err)
+	}
+	key, err := ioutil.ReadFile(k.privateKeyPath(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading private key %v", err)
+	}
+	return &Credentials{CertificatePEM: cert, PrivateKeyPEM: key}, nil
+}
+
+func (k *fileKeystore) Store(name string, c *Credentials) error {
+	var data bytes.Buffer
+	data.Write(bytes.TrimSpace(c.CertificatePEM))
+	data.WriteByte('\n')
+	data.Write(bytes.TrimSpace(c.PrivateKeyPEM))
+	data.WriteByte('\n')
+	// A single rename replaces both, so a crash never leaves a certificate
+	// next to the key of another.
+	if err := writeFileAtomic(k.path(name), data.Bytes(), 0600); err != nil {
+		return err
+	}
+	return k.removeSeparate(name)
+}
+
+func (k *fileKeystore) Exists(name string) bool {
+	if _, err := os.Stat(k.path(name)); err == nil {
+		return true
+	}
+	for _, path := range []string{k.certificatePath(name), k.privateKeyPath(name)} {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (k *fileKeystore) Delete(name string) error {
+	if err := os.Remove(k.path(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing credentials of %s %v", name, err)
+	}
+	return k.removeSeparate(name)
+}
+
+// removeSeparate removes credentials stored in two files.
+func (k *fileKeystore) removeSeparate(name string) error {
+	for _, path := range []string{k.certificatePath(name), k.privateKeyPath(name)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing %s %v", path, err)
+		}
+	}
+	return nil
+}
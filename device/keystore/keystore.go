@@ -0,0 +1,121 @@
+/*
+Copyright © 2020 Randy Ridgley randy.ridgley@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Keystore types of the configuration.
+const (
+	TypeFile      = "file"
+	TypeEncrypted = "encrypted"
+)
+
+const defaultDirectory = "certs"
+
+// ErrNotFound is returned if no credentials are stored under a name.
+var ErrNotFound = errors.New("credentials not found")
+
+// Credentials is the certificate and private key of a device identity.
+type Credentials struct {
+	CertificatePEM []byte `json:"certificatePem"`
+	PrivateKeyPEM  []byte `json:"privateKey"`
+}
+
+// Keystore is an interface of a store for device credentials.
+type Keystore interface {
+	// Load returns the credentials stored under name.
+	Load(name string) (*Credentials, error)
+	// Store saves the credentials under name, replacing existing ones.
+	Store(name string, c *Credentials) error
+	// Exists reports whether credentials are stored under name.
+	Exists(name string) bool
+	// Delete removes the credentials stored under name.
+	Delete(name string) error
+}
+
+// Configuration selects and configures a Keystore.
+type Configuration struct {
+	// Type is TypeFile (default) or TypeEncrypted.
+	Type string
+	// Directory holds the credentials, "certs" by default.
+	Directory string
+	// KeyFile holds the base64 encoded AES-256 key of TypeEncrypted.
+	KeyFile string
+}
+
+// New creates the Keystore described by config.
+func New(config Configuration) (Keystore, error) {
+	dir := config.Directory
+	if dir == "" {
+		dir = defaultDirectory
+	}
+	switch config.Type {
+	case "", TypeFile:
+		return NewFileKeystore(dir)
+	case TypeEncrypted:
+		key, err := LoadKey(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return NewEncryptedKeystore(dir, key)
+	default:
+		return nil, fmt.Errorf("unsupported keystore type %q", config.Type)
+	}
+}
+
+// writeFileAtomic replaces path with data so readers never observe a
+// partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating temporary file %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := f.Chmod(perm); err != nil {
+		return fmt.Errorf("setting permissions of %s %v", path, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("writing %s %v", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing %s %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing %s %v", path, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("replacing %s %v", path, err)
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("opening %s %v", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("syncing %s %v", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+/*
+Copyright © 2020 Randy Ridgley randy.ridgley@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ota
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/jobs"
+)
+
+const (
+	defaultBlockSize        = 4096
+	defaultBlocksPerRequest = 8
+	defaultBlockTimeout     = 10 * time.Second
+	defaultMaxRetries       = 5
+)
+
+// ErrUnsupportedProtocol is returned if an OTA job cannot be downloaded
+// over MQTT.
+var ErrUnsupportedProtocol = errors.New("OTA job does not support the MQTT protocol")
+
+// Configuration configures the OTA agent.
+type Configuration struct {
+	// StagingDirectory receives the verified files.
+	StagingDirectory string
+	// CodeSigningCertificatePath is the certificate of the code signing
+	// key used to sign the files.
+	CodeSigningCertificatePath string
+	// AllowUnsigned accepts files without a signature in the job document.
+	AllowUnsigned bool
+	// BlockSize is the size of the blocks requested from the stream.
+	BlockSize int
+	// BlocksPerRequest is the number of blocks asked for in one request.
+	BlocksPerRequest int
+	// BlockTimeout is how long to wait for requested blocks.
+	BlockTimeout time.Duration
+	// MaxRetries is how often a request is repeated before giving up.
+	MaxRetries int
+}
+
+// Agent downloads the files of OTA jobs from AWS IoT MQTT file streams and
+// stages them for the device to install.
+type Agent struct {
+	thing     device.Thing
+	thingName string
+	config    Configuration
+	cert      *x509.Certificate
+	mu        sync.Mutex
+	download  *download
+	msgToken  uint32
+}
+
+// New creates an OTA agent.
+func New(thing device.Thing, config Configuration) (*Agent, error) {
+	if config.StagingDirectory == "" {
+		return nil, fmt.Errorf("OTA staging directory is not configured")
+	}
+	if config.BlockSize == 0 {
+		config.BlockSize = defaultBlockSize
+	}
+	if config.BlockSize < 256 || config.BlockSize > 128*1024 {
+		return nil, fmt.Errorf("OTA block size must be between 256 and 131072 bytes")
+	}
+	if config.BlocksPerRequest == 0 {
+		config.BlocksPerRequest = defaultBlocksPerRequest
+	}
+	if config.BlockTimeout == 0 {
+		config.BlockTimeout = defaultBlockTimeout
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = defaultMaxRetries
+	}
+
+	a := &Agent{
+		thing:     thing,
+		thingName: thing.Config.ThingName,
+		config:    config,
+	}
+	if config.CodeSigningCertificatePath != "" {
+		cert, err := loadCertificate(config.CodeSigningCertificatePath)
+		if err != nil {
+			return nil, err
+		}
+		a.cert = cert
+	} else if !config.AllowUnsigned {
+		return nil, fmt.Errorf("OTA code signing certificate is not configured")
+	}
+
+	if err := os.MkdirAll(config.StagingDirectory, 0755); err != nil {
+		return nil, fmt.Errorf("creating staging directory %v", err)
+	}
+	return a, nil
+}
+
+func loadCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading code signing certificate %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("code signing certificate %s is not PEM encoded", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing code signing certificate %v", err)
+	}
+	return cert, nil
+}
+
+func (a *Agent) token() string {
+	token := atomic.AddUint32(&a.msgToken, 1)
+	return fmt.Sprintf("%x", token)
+}
+
+// Handle executes an OTA job. It implements jobs.Handler and is registered
+// for jobs.OperationOTA.
+func (a *Agent) Handle(ctx context.Context, job *jobs.JobExecution, progress jobs.Progress) (map[string]string, error) {
+	doc, err := parseDocument(job.JobDocument)
+	if err != nil {
+		return nil, err
+	}
+	if !supportsMQTT(doc.Protocols) {
+		return nil, ErrUnsupportedProtocol
+	}
+
+	var staged []string
+	for i, f := range doc.Files {
+		report := func(done, total int) {
+			details := map[string]string{
+				"state":    "downloading",
+				"file":     strconv.Itoa(i+1) + "/" + strconv.Itoa(len(doc.Files)),
+				"progress": strconv.Itoa(done) + "/" + strconv.Itoa(total),
+			}
+			if err := progress(ctx, details); err != nil {
+				fmt.Printf("reporting OTA progress %v\n", err)
+			}
+		}
+		path, err := a.stage(ctx, doc.StreamName, f, report)
+		if err != nil {
+			return map[string]string{"file": f.FilePath}, err
+		}
+		staged = append(staged, path)
+	}
+
+	details := map[string]string{"state": "staged"}
+	for i, path := range staged {
+		details["staged"+strconv.Itoa(i)] = path
+	}
+	return details, nil
+}
+
+func supportsMQTT(protocols []string) bool {
+	if len(protocols) == 0 {
+		return true
+	}
+	for _, p := range protocols {
+		if p == "MQTT" {
+			return true
+		}
+	}
+	return false
+}
+
+// stage downloads f into a temporary file, verifies it and moves it into
+// the staging directory.
+func (a *Agent) stage(ctx context.Context, streamName string, f File, report func(done, total int)) (string, error) {
+	tmp, err := ioutil.TempFile(a.config.StagingDirectory, ".ota-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("creating staging file %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	fmt.Printf("Downloading %s (%d bytes) from stream %s\n", f.FilePath, f.FileSize, streamName)
+	if err := a.fetch(ctx, streamName, f, tmp, report); err != nil {
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", fmt.Errorf("syncing staging file %v", err)
+	}
+	if err := a.verify(tmp, f); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("closing staging file %v", err)
+	}
+
+	path, err := commit(tmp.Name(), a.config.StagingDirectory, f.FilePath)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Staged %s at %s\n", f.FilePath, path)
+	return path, nil
+}
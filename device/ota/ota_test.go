@@ -0,0 +1,373 @@
+package ota_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/connect/connecttest"
+	"github.com/randyridgley/simple-go-iot-device/device/iottest"
+	"github.com/randyridgley/simple-go-iot-device/device/jobs"
+	"github.com/randyridgley/simple-go-iot-device/device/ota"
+)
+
+const (
+	thingName  = "thing-1"
+	streamName = "stream-1"
+	getTopic   = "$aws/things/" + thingName + "/streams/" + streamName + "/get/json"
+	blockSize  = 256
+)
+
+type fixture struct {
+	broker  *connecttest.Broker
+	emu     *iottest.Emulator
+	thing   device.Thing
+	key     crypto.Signer
+	certDir string
+	staging string
+	image   []byte
+}
+
+// newFixture connects a thing to an emulated AWS IoT that streams an image
+// of a little more than four blocks, and creates a code signing key of the
+// kind of key.
+func newFixture(t *testing.T, key crypto.Signer) *fixture {
+	t.Helper()
+	thing, emu := iottest.NewThing(t, device.ThingConfiguration{ThingName: thingName})
+	image := make([]byte, 4*blockSize+100)
+	rand.Read(image)
+	emu.AddStream(streamName, map[int][]byte{0: image})
+	return &fixture{
+		broker:  emu.Broker(),
+		emu:     emu,
+		thing:   thing,
+		key:     key,
+		certDir: t.TempDir(),
+		staging: t.TempDir(),
+		image:   image,
+	}
+}
+
+func ecdsaKey(t *testing.T) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func rsaKey(t *testing.T) crypto.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// certificate writes a self-signed certificate of key and returns its path.
+func (f *fixture) certificate(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "code signing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(f.certDir, "signer.crt")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// agent creates an OTA agent that trusts the code signing key.
+func (f *fixture) agent(t *testing.T) *ota.Agent {
+	t.Helper()
+	a, err := ota.New(f.thing, ota.Configuration{
+		StagingDirectory:           f.staging,
+		CodeSigningCertificatePath: f.certificate(t, f.key),
+		BlockSize:                  blockSize,
+		BlocksPerRequest:           4,
+		BlockTimeout:               50 * time.Millisecond,
+		MaxRetries:                 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// sign returns the signature of data by key, as AWS code signing puts it
+// into the job document.
+func sign(t *testing.T, key crypto.Signer, data []byte) string {
+	t.Helper()
+	digest := sha256.Sum256(data)
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		sig, err = ecdsa.SignASN1(rand.Reader, k, digest[:])
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// file describes the streamed image signed by the code signing key.
+func (f *fixture) file(t *testing.T) ota.File {
+	file := ota.File{
+		FilePath: "/firmware/app.bin",
+		FileSize: int64(len(f.image)),
+		FileID:   0,
+		CertFile: "signer.crt",
+	}
+	switch f.key.(type) {
+	case *ecdsa.PrivateKey:
+		file.SignatureSHA256ECDSA = sign(t, f.key, f.image)
+	case *rsa.PrivateKey:
+		file.SignatureSHA256RSA = sign(t, f.key, f.image)
+	}
+	return file
+}
+
+// run executes an OTA job that updates files.
+func run(t *testing.T, a *ota.Agent, files ...ota.File) (map[string]string, error) {
+	t.Helper()
+	doc, err := json.Marshal(map[string]interface{}{"afr_ota": &ota.Document{
+		Protocols:  []string{"MQTT"},
+		StreamName: streamName,
+		Files:      files,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &jobs.JobExecution{JobID: "ota-1", JobDocument: doc}
+	return a.Handle(iottest.Context(t), job, func(context.Context, map[string]string) error { return nil })
+}
+
+// staged returns the names of the files in the staging directory.
+func (f *fixture) staged(t *testing.T) []string {
+	t.Helper()
+	entries, err := ioutil.ReadDir(f.staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// expectStaged checks that the image is the only file in the staging
+// directory.
+func (f *fixture) expectStaged(t *testing.T, details map[string]string) {
+	t.Helper()
+	path := filepath.Join(f.staging, "app.bin")
+	if details["staged0"] != path {
+		t.Errorf("status details %v", details)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, f.image) {
+		t.Error("staged file differs from the image")
+	}
+	if names := f.staged(t); len(names) != 1 {
+		t.Errorf("staging directory holds %v", names)
+	}
+}
+
+// expectNothingStaged checks that a rejected file was neither committed
+// nor left behind as temporary file.
+func (f *fixture) expectNothingStaged(t *testing.T) {
+	t.Helper()
+	if names := f.staged(t); len(names) != 0 {
+		t.Errorf("staging directory holds %v", names)
+	}
+}
+
+func TestStage(t *testing.T) {
+	for name, key := range map[string]crypto.Signer{"ecdsa": ecdsaKey(t), "rsa": rsaKey(t)} {
+		t.Run(name, func(t *testing.T) {
+			f := newFixture(t, key)
+			file := f.file(t)
+			sum := sha256.Sum256(f.image)
+			file.SHA256 = hex.EncodeToString(sum[:])
+
+			details, err := run(t, f.agent(t), file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.expectStaged(t, details)
+			if n := len(f.broker.Messages(getTopic)); n != 2 {
+				t.Errorf("%d requests, want 2", n)
+			}
+		})
+	}
+}
+
+func TestRejectTampered(t *testing.T) {
+	for name, key := range map[string]crypto.Signer{"ecdsa": ecdsaKey(t), "rsa": rsaKey(t)} {
+		t.Run(name, func(t *testing.T) {
+			f := newFixture(t, key)
+			file := f.file(t)
+			f.image[blockSize] ^= 1
+			f.emu.AddStream(streamName, map[int][]byte{0: f.image})
+
+			if _, err := run(t, f.agent(t), file); !errors.Is(err, ota.ErrSignatureMismatch) {
+				t.Errorf("Handle() = %v, want %v", err, ota.ErrSignatureMismatch)
+			}
+			f.expectNothingStaged(t)
+		})
+	}
+}
+
+func TestRejectWrongKey(t *testing.T) {
+	f := newFixture(t, ecdsaKey(t))
+	file := f.file(t)
+	file.SignatureSHA256ECDSA = sign(t, ecdsaKey(t), f.image)
+
+	if _, err := run(t, f.agent(t), file); !errors.Is(err, ota.ErrSignatureMismatch) {
+		t.Errorf("Handle() = %v, want %v", err, ota.ErrSignatureMismatch)
+	}
+	f.expectNothingStaged(t)
+}
+
+func TestRejectUnsigned(t *testing.T) {
+	f := newFixture(t, ecdsaKey(t))
+	file := f.file(t)
+	file.SignatureSHA256ECDSA = ""
+
+	if _, err := run(t, f.agent(t), file); err == nil {
+		t.Error("Handle() of an unsigned file succeeded")
+	}
+	f.expectNothingStaged(t)
+}
+
+func TestAllowUnsigned(t *testing.T) {
+	f := newFixture(t, nil)
+	a, err := ota.New(f.thing, ota.Configuration{
+		StagingDirectory: f.staging,
+		AllowUnsigned:    true,
+		BlockSize:        blockSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	details, err := run(t, a, f.file(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.expectStaged(t, details)
+}
+
+func TestRejectHashMismatch(t *testing.T) {
+	f := newFixture(t, ecdsaKey(t))
+	file := f.file(t)
+	sum := sha256.Sum256([]byte("other image"))
+	file.SHA256 = hex.EncodeToString(sum[:])
+
+	if _, err := run(t, f.agent(t), file); !errors.Is(err, ota.ErrHashMismatch) {
+		t.Errorf("Handle() = %v, want %v", err, ota.ErrHashMismatch)
+	}
+	f.expectNothingStaged(t)
+}
+
+func TestStreamFailures(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		alter func([]iottest.Reply) []iottest.Reply
+		// requests is the number of requests made for the image.
+		requests int
+	}{{
+		name: "missing",
+		alter: func(blocks []iottest.Reply) []iottest.Reply {
+			return append(blocks[:1:1], blocks[2:]...)
+		},
+		requests: 3,
+	}, {
+		name: "duplicate",
+		alter: func(blocks []iottest.Reply) []iottest.Reply {
+			return append(blocks, blocks...)
+		},
+		requests: 2,
+	}, {
+		name: "out of order",
+		alter: func(blocks []iottest.Reply) []iottest.Reply {
+			for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+				blocks[i], blocks[j] = blocks[j], blocks[i]
+			}
+			return blocks
+		},
+		requests: 2,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			f := newFixture(t, ecdsaKey(t))
+			alter := c.alter
+			f.emu.Script(getTopic, 1, func(req *connecttest.Message) []iottest.Reply {
+				return alter(f.emu.StreamBlocks(req))
+			})
+
+			details, err := run(t, f.agent(t), f.file(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.expectStaged(t, details)
+			if n := len(f.broker.Messages(getTopic)); n != c.requests {
+				t.Errorf("%d requests, want %d", n, c.requests)
+			}
+		})
+	}
+}
+
+func TestStreamRejected(t *testing.T) {
+	f := newFixture(t, ecdsaKey(t))
+	f.emu.Script(getTopic, 0, iottest.RejectStream("Unauthorized", "Not authorized"))
+
+	if _, err := run(t, f.agent(t), f.file(t)); err == nil {
+		t.Error("Handle() of a rejected stream succeeded")
+	}
+	f.expectNothingStaged(t)
+}
+
+func TestStreamTimeout(t *testing.T) {
+	f := newFixture(t, ecdsaKey(t))
+	f.emu.Script(getTopic, 0, iottest.Drop())
+
+	if _, err := run(t, f.agent(t), f.file(t)); err == nil {
+		t.Error("Handle() of a silent stream succeeded")
+	}
+	// The request is repeated MaxRetries times.
+	if n := len(f.broker.Messages(getTopic)); n != 4 {
+		t.Errorf("%d requests, want 4", n)
+	}
+	f.expectNothingStaged(t)
+}
@@ -0,0 +1,77 @@
+package ota
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Document is the "afr_ota" object of an OTA job document.
+type Document struct {
+	Protocols  []string `json:"protocols"`
+	StreamName string   `json:"streamname"`
+	Files      []File   `json:"files"`
+}
+
+// File describes a file of an OTA update.
+type File struct {
+	FilePath             string `json:"filepath"`
+	FileSize             int64  `json:"filesize"`
+	FileID               int    `json:"fileid"`
+	CertFile             string `json:"certfile"`
+	FileType             int    `json:"fileType,omitempty"`
+	SHA256               string `json:"sha256,omitempty"`
+	SignatureSHA256ECDSA string `json:"sig-sha256-ecdsa,omitempty"`
+	SignatureSHA256RSA   string `json:"sig-sha256-rsa,omitempty"`
+}
+
+type jobDocument struct {
+	OTA *Document `json:"afr_ota"`
+}
+
+// parseDocument extracts the OTA document from a job document.
+func parseDocument(doc json.RawMessage) (*Document, error) {
+	d := &jobDocument{}
+	if err := json.Unmarshal(doc, d); err != nil {
+		return nil, fmt.Errorf("unmarshaling job document %v", err)
+	}
+	if d.OTA == nil {
+		return nil, fmt.Errorf("job document has no afr_ota object")
+	}
+	if d.OTA.StreamName == "" {
+		return nil, fmt.Errorf("job document has no stream name")
+	}
+	if len(d.OTA.Files) == 0 {
+		return nil, fmt.Errorf("job document has no files")
+	}
+	return d.OTA, nil
+}
+
+// getStreamRequest asks for blocks of a file of a stream.
+type getStreamRequest struct {
+	ClientToken  string `json:"c"`
+	FileID       int    `json:"f"`
+	BlockSize    int    `json:"l"`
+	BlockOffset  int    `json:"o"`
+	NumberBlocks int    `json:"n"`
+}
+
+// dataBlock is a block of a file sent on the data topic of a stream.
+type dataBlock struct {
+	ClientToken string `json:"c"`
+	FileID      int    `json:"f"`
+	BlockSize   int    `json:"l"`
+	BlockID     int    `json:"i"`
+	Payload     []byte `json:"p"`
+}
+
+// ErrorResponse represents error response from the AWS IoT streams.
+type ErrorResponse struct {
+	Code        string `json:"o"`
+	Message     string `json:"m"`
+	ClientToken string `json:"c"`
+}
+
+// Error implements error interface.
+func (e *ErrorResponse) Error() string {
+	return fmt.Sprintf("%s (%s): %s", e.Code, e.ClientToken, e.Message)
+}
@@ -0,0 +1,189 @@
+package ota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+)
+
+// download is the state of the file currently fetched from a stream.
+type download struct {
+	fileID   int
+	chBlocks chan *dataBlock
+	chErrors chan *ErrorResponse
+}
+
+func (a *Agent) streamTopic(streamName, operation string) string {
+	return "$aws/things/" + a.thingName + "/streams/" + streamName + "/" + operation
+}
+
+func (a *Agent) dataReceived(client mqtt.Client, msg mqtt.Message) {
+	b := &dataBlock{}
+	if err := json.Unmarshal(msg.Payload(), b); err != nil {
+		fmt.Printf("unmarshaling stream data block %v\n", err)
+		return
+	}
+	a.mu.Lock()
+	d := a.download
+	a.mu.Unlock()
+	if d == nil || d.fileID != b.FileID {
+		return
+	}
+	select {
+	case d.chBlocks <- b:
+	default:
+		// Dropped blocks are requested again.
+	}
+}
+
+func (a *Agent) rejected(client mqtt.Client, msg mqtt.Message) {
+	e := &ErrorResponse{}
+	if err := json.Unmarshal(msg.Payload(), e); err != nil {
+		fmt.Printf("unmarshaling stream error response %v\n", err)
+		return
+	}
+	a.mu.Lock()
+	d := a.download
+	a.mu.Unlock()
+	if d == nil {
+		return
+	}
+	select {
+	case d.chErrors <- e:
+	default:
+	}
+}
+
+// fetch writes every block of f from the stream into w.
+func (a *Agent) fetch(ctx context.Context, streamName string, f File, w *os.File, report func(done, total int)) error {
+	blockSize := a.config.BlockSize
+	total := int((f.FileSize + int64(blockSize) - 1) / int64(blockSize))
+	if total == 0 {
+		return nil
+	}
+
+	d := &download{
+		fileID:   f.FileID,
+		chBlocks: make(chan *dataBlock, a.config.BlocksPerRequest*2),
+		chErrors: make(chan *ErrorResponse, 1),
+	}
+	a.mu.Lock()
+	a.download = d
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.download = nil
+		a.mu.Unlock()
+	}()
+
+	dataTopic := a.streamTopic(streamName, "data/json")
+	rejectedTopic := a.streamTopic(streamName, "rejected/json")
+	if err := a.thing.Connection.SubscribeMultiple([]connect.Subscription{
+		{Topic: dataTopic, QoS: 1, Handler: a.dataReceived},
+		{Topic: rejectedTopic, QoS: 1, Handler: a.rejected},
+	}); err != nil {
+		a.thing.Connection.Unsubscribe(dataTopic, rejectedTopic)
+		return fmt.Errorf("subscribing to stream %v", err)
+	}
+	defer a.thing.Connection.Unsubscribe(dataTopic, rejectedTopic)
+
+	received := make([]bool, total)
+	done := 0
+	retries := 0
+	lastReport := time.Now()
+	for done < total {
+		// Ask for the next run of missing blocks.
+		offset := 0
+		for received[offset] {
+			offset++
+		}
+		n := 0
+		for offset+n < total && n < a.config.BlocksPerRequest && !received[offset+n] {
+			n++
+		}
+		if err := a.request(streamName, f.FileID, offset, n); err != nil {
+			return err
+		}
+
+		timeout := time.NewTimer(a.config.BlockTimeout)
+		pending := n
+	wait:
+		for pending > 0 {
+			select {
+			case <-ctx.Done():
+				timeout.Stop()
+				return ctx.Err()
+			case e := <-d.chErrors:
+				timeout.Stop()
+				return fmt.Errorf("requesting stream %s %v", streamName, e)
+			case <-timeout.C:
+				retries++
+				if retries > a.config.MaxRetries {
+					return fmt.Errorf("timed out downloading %s after %d retries", f.FilePath, a.config.MaxRetries)
+				}
+				break wait
+			case b := <-d.chBlocks:
+				if b.BlockID < 0 || b.BlockID >= total || received[b.BlockID] {
+					continue
+				}
+				if err := writeBlock(w, b, blockSize, total, f.FileSize); err != nil {
+					timeout.Stop()
+					return err
+				}
+				received[b.BlockID] = true
+				done++
+				if b.BlockID >= offset && b.BlockID < offset+n {
+					pending--
+				}
+			}
+		}
+		timeout.Stop()
+		if pending == 0 {
+			retries = 0
+		}
+
+		if time.Since(lastReport) > 5*time.Second || done == total {
+			report(done, total)
+			lastReport = time.Now()
+		}
+	}
+	return nil
+}
+
+func (a *Agent) request(streamName string, fileID, offset, n int) error {
+	data, err := json.Marshal(&getStreamRequest{
+		ClientToken:  a.token(),
+		FileID:       fileID,
+		BlockSize:    a.config.BlockSize,
+		BlockOffset:  offset,
+		NumberBlocks: n,
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling request %v", err)
+	}
+	if token := a.thing.Connection.Publish(a.streamTopic(streamName, "get/json"), data); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("sending request %v", token.Error())
+	}
+	return nil
+}
+
+// writeBlock writes b at its position in the file and checks its length.
+func writeBlock(w *os.File, b *dataBlock, blockSize, total int, fileSize int64) error {
+	want := blockSize
+	if b.BlockID == total-1 {
+		want = int(fileSize - int64(blockSize)*int64(total-1))
+	}
+	if len(b.Payload) != want {
+		return fmt.Errorf("block %d has %d bytes, expected %d", b.BlockID, len(b.Payload), want)
+	}
+	if _, err := w.WriteAt(b.Payload, int64(b.BlockID)*int64(blockSize)); err != nil {
+		return fmt.Errorf("writing block %d %v", b.BlockID, err)
+	}
+	return nil
+}
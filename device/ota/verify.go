@@ -0,0 +1,116 @@
+package ota
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrSignatureMismatch is returned if a file does not match its signature.
+var ErrSignatureMismatch = errors.New("signature verification failed")
+
+// ErrHashMismatch is returned if a file does not match its SHA-256 hash.
+var ErrHashMismatch = errors.New("hash verification failed")
+
+// verify checks the size, hash and code signing signature of the file.
+func (a *Agent) verify(r *os.File, f File) error {
+	info, err := r.Stat()
+	if err != nil {
+		return fmt.Errorf("reading staging file %v", err)
+	}
+	if info.Size() != f.FileSize {
+		return fmt.Errorf("file has %d bytes, expected %d", info.Size(), f.FileSize)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, info.Size())); err != nil {
+		return fmt.Errorf("hashing staging file %v", err)
+	}
+	digest := h.Sum(nil)
+
+	if f.SHA256 != "" {
+		want, err := hex.DecodeString(f.SHA256)
+		if err != nil || !bytes.Equal(want, digest) {
+			return ErrHashMismatch
+		}
+	}
+
+	switch {
+	case f.SignatureSHA256ECDSA != "":
+		return a.verifyECDSA(digest, f.SignatureSHA256ECDSA)
+	case f.SignatureSHA256RSA != "":
+		return a.verifyRSA(digest, f.SignatureSHA256RSA)
+	case a.config.AllowUnsigned:
+		return nil
+	default:
+		return fmt.Errorf("file %s is not signed", f.FilePath)
+	}
+}
+
+func (a *Agent) verifyECDSA(digest []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("decoding signature %v", err)
+	}
+	if a.cert == nil {
+		return fmt.Errorf("no code signing certificate to verify the signature")
+	}
+	key, ok := a.cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("code signing certificate does not hold an ECDSA key")
+	}
+	if !ecdsa.VerifyASN1(key, digest, sig) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+func (a *Agent) verifyRSA(digest []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("decoding signature %v", err)
+	}
+	if a.cert == nil {
+		return fmt.Errorf("no code signing certificate to verify the signature")
+	}
+	key, ok := a.cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("code signing certificate does not hold an RSA key")
+	}
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig); err != nil {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+// commit atomically moves the verified file into the staging directory
+// under the base name of its OTA file path.
+func commit(tmp, dir, filePath string) (string, error) {
+	name := filepath.Base(filepath.Clean("/" + filePath))
+	if name == "/" || name == "." {
+		return "", fmt.Errorf("invalid OTA file path %q", filePath)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.Rename(tmp, path); err != nil {
+		return "", fmt.Errorf("moving staged file %v", err)
+	}
+	// Persist the rename itself.
+	d, err := os.Open(dir)
+	if err != nil {
+		return "", fmt.Errorf("opening staging directory %v", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return "", fmt.Errorf("syncing staging directory %v", err)
+	}
+	return path, nil
+}
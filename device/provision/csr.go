@@ -0,0 +1,67 @@
+package provision
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+)
+
+// Certificate modes of the bootstrap configuration.
+const (
+	// CertificateModeCreate lets AWS IoT generate the key pair.
+	CertificateModeCreate = "create"
+	// CertificateModeCSR generates the key pair on the device and only
+	// sends a certificate signing request to AWS IoT.
+	CertificateModeCSR = "csr"
+)
+
+// Key algorithms for CertificateModeCSR.
+const (
+	KeyAlgorithmECDSAP256 = "ecdsa-p256"
+	KeyAlgorithmRSA2048   = "rsa-2048"
+)
+
+type createFromCSRRequest struct {
+	CertificateSigningRequest string `json:"certificateSigningRequest"`
+}
+
+// generateKey creates a private key with the given algorithm and returns it
+// along with its PEM encoding.
+func generateKey(algorithm string) (crypto.Signer, []byte, error) {
+	var key crypto.Signer
+	var err error
+	switch algorithm {
+	case "", KeyAlgorithmECDSAP256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyAlgorithmRSA2048:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, nil, fmt.Errorf("unsupported key algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating private key %v", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling private key %v", err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// createCSR creates a PEM encoded certificate signing request for key.
+func createCSR(key crypto.Signer, commonName string) ([]byte, error) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("creating certificate signing request %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
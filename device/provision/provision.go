@@ -17,27 +17,30 @@ package provision
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"os"
-	"sync"
-	"sync/atomic"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/codec"
 	"github.com/randyridgley/simple-go-iot-device/device/connect"
-	"github.com/spf13/viper"
+	"github.com/randyridgley/simple-go-iot-device/device/keystore"
 )
 
-const certAccepted = "$aws/certificates/create/json/accepted"
-const certRejected = "$aws/certificates/create/json/rejected"
-const certCreate = "$aws/certificates/create/json"
+const certCreate = "$aws/certificates/create/"
+const csrCreate = "$aws/certificates/create-from-csr/"
+
+const (
+	defaultRequestTimeout = 30 * time.Second
+	defaultMaxAttempts    = 5
+	defaultInitialBackoff = 1 * time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
 
 // Provision is an interface of Thing Provisioning.
 type Provision interface {
-	Provision(ctx context.Context)
+	Provision(ctx context.Context) error
 	Disconnect(ctx context.Context)
 }
 
@@ -64,42 +67,56 @@ func NewRegisterThingRequest(p *Provisioner) *RegisterThingRequest {
 	}
 }
 
-func (p *Provisioner) token() string {
-	token := atomic.AddUint32(&p.msgToken, 1)
-	return fmt.Sprintf("%x", token)
+type KeysAndCertificateResponse struct {
+	CertificateId             string `json:"certificateId"`
+	CertificatePem            string `json:"certificatePem"`
+	PrivateKey                string `json:"privateKey"`
+	CertificateOwnershipToken string `json:"certificateOwnershipToken"`
 }
 
-type Provisioner struct {
-	thing     device.Thing
-	thingName string
-	// doc       *ThingDocument
-	// onDelta   func(delta map[string]interface{})
-	// onError   func(err error)
-	mu                         sync.Mutex
-	Channels                   Channels
-	KeysAndCertificateResponse struct {
-		CertificateId             string `json:"certificateId"`
-		CertificatePem            string `json:"certificatePem"`
-		PrivateKey                string `json:"privateKey"`
-		CertificateOwnershipToken string `json:"certificateOwnershipToken"`
-	}
-	RegisterThingResponse struct {
-		ThingName           string `json:"thingName"`
-		DeviceConfiguration string `json:"deviceConfiguration"`
-	}
-	Connection connect.Connection
-	chResps    map[string]chan interface{}
-	msgToken   uint32
+type RegisterThingResponse struct {
+	ThingName           string            `json:"thingName"`
+	DeviceConfiguration map[string]string `json:"deviceConfiguration"`
 }
 
-type Channels struct {
-	RegisterKeysChan  chan bool
-	RegisterThingChan chan bool
-	ProvisionChan     chan bool
+// Provisioner provisions a thing with AWS IoT fleet provisioning. It runs
+// through the states connect, create keys, register thing, persist and
+// verify, retrying transient failures with exponential backoff.
+type Provisioner struct {
+	thing                      device.Thing
+	thingName                  string
+	bootstrapKeyPair           connect.KeyPair
+	certificateMode            string
+	codec                      codec.Codec
+	KeysAndCertificateResponse KeysAndCertificateResponse
+	RegisterThingResponse      RegisterThingResponse
+	Connection                 connect.Connection
+	chResp                     chan interface{}
+
+	// RequestTimeout bounds the wait for each response from AWS IoT.
+	RequestTimeout time.Duration
+	// MaxAttempts is how often a state is tried before giving up.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry; it doubles on
+	// every further retry up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// NewConnection creates the connection that verifies the provisioned
+	// certificate. It defaults to connect.New.
+	NewConnection func(*connect.ConnectionConfiguration) (connect.Connection, error)
 }
 
 // New - Function to create a new Provisioner
 func New(tx context.Context, thing device.Thing, bootstrapKeypair connect.KeyPair) (*Provisioner, error) {
+	switch thing.Config.CertificateMode {
+	case "", CertificateModeCreate, CertificateModeCSR:
+	default:
+		return nil, fmt.Errorf("unsupported certificate mode %q", thing.Config.CertificateMode)
+	}
+	if c := thing.Config.ProvisioningCodec; c != nil && c != codec.JSON && c != codec.CBOR {
+		return nil, fmt.Errorf("unsupported provisioning payload format %q", c.Name())
+	}
+
 	conf := connect.ConnectionConfiguration{
 		KeyPair:  bootstrapKeypair,
 		Endpoint: thing.Config.Endpoint,
@@ -110,153 +127,329 @@ func New(tx context.Context, thing device.Thing, bootstrapKeypair connect.KeyPai
 	if err != nil {
 		return nil, fmt.Errorf("Could not create connection %v", err)
 	}
+	if thing.Config.Recording != nil {
+		c = connect.NewRecorder(c, thing.Config.Recording)
+	}
 
-	c.Connect()
-	p := &Provisioner{
-		thing:      thing,
-		thingName:  thing.Config.ThingName,
-		Connection: c,
-		Channels: Channels{
-			RegisterKeysChan:  make(chan bool, 1),
-			RegisterThingChan: make(chan bool, 1),
-		},
+	p := NewWithConnection(thing, c)
+	p.bootstrapKeyPair = bootstrapKeypair
+	p.certificateMode = thing.Config.CertificateMode
+	return p, nil
+}
+
+// NewWithConnection creates a Provisioner that uses an already connected
+// connection, e.g. the primary connection of a provisioned thing renewing
+// its certificate. It always generates the key pair on the device.
+func NewWithConnection(thing device.Thing, c connect.Connection) *Provisioner {
+	payloadCodec := thing.Config.ProvisioningCodec
+	if payloadCodec == nil {
+		payloadCodec = codec.JSON
+	}
+	return &Provisioner{
+		thing:           thing,
+		thingName:       thing.Config.ThingName,
+		certificateMode: CertificateModeCSR,
+		codec:           payloadCodec,
+		Connection:      c,
+		chResp:          make(chan interface{}, 1),
+		RequestTimeout:  defaultRequestTimeout,
+		MaxAttempts:     defaultMaxAttempts,
+		InitialBackoff:  defaultInitialBackoff,
+		MaxBackoff:      defaultMaxBackoff,
+		NewConnection:   connect.New,
+	}
+}
+
+func (p *Provisioner) provisionTopic(suffix string) string {
+	return fmt.Sprintf("$aws/provisioning-templates/%s/provision/%s%s", p.thing.Config.ProvisioningTemplate, p.codec.Name(), suffix)
+}
+
+// topic returns the topic of a certificate request in the payload format
+// of the provisioner.
+func (p *Provisioner) topic(request, suffix string) string {
+	return request + p.codec.Name() + suffix
+}
+
+// Provision runs the provisioning state machine until the thing is
+// provisioned, a state fails permanently or ctx is done. The returned
+// error is a *StateError; rejections from AWS IoT unwrap to *ErrorResponse.
+func (p *Provisioner) Provision(ctx context.Context) error {
+	steps := map[State]func(ctx context.Context) error{
+		StateConnect:       p.connect,
+		StateCreateKeys:    p.createKeys,
+		StateRegisterThing: p.registerThing,
+		StatePersist:       p.persist,
+		StateVerify:        p.verify,
 	}
-	fmt.Printf("Bootstrap Connected to %s\n", thing.Config.Endpoint)
 
-	for _, sub := range []struct {
-		topic   string
-		handler mqtt.MessageHandler
+	for state := StateConnect; state != StateDone; state++ {
+		fmt.Printf("Provisioning: %s\n", state)
+		if err := p.retry(ctx, steps[state]); err != nil {
+			if state != StateConnect && state != StateVerify {
+				p.Disconnect(ctx)
+			}
+			return &StateError{State: state, Err: err}
+		}
+	}
+	fmt.Println("Thing provisioning completed.")
+	return nil
+}
+
+// CreateCertificate obtains a new certificate for a locally generated key
+// and registers it with the provisioning template, without persisting it.
+// The connection must already be connected.
+func (p *Provisioner) CreateCertificate(ctx context.Context) (*keystore.Credentials, error) {
+	if err := p.retry(ctx, p.subscribe); err != nil {
+		return nil, &StateError{State: StateConnect, Err: err}
+	}
+	defer p.unsubscribe()
+
+	for _, step := range []struct {
+		state State
+		fn    func(ctx context.Context) error
 	}{
-		{certAccepted, mqtt.MessageHandler(p.certificateCreateAccepted)},
-		{certRejected, mqtt.MessageHandler(p.certificateCreateRejected)},
-		{fmt.Sprintf("$aws/provisioning-templates/%s/provision/json/accepted", p.thing.Config.ProvisioningTemplate), mqtt.MessageHandler(p.provisioningAccepted)},
-		{fmt.Sprintf("$aws/provisioning-templates/%s/provision/json/rejected", p.thing.Config.ProvisioningTemplate), mqtt.MessageHandler(p.provisioningRejected)},
+		{StateCreateKeys, p.createKeys},
+		{StateRegisterThing, p.registerThing},
 	} {
-		if err := p.Connection.Subscribe(sub.topic, sub.handler); err != nil {
-			return nil, fmt.Errorf("registering message handlers %v", err)
+		if err := p.retry(ctx, step.fn); err != nil {
+			return nil, &StateError{State: step.state, Err: err}
 		}
 	}
+	return &keystore.Credentials{
+		CertificatePEM: []byte(p.KeysAndCertificateResponse.CertificatePem),
+		PrivateKeyPEM:  []byte(p.KeysAndCertificateResponse.PrivateKey),
+	}, nil
+}
 
-	return p, nil
+// retry runs step until it succeeds, fails permanently or runs out of
+// attempts.
+func (p *Provisioner) retry(ctx context.Context, step func(ctx context.Context) error) error {
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := step(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !temporary(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+		fmt.Printf("Attempt %d failed, retrying in %v: %v\n", attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
 }
 
-func (p *Provisioner) certificateCreateAccepted(client mqtt.Client, msg mqtt.Message) {
-	fmt.Printf("* [%s] %s\n", msg.Topic(), string(msg.Payload()))
-	json.Unmarshal(msg.Payload(), &p.KeysAndCertificateResponse)
-	p.Channels.RegisterKeysChan <- true
+func (p *Provisioner) connect(ctx context.Context) error {
+	if err := p.Connection.Connect(); err != nil {
+		return &transientError{fmt.Errorf("connecting to %s %v", p.thing.Config.Endpoint, err)}
+	}
+	fmt.Printf("Bootstrap Connected to %s\n", p.thing.Config.Endpoint)
+	return p.subscribe(ctx)
 }
 
-func (p *Provisioner) certificateCreateRejected(client mqtt.Client, msg mqtt.Message) {
-	fmt.Printf("* [%s] %s\n", msg.Topic(), string(msg.Payload()))
-	p.Channels.RegisterKeysChan <- false
+func (p *Provisioner) subscriptions() []connect.Subscription {
+	return []connect.Subscription{
+		{Topic: p.topic(certCreate, "/accepted"), QoS: 1, Handler: p.certificateCreateAccepted},
+		{Topic: p.topic(certCreate, "/rejected"), QoS: 1, Handler: p.rejected},
+		{Topic: p.topic(csrCreate, "/accepted"), QoS: 1, Handler: p.certificateCreateAccepted},
+		{Topic: p.topic(csrCreate, "/rejected"), QoS: 1, Handler: p.rejected},
+		{Topic: p.provisionTopic("/accepted"), QoS: 1, Handler: p.provisioningAccepted},
+		{Topic: p.provisionTopic("/rejected"), QoS: 1, Handler: p.rejected},
+	}
 }
 
-func (p *Provisioner) provisioningAccepted(client mqtt.Client, msg mqtt.Message) {
-	fmt.Printf("* [%s] %s\n", msg.Topic(), string(msg.Payload()))
-	json.Unmarshal(msg.Payload(), &p.RegisterThingResponse)
-	certFileName := fmt.Sprintf("certs/%s.certificate.pem", p.thing.Config.ThingName)
-	keyFileName := fmt.Sprintf("certs/%s.private.key", p.thing.Config.ThingName)
+func (p *Provisioner) subscribe(ctx context.Context) error {
+	if err := p.Connection.SubscribeMultiple(p.subscriptions()); err != nil {
+		return &transientError{fmt.Errorf("registering message handlers %v", err)}
+	}
+	return nil
+}
 
-	if &p.RegisterThingResponse != nil {
-		// save the keys if need to otherwise start connecting and sending data
-		f, err := os.Create(fmt.Sprintf("%s", certFileName))
+func (p *Provisioner) unsubscribe() {
+	var topics []string
+	for _, sub := range p.subscriptions() {
+		topics = append(topics, sub.Topic)
+	}
+	if err := p.Connection.Unsubscribe(topics...); err != nil {
+		fmt.Printf("removing message handlers %v\n", err)
+	}
+}
 
+func (p *Provisioner) createKeys(ctx context.Context) error {
+	topic := p.topic(certCreate, "")
+	payload := []byte{}
+	privateKey := ""
+	if p.certificateMode == CertificateModeCSR {
+		fmt.Println("Creating certificate from a locally generated key in AWS IoT")
+		key, keyPEM, err := generateKey(p.thing.Config.KeyAlgorithm)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-
-		defer f.Close()
-
-		_, err2 := f.WriteString(p.KeysAndCertificateResponse.CertificatePem)
-
-		if err2 != nil {
-			log.Fatal(err2)
+		csr, err := createCSR(key, p.thing.Config.ThingName)
+		if err != nil {
+			return err
 		}
-		viper.Set("primary.certificatepath", fmt.Sprintf("%s", certFileName))
-
-		f, err = os.Create(fmt.Sprintf("%s", keyFileName))
-
+		payload, err = p.codec.Marshal(&createFromCSRRequest{CertificateSigningRequest: string(csr)})
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("marshaling request %v", err)
 		}
+		topic = p.topic(csrCreate, "")
+		privateKey = string(keyPEM)
+	} else {
+		fmt.Println("Creating keys and certificates in AWS IoT")
+	}
 
-		defer f.Close()
+	res, err := p.request(ctx, topic, payload)
+	if err != nil {
+		return err
+	}
+	r, ok := res.(*KeysAndCertificateResponse)
+	if !ok {
+		return fmt.Errorf("creating keys %v", ErrInvalidResponse)
+	}
+	if privateKey != "" {
+		// The private key was generated locally and never sent.
+		r.PrivateKey = privateKey
+	}
+	p.KeysAndCertificateResponse = *r
+	fmt.Printf("Created certificate %s\n", r.CertificateId)
+	return nil
+}
 
-		_, err2 = f.WriteString(p.KeysAndCertificateResponse.PrivateKey)
+func (p *Provisioner) registerThing(ctx context.Context) error {
+	fmt.Println("Creating thing in AWS IoT")
+	payload, err := p.codec.Marshal(NewRegisterThingRequest(p))
+	if err != nil {
+		return fmt.Errorf("marshaling request %v", err)
+	}
+	res, err := p.request(ctx, p.provisionTopic(""), payload)
+	if err != nil {
+		return err
+	}
+	r, ok := res.(*RegisterThingResponse)
+	if !ok {
+		return fmt.Errorf("registering thing %v", ErrInvalidResponse)
+	}
+	p.RegisterThingResponse = *r
+	if r.ThingName != "" && r.ThingName != p.thingName {
+		fmt.Printf("Registered as %s instead of %s\n", r.ThingName, p.thingName)
+	}
+	return nil
+}
 
-		if err2 != nil {
-			log.Fatal(err2)
-		}
-		viper.Set("primary.privatekeypath", fmt.Sprintf("%s", keyFileName))
-		viper.WriteConfig()
-		fmt.Printf("wrote files: cert_file_name: %v key_file_name: %v\n", certFileName, keyFileName)
+func (p *Provisioner) persist(ctx context.Context) error {
+	if err := p.thing.Config.Keystore.Store(p.thingName, &keystore.Credentials{
+		CertificatePEM: []byte(p.KeysAndCertificateResponse.CertificatePem),
+		PrivateKeyPEM:  []byte(p.KeysAndCertificateResponse.PrivateKey),
+	}); err != nil {
+		return fmt.Errorf("storing credentials %v", err)
 	}
-	fmt.Printf("Writing to provision complete channel")
-	p.Channels.RegisterThingChan <- true
+	fmt.Printf("Stored credentials of %s\n", p.thingName)
+	return nil
 }
 
-func (p *Provisioner) provisioningRejected(client mqtt.Client, msg mqtt.Message) {
-	fmt.Printf("* [%s] %s\n", msg.Topic(), string(msg.Payload()))
-	p.Channels.RegisterThingChan <- false
+// verify connects with the new certificate. The bootstrap connection is
+// closed first since both use the same client id.
+func (p *Provisioner) verify(ctx context.Context) error {
+	p.Disconnect(ctx)
+
+	kp, err := p.thing.KeyPair(p.bootstrapKeyPair.CACertificatePath)
+	if err != nil {
+		return err
+	}
+	c, err := p.NewConnection(&connect.ConnectionConfiguration{
+		KeyPair:  kp,
+		Endpoint: p.thing.Config.Endpoint,
+		Port:     p.thing.Config.Port,
+		ClientId: p.thing.Config.ThingName,
+	})
+	if err != nil {
+		return fmt.Errorf("loading provisioned certificate %v", err)
+	}
+	if err := c.Connect(); err != nil {
+		return &transientError{fmt.Errorf("connecting with provisioned certificate %v", err)}
+	}
+	c.Disconnect(250)
+	return nil
 }
 
-func (p *Provisioner) Provision(ctx context.Context) {
-	go func() {
-		fmt.Println("Creating keys and certificates in AWS IoT")
-		if token := p.Connection.Publish(certCreate, []byte{}); token.Error() != nil {
-			fmt.Errorf("registering message handlers %v", token.Error())
-		}
-	}()
-	fmt.Println("Waiting for certificate provisioning.")
-	go p.RegisterThing(ctx)
+// request publishes payload to topic and waits for the accepted or
+// rejected response. Fleet provisioning has no client tokens, so only one
+// request is in flight at a time.
+func (p *Provisioner) request(ctx context.Context, topic string, payload []byte) (interface{}, error) {
+	// Drop a late response to an earlier attempt.
+	select {
+	case <-p.chResp:
+	default:
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			fmt.Errorf("updating reported state %v", ctx.Err())
-		case accepted := <-p.Channels.RegisterThingChan:
-			if accepted {
-				fmt.Println("Thing provisioning completed.")
-				p.Disconnect(ctx)
-			} else {
-				fmt.Println("Thing provisioning failed.")
-			}
-			return
+	if token := p.Connection.Publish(topic, payload); token.Wait() && token.Error() != nil {
+		return nil, &transientError{fmt.Errorf("sending request %v", token.Error())}
+	}
+
+	timer := time.NewTimer(p.RequestTimeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, ErrTimeout
+	case res := <-p.chResp:
+		if e, ok := res.(*ErrorResponse); ok {
+			return nil, e
 		}
+		return res, nil
 	}
 }
 
-func (p *Provisioner) Disconnect(ctx context.Context) {
-	p.Connection.Disconnect(3)
+func (p *Provisioner) handleResponse(r interface{}) {
+	select {
+	case p.chResp <- r:
+	default:
+	}
 }
 
-func (p *Provisioner) PublishThingRequest() {
-	payload, _ := json.Marshal(NewRegisterThingRequest(p))
-	topic := fmt.Sprintf("$aws/provisioning-templates/%s/provision/json", p.thing.Config.ProvisioningTemplate)
-	fmt.Printf("* [%s] %s\n", topic, string(payload))
-	if token := p.Connection.Publish(topic, payload); token.Error() != nil {
-		fmt.Errorf("publish thing request %v", token.Error())
+func (p *Provisioner) certificateCreateAccepted(client mqtt.Client, msg mqtt.Message) {
+	r := &KeysAndCertificateResponse{}
+	if err := p.codec.Unmarshal(msg.Payload(), r); err != nil {
+		fmt.Printf("unmarshaling certificate response %v\n", err)
+		return
 	}
+	// The payload may hold the private key, never log it.
+	fmt.Printf("* [%s] certificateId: %s\n", msg.Topic(), r.CertificateId)
+	p.handleResponse(r)
 }
 
-func (p *Provisioner) RegisterThing(ctx context.Context) {
-registerThing:
-	for {
-		select {
-		case <-ctx.Done():
-			fmt.Errorf("updating reported state %v", ctx.Err())
-			break registerThing
-		case accepted := <-p.Channels.RegisterKeysChan:
-			if accepted {
-				fmt.Println("Creating thing in AWS IoT")
-				p.PublishThingRequest()
-			} else {
-				fmt.Println("Create Keys and Certificates rejected")
-				p.Channels.ProvisionChan <- false
-			}
-			fmt.Println("Returned from register keys channel")
-			break registerThing
-		}
+func (p *Provisioner) provisioningAccepted(client mqtt.Client, msg mqtt.Message) {
+	r := &RegisterThingResponse{}
+	if err := p.codec.Unmarshal(msg.Payload(), r); err != nil {
+		fmt.Printf("unmarshaling register thing response %v\n", err)
+		return
 	}
-	fmt.Println("returning from register thing")
+	fmt.Printf("* [%s] %+v\n", msg.Topic(), *r)
+	p.handleResponse(r)
+}
+
+func (p *Provisioner) rejected(client mqtt.Client, msg mqtt.Message) {
+	e := &ErrorResponse{}
+	if err := p.codec.Unmarshal(msg.Payload(), e); err != nil {
+		fmt.Printf("unmarshaling error response %v\n", err)
+		return
+	}
+	fmt.Printf("* [%s] %v\n", msg.Topic(), e)
+	p.handleResponse(e)
+}
+
+func (p *Provisioner) Disconnect(ctx context.Context) {
+	p.Connection.Disconnect(250)
 }
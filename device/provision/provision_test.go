@@ -0,0 +1,162 @@
+package provision_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/codec"
+	"github.com/randyridgley/simple-go-iot-device/device/connect/connecttest"
+	"github.com/randyridgley/simple-go-iot-device/device/iottest"
+	"github.com/randyridgley/simple-go-iot-device/device/keystore"
+	"github.com/randyridgley/simple-go-iot-device/device/provision"
+)
+
+const (
+	thingName = "thing-1"
+	template  = "FleetTemplate"
+
+	csrTopic      = "$aws/certificates/create-from-csr/json"
+	registerTopic = "$aws/provisioning-templates/" + template + "/provision/json"
+)
+
+type fixture struct {
+	broker *connecttest.Broker
+	emu    *iottest.Emulator
+	ks     keystore.Keystore
+	p      *provision.Provisioner
+}
+
+// newFixture creates a provisioner of a thing that talks to an emulated
+// AWS IoT.
+func newFixture(t *testing.T, payloadCodec codec.Codec) *fixture {
+	t.Helper()
+	ks, err := keystore.NewFileKeystore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	thing, emu := iottest.NewThing(t, device.ThingConfiguration{
+		ThingName:            thingName,
+		SerialNumber:         "123",
+		ProvisioningTemplate: template,
+		ProvisioningCodec:    payloadCodec,
+		Keystore:             ks,
+	})
+	broker := emu.Broker()
+	p := provision.NewWithConnection(thing, thing.Connection)
+	p.NewConnection = broker.NewConnection
+	p.RequestTimeout = time.Second
+	p.InitialBackoff = time.Millisecond
+	p.MaxBackoff = time.Millisecond
+	return &fixture{broker: broker, emu: emu, ks: ks, p: p}
+}
+
+// requests returns the number of requests the device published on topic.
+func (f *fixture) requests(topic string) int {
+	return len(f.broker.Messages(topic))
+}
+
+func TestProvision(t *testing.T) {
+	for _, c := range []codec.Codec{codec.JSON, codec.CBOR} {
+		t.Run(c.Name(), func(t *testing.T) {
+			f := newFixture(t, c)
+			if err := f.p.Provision(iottest.Context(t)); err != nil {
+				t.Fatal(err)
+			}
+
+			registered, ok := f.emu.Thing("thing_123")
+			if !ok {
+				t.Fatal("thing was not registered")
+			}
+			if registered.Template != template || registered.Parameters["serialNumber"] != "123" {
+				t.Errorf("registered %+v", registered)
+			}
+			if f.p.RegisterThingResponse.ThingName != "thing_123" {
+				t.Errorf("RegisterThingResponse %+v", f.p.RegisterThingResponse)
+			}
+
+			creds, err := f.ks.Load(thingName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tls.X509KeyPair(creds.CertificatePEM, creds.PrivateKeyPEM); err != nil {
+				t.Errorf("stored credentials %v", err)
+			}
+			certs := f.emu.Certificates()
+			if len(certs) != 1 || certs[0].ID != registered.CertificateID || certs[0].PEM != string(creds.CertificatePEM) {
+				t.Errorf("issued %+v, registered %s", certs, registered.CertificateID)
+			}
+		})
+	}
+}
+
+func TestProvisionRetriesTransientRejections(t *testing.T) {
+	f := newFixture(t, nil)
+	f.emu.Script(csrTopic, 1, iottest.RejectProvisioning(500, "InternalFailure", "Internal failure"))
+	f.emu.Script(registerTopic, 2, iottest.RejectProvisioning(429, "Throttling", "Rate exceeded"))
+
+	if err := f.p.Provision(iottest.Context(t)); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.requests(csrTopic); n != 2 {
+		t.Errorf("%d create requests, want 2", n)
+	}
+	if n := f.requests(registerTopic); n != 3 {
+		t.Errorf("%d register requests, want 3", n)
+	}
+	if _, ok := f.emu.Thing("thing_123"); !ok {
+		t.Error("thing was not registered")
+	}
+}
+
+func TestProvisionRetriesLostResponses(t *testing.T) {
+	f := newFixture(t, nil)
+	f.p.RequestTimeout = 50 * time.Millisecond
+	f.emu.Script(registerTopic, 1, iottest.Drop())
+
+	if err := f.p.Provision(iottest.Context(t)); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.requests(registerTopic); n != 2 {
+		t.Errorf("%d register requests, want 2", n)
+	}
+}
+
+func TestProvisionRejected(t *testing.T) {
+	f := newFixture(t, nil)
+	f.emu.Script(registerTopic, 0, iottest.RejectProvisioning(400, "InvalidParameters", "Missing serialNumber"))
+
+	err := f.p.Provision(iottest.Context(t))
+	var stateErr *provision.StateError
+	if !errors.As(err, &stateErr) || stateErr.State != provision.StateRegisterThing {
+		t.Fatalf("Provision() = %v, want a failure to register the thing", err)
+	}
+	var rejected *provision.ErrorResponse
+	if !errors.As(err, &rejected) || rejected.StatusCode != 400 || rejected.ErrorCode != "InvalidParameters" {
+		t.Errorf("Provision() = %v, want the rejection", err)
+	}
+	// Permanent rejections are not retried.
+	if n := f.requests(registerTopic); n != 1 {
+		t.Errorf("%d register requests, want 1", n)
+	}
+	if f.ks.Exists(thingName) {
+		t.Error("credentials were stored")
+	}
+}
+
+func TestProvisionGivesUp(t *testing.T) {
+	f := newFixture(t, nil)
+	f.p.MaxAttempts = 3
+	f.emu.Script(csrTopic, 0, iottest.RejectProvisioning(503, "ServiceUnavailable", "Service unavailable"))
+
+	err := f.p.Provision(iottest.Context(t))
+	var stateErr *provision.StateError
+	if !errors.As(err, &stateErr) || stateErr.State != provision.StateCreateKeys {
+		t.Fatalf("Provision() = %v, want a failure to create keys", err)
+	}
+	if n := f.requests(csrTopic); n != 3 {
+		t.Errorf("%d create requests, want 3", n)
+	}
+}
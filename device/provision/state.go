@@ -0,0 +1,92 @@
+package provision
+
+import (
+	"errors"
+	"fmt"
+)
+
+// State is a step of the provisioning state machine.
+type State int
+
+// Provisioning states in the order they are run.
+const (
+	StateConnect State = iota
+	StateCreateKeys
+	StateRegisterThing
+	StatePersist
+	StateVerify
+	StateDone
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnect:
+		return "connect"
+	case StateCreateKeys:
+		return "create keys"
+	case StateRegisterThing:
+		return "register thing"
+	case StatePersist:
+		return "persist"
+	case StateVerify:
+		return "verify"
+	case StateDone:
+		return "done"
+	default:
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+}
+
+// ErrTimeout is returned if AWS IoT did not answer a request in time.
+var ErrTimeout = errors.New("timed out waiting for response from AWS IoT")
+
+// StateError is returned by Provision and records the state that failed.
+type StateError struct {
+	State State
+	Err   error
+}
+
+// Error implements error interface.
+func (e *StateError) Error() string {
+	return fmt.Sprintf("provisioning failed in %s: %v", e.State, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *StateError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorResponse represents error response from AWS IoT fleet provisioning.
+type ErrorResponse struct {
+	StatusCode   int    `json:"statusCode"`
+	ErrorCode    string `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+// Error implements error interface.
+func (e *ErrorResponse) Error() string {
+	return fmt.Sprintf("%d (%s): %s", e.StatusCode, e.ErrorCode, e.ErrorMessage)
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *ErrorResponse) Temporary() bool {
+	return e.StatusCode == 429 || e.StatusCode >= 500
+}
+
+// transientError marks failures that are worth retrying.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string   { return e.err.Error() }
+func (e *transientError) Unwrap() error   { return e.err }
+func (e *transientError) Temporary() bool { return true }
+
+// temporary reports whether err is worth retrying.
+func temporary(err error) bool {
+	if errors.Is(err, ErrTimeout) {
+		return true
+	}
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
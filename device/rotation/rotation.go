@@ -0,0 +1,254 @@
+/*
+Copyright © 2020 Randy Ridgley randy.ridgley@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rotation
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+	"github.com/randyridgley/simple-go-iot-device/device/jobs"
+	"github.com/randyridgley/simple-go-iot-device/device/keystore"
+	"github.com/randyridgley/simple-go-iot-device/device/provision"
+)
+
+// Operation is the job operation that forces a certificate rotation.
+const Operation = "rotate-certificate"
+
+const (
+	defaultRenewBefore   = 30 * 24 * time.Hour
+	defaultCheckInterval = 12 * time.Hour
+)
+
+// Configuration configures certificate rotation.
+type Configuration struct {
+	// RenewBefore is how long before NotAfter a certificate is renewed.
+	RenewBefore time.Duration
+	// CheckInterval is how often the certificate expiry is inspected.
+	CheckInterval time.Duration
+	// CACertificatePath is the CA bundle of the AWS IoT endpoint.
+	CACertificatePath string
+	// RetireRule is the AWS IoT rule that is asked through Basic Ingest to
+	// deactivate the replaced certificate. Replaced certificates stay
+	// active if it is empty.
+	RetireRule string
+}
+
+// Rotator renews the primary certificate of a thing before it expires.
+type Rotator struct {
+	thing  device.Thing
+	config Configuration
+	mu     sync.Mutex
+}
+
+// New creates a Rotator for thing, whose Connection must be connected with
+// the primary certificate.
+func New(thing device.Thing, config Configuration) *Rotator {
+	if config.RenewBefore == 0 {
+		config.RenewBefore = defaultRenewBefore
+	}
+	if config.CheckInterval == 0 {
+		config.CheckInterval = defaultCheckInterval
+	}
+	return &Rotator{
+		thing:  thing,
+		config: config,
+	}
+}
+
+// Expiry returns the NotAfter of the stored primary certificate.
+func (r *Rotator) Expiry() (time.Time, error) {
+	c, err := r.thing.Config.Keystore.Load(r.thing.Config.ThingName)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("loading certificate %v", err)
+	}
+	cert, err := parseCertificate(c.CertificatePEM)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("certificate of %s %v", r.thing.Config.ThingName, err)
+	}
+	return cert.NotAfter, nil
+}
+
+func parseCertificate(certificatePEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certificatePEM)
+	if block == nil {
+		return nil, fmt.Errorf("is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("is not a valid X.509 certificate %v", err)
+	}
+	return cert, nil
+}
+
+// Run checks the certificate expiry at the configured interval and rotates
+// the certificate once it is due, until ctx is cancelled. A certificate that
+// cannot be read is checked again at the next interval.
+func (r *Rotator) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		notAfter, err := r.Expiry()
+		if err != nil {
+			// The keystore may be replaced or repaired in the meantime.
+			fmt.Printf("checking certificate expiry %v\n", err)
+		} else if time.Until(notAfter) < r.config.RenewBefore {
+			fmt.Printf("Certificate expires at %v, rotating\n", notAfter)
+			if err := r.Rotate(ctx); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				// Keep the current certificate and try again later.
+				fmt.Printf("rotating certificate %v\n", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Rotate obtains a new certificate through the provisioning topics,
+// stores it in the keystore and verifies it by reconnecting with it. The
+// current certificate is backed up under BackupName until the new one
+// connected, so a restart in between finds a usable certificate either way.
+// If the new certificate does not connect, the connection and the keystore
+// fall back to the current one.
+func (r *Rotator) Rotate(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ks, name := r.thing.Config.Keystore, r.thing.Config.ThingName
+	current, err := r.thing.KeyPair(r.config.CACertificatePath)
+	if err != nil {
+		return err
+	}
+	previous := &keystore.Credentials{CertificatePEM: current.CertificatePEM, PrivateKeyPEM: current.PrivateKeyPEM}
+
+	p := provision.NewWithConnection(r.thing, r.thing.Connection)
+	creds, err := p.CreateCertificate(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created certificate %s\n", p.KeysAndCertificateResponse.CertificateId)
+
+	if err := ks.Store(BackupName(name), previous); err != nil {
+		return fmt.Errorf("backing up certificate %v", err)
+	}
+	if err := ks.Store(name, creds); err != nil {
+		return fmt.Errorf("storing new certificate %v", err)
+	}
+
+	next := current
+	next.CertificatePEM = creds.CertificatePEM
+	next.PrivateKeyPEM = creds.PrivateKeyPEM
+	if err := r.thing.Connection.UpdateKeyPair(next); err != nil {
+		if rerr := r.thing.Connection.UpdateKeyPair(current); rerr != nil {
+			fmt.Printf("restoring previous certificate %v\n", rerr)
+		}
+		if serr := ks.Store(name, previous); serr != nil {
+			fmt.Printf("restoring previous certificate in the keystore %v\n", serr)
+		} else if derr := ks.Delete(BackupName(name)); derr != nil {
+			fmt.Printf("removing certificate backup %v\n", derr)
+		}
+		return fmt.Errorf("connecting with new certificate %v", err)
+	}
+
+	if err := ks.Delete(BackupName(name)); err != nil {
+		fmt.Printf("removing certificate backup %v\n", err)
+	}
+	fmt.Println("Certificate rotated")
+	r.retire(previous.CertificatePEM, p.KeysAndCertificateResponse.CertificateId)
+	return nil
+}
+
+// RetireRequest is sent to the RetireRule once a certificate was replaced.
+type RetireRequest struct {
+	ThingName string `json:"thingName"`
+	// CertificateID is the ID of the replaced certificate to deactivate.
+	CertificateID string `json:"certificateId"`
+	// NewCertificateID is the ID of the certificate that replaced it.
+	NewCertificateID string `json:"newCertificateId"`
+}
+
+// RetireTopic is the topic of the retire requests of thingName, below the
+// Basic Ingest prefix of the RetireRule.
+func RetireTopic(thingName string) string {
+	return "things/" + thingName + "/certificate/retire"
+}
+
+// retire asks the RetireRule to deactivate the replaced certificate. The
+// request is queued if the connection is down.
+func (r *Rotator) retire(certificatePEM []byte, newCertificateID string) {
+	cert, err := parseCertificate(certificatePEM)
+	if err != nil {
+		fmt.Printf("replaced certificate %v\n", err)
+		return
+	}
+	sum := sha256.Sum256(cert.Raw)
+	id := hex.EncodeToString(sum[:])
+	if r.config.RetireRule == "" {
+		fmt.Printf("Certificate %s stays active, no retire rule is configured\n", id)
+		return
+	}
+	payload, err := json.Marshal(&RetireRequest{
+		ThingName:        r.thing.Config.ThingName,
+		CertificateID:    id,
+		NewCertificateID: newCertificateID,
+	})
+	if err != nil {
+		fmt.Printf("marshaling retire request %v\n", err)
+		return
+	}
+	token := r.thing.Connection.Publish(RetireTopic(r.thing.Config.ThingName), payload,
+		connect.WithBasicIngest(r.config.RetireRule), connect.WithQoS(1), connect.WithQueue())
+	if token.Wait() && token.Error() != nil {
+		fmt.Printf("requesting to retire certificate %s %v\n", id, token.Error())
+		return
+	}
+	fmt.Printf("Requested to retire certificate %s\n", id)
+}
+
+// BackupName is the keystore name of the certificate of thingName that is
+// kept while a rotation is in progress.
+func BackupName(thingName string) string {
+	return thingName + ".previous"
+}
+
+// Handle rotates the certificate on request. It implements jobs.Handler
+// and is registered for Operation.
+func (r *Rotator) Handle(ctx context.Context, job *jobs.JobExecution, progress jobs.Progress) (map[string]string, error) {
+	if err := r.Rotate(ctx); err != nil {
+		return nil, err
+	}
+	notAfter, err := r.Expiry()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"notAfter": notAfter.UTC().Format(time.RFC3339)}, nil
+}
@@ -0,0 +1,255 @@
+package rotation_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/connect/connecttest"
+	"github.com/randyridgley/simple-go-iot-device/device/iottest"
+	"github.com/randyridgley/simple-go-iot-device/device/keystore"
+	"github.com/randyridgley/simple-go-iot-device/device/rotation"
+)
+
+const (
+	thingName   = "thing-1"
+	retireRule  = "RetireCertificate"
+	retireTopic = "$aws/rules/" + retireRule + "/things/" + thingName + "/certificate/retire"
+)
+
+type fixture struct {
+	broker  *connecttest.Broker
+	emu     *iottest.Emulator
+	conn    *connecttest.Connection
+	ks      keystore.Keystore
+	thing   device.Thing
+	current *keystore.Credentials
+	// currentID is the certificate ID of current.
+	currentID string
+}
+
+// newFixture connects a thing whose certificate expires in a day to an
+// emulated AWS IoT.
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	ks, err := keystore.NewFileKeystore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, id := selfSigned(t, 24*time.Hour)
+	if err := ks.Store(thingName, current); err != nil {
+		t.Fatal(err)
+	}
+	thing, emu := iottest.NewThing(t, device.ThingConfiguration{
+		ThingName:            thingName,
+		SerialNumber:         "123",
+		ProvisioningTemplate: "FleetTemplate",
+		Keystore:             ks,
+	})
+	return &fixture{
+		broker:    emu.Broker(),
+		emu:       emu,
+		conn:      thing.Connection.(*connecttest.Connection),
+		ks:        ks,
+		current:   current,
+		thing:     thing,
+		currentID: id,
+	}
+}
+
+// selfSigned returns credentials that expire after validity and the ID
+// AWS IoT gives their certificate.
+func selfSigned(t *testing.T, validity time.Duration) (*keystore.Credentials, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: thingName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validity),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(der)
+	return &keystore.Credentials{
+		CertificatePEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		PrivateKeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, hex.EncodeToString(sum[:])
+}
+
+func (f *fixture) rotator() *rotation.Rotator {
+	return rotation.New(f.thing, rotation.Configuration{
+		RetireRule:    retireRule,
+		CheckInterval: 10 * time.Millisecond,
+	})
+}
+
+// stored returns the certificate in the keystore.
+func (f *fixture) stored(t *testing.T) []byte {
+	t.Helper()
+	creds, err := f.ks.Load(thingName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creds.CertificatePEM
+}
+
+// expectCurrent checks that the thing still uses its current certificate
+// and did not ask to retire it.
+func (f *fixture) expectCurrent(t *testing.T) {
+	t.Helper()
+	if !bytes.Equal(f.stored(t), f.current.CertificatePEM) {
+		t.Error("keystore does not hold the current certificate")
+	}
+	if f.ks.Exists(rotation.BackupName(thingName)) {
+		t.Error("backup of the current certificate was left behind")
+	}
+	if n := len(f.broker.Messages(retireTopic)); n != 0 {
+		t.Errorf("%d retire requests, want none", n)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	f := newFixture(t)
+	if err := f.rotator().Rotate(iottest.Context(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	certs := f.emu.Certificates()
+	if len(certs) != 1 {
+		t.Fatalf("issued %d certificates, want 1", len(certs))
+	}
+	issued := certs[0]
+	if registered, ok := f.emu.Thing("thing_123"); !ok || registered.CertificateID != issued.ID {
+		t.Errorf("registered %+v, issued %s", registered, issued.ID)
+	}
+	if string(f.stored(t)) != issued.PEM {
+		t.Error("keystore does not hold the new certificate")
+	}
+	if f.ks.Exists(rotation.BackupName(thingName)) {
+		t.Error("backup of the replaced certificate was not removed")
+	}
+	if kps := f.conn.KeyPairs(); len(kps) != 1 || string(kps[0].CertificatePEM) != issued.PEM {
+		t.Errorf("connection switched to %d key pairs", len(kps))
+	}
+
+	msgs := f.broker.Messages(retireTopic)
+	if len(msgs) != 1 {
+		t.Fatalf("%d retire requests, want 1", len(msgs))
+	}
+	var req rotation.RetireRequest
+	if err := json.Unmarshal(msgs[0].Payload(), &req); err != nil {
+		t.Fatal(err)
+	}
+	want := rotation.RetireRequest{ThingName: thingName, CertificateID: f.currentID, NewCertificateID: issued.ID}
+	if req != want {
+		t.Errorf("retire request %+v, want %+v", req, want)
+	}
+}
+
+func TestRotateFallsBack(t *testing.T) {
+	f := newFixture(t)
+	f.conn.FailUpdateKeyPair(errors.New("certificate rejected"))
+
+	if err := f.rotator().Rotate(iottest.Context(t)); err == nil {
+		t.Fatal("Rotate() with a rejected certificate succeeded")
+	}
+	kps := f.conn.KeyPairs()
+	if len(kps) != 2 || !bytes.Equal(kps[1].CertificatePEM, f.current.CertificatePEM) {
+		t.Errorf("connection did not fall back to the current certificate")
+	}
+	f.expectCurrent(t)
+}
+
+// failingKeystore fails to store credentials under name.
+type failingKeystore struct {
+	keystore.Keystore
+	name string
+}
+
+func (k *failingKeystore) Store(name string, c *keystore.Credentials) error {
+	if name == k.name {
+		return errors.New("disk full")
+	}
+	return k.Keystore.Store(name, c)
+}
+
+func TestRotateStoreFails(t *testing.T) {
+	f := newFixture(t)
+	f.thing.Config.Keystore = &failingKeystore{Keystore: f.ks, name: thingName}
+
+	if err := f.rotator().Rotate(iottest.Context(t)); err == nil {
+		t.Fatal("Rotate() without storing the certificate succeeded")
+	}
+	// The connection keeps the certificate the keystore holds.
+	if n := len(f.conn.KeyPairs()); n != 0 {
+		t.Errorf("connection switched %d times", n)
+	}
+	if !bytes.Equal(f.stored(t), f.current.CertificatePEM) {
+		t.Error("keystore does not hold the current certificate")
+	}
+	if n := len(f.broker.Messages(retireTopic)); n != 0 {
+		t.Errorf("%d retire requests, want none", n)
+	}
+}
+
+func TestRunKeepsChecking(t *testing.T) {
+	f := newFixture(t)
+	if err := f.ks.Delete(thingName); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(iottest.Context(t))
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- f.rotator().Run(ctx) }()
+
+	// Run does not give up while the certificate cannot be read.
+	select {
+	case err := <-done:
+		t.Fatalf("Run() without a certificate = %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := f.ks.Store(thingName, f.current); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for len(f.broker.Messages(retireTopic)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate was not rotated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run() did not return")
+	}
+}
@@ -0,0 +1,104 @@
+package shadow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/randyridgley/simple-go-iot-device/device"
+)
+
+// ErrInvalidName is returned if a shadow name is not accepted by AWS IoT.
+var ErrInvalidName = errors.New("invalid shadow name")
+
+// ErrNotOpen is returned when closing a named shadow that is not open.
+var ErrNotOpen = errors.New("shadow is not open")
+
+var shadowNamePattern = regexp.MustCompile(`^[a-zA-Z0-9:_-]{1,64}$`)
+
+// Manager is an interface of the named shadows of a thing. Every named
+// shadow has its own document, client tokens and handlers.
+type Manager interface {
+	// Open subscribes to the topics of the named shadow and returns it.
+	// Opening a shadow that is already open returns the existing one.
+	Open(ctx context.Context, name string) (Shadow, error)
+	// Close unsubscribes from the topics of the named shadow.
+	Close(name string) error
+	// Shadow returns the named shadow if it is open.
+	Shadow(name string) (Shadow, bool)
+	// Names returns the names of the open shadows.
+	Names() []string
+}
+
+type manager struct {
+	thing   device.Thing
+	mu      sync.Mutex
+	shadows map[string]*shadow
+}
+
+// NewManager creates a Manager for the named shadows of thing.
+func NewManager(thing device.Thing) Manager {
+	return &manager{
+		thing:   thing,
+		shadows: make(map[string]*shadow),
+	}
+}
+
+func (m *manager) Open(ctx context.Context, name string) (Shadow, error) {
+	if !shadowNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("opening shadow %q %v", name, ErrInvalidName)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.shadows[name]; ok {
+		return s, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("opening shadow %q %v", name, err)
+	}
+
+	s := newShadow(m.thing, name)
+	if err := s.subscribe(); err != nil {
+		// Drop whatever was subscribed before the failure.
+		s.unsubscribe()
+		return nil, fmt.Errorf("opening shadow %q %v", name, err)
+	}
+	m.shadows[name] = s
+	return s, nil
+}
+
+func (m *manager) Close(name string) error {
+	m.mu.Lock()
+	s, ok := m.shadows[name]
+	delete(m.shadows, name)
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("closing shadow %q %v", name, ErrNotOpen)
+	}
+	return s.unsubscribe()
+}
+
+func (m *manager) Shadow(name string) (Shadow, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.shadows[name]
+	if !ok {
+		return nil, false
+	}
+	return s, true
+}
+
+func (m *manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.shadows))
+	for name := range m.shadows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -22,9 +22,13 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/codec"
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+	"github.com/randyridgley/simple-go-iot-device/device/internal/clienttoken"
 )
 
 // Shadow is an interface of Thing Shadow.
@@ -47,18 +51,27 @@ type Shadow interface {
 
 var ErrRejected = errors.New("rejected")
 
+// refreshTimeout bounds the get request sent after a reconnect.
+const refreshTimeout = 30 * time.Second
+
 // ErrInvalidResponse is returned if failed to parse response from AWS IoT.
 var ErrInvalidResponse = errors.New("invalid response from AWS IoT")
 
+// payloadCodec encodes requests and responses. AWS IoT serves the Device Shadow
+// API in JSON only.
+var payloadCodec = codec.JSON
+
 type shadow struct {
 	thing     device.Thing
 	thingName string
+	name      string
 	doc       *ThingDocument
 	onDelta   func(delta map[string]interface{})
 	onError   func(err error)
 	mu        sync.Mutex
 	chResps   map[string]chan interface{}
 	msgToken  uint32
+	unwatch   func()
 }
 
 func (s *shadow) token() string {
@@ -67,54 +80,83 @@ func (s *shadow) token() string {
 }
 
 func (s *shadow) topic(operation string) string {
+	if s.name != "" {
+		return "$aws/things/" + s.thingName + "/shadow/name/" + s.name + "/" + operation
+	}
 	return "$aws/things/" + s.thingName + "/shadow/" + operation
 }
 
+// New creates the classic (unnamed) shadow of the thing.
 func New(ctx context.Context, thing device.Thing) (Shadow, error) {
-	s := &shadow{
+	s := newShadow(thing, "")
+	if err := s.subscribe(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newShadow(thing device.Thing, name string) *shadow {
+	return &shadow{
 		thing:     thing,
 		thingName: thing.Config.ThingName,
-		doc: &ThingDocument{
-			State: ThingState{
-				Desired:  map[string]interface{}{},
-				Reported: map[string]interface{}{},
-				Delta:    map[string]interface{}{},
-			},
-		},
-
-		chResps: make(map[string]chan interface{}),
-	}
-
-	for _, sub := range []struct {
-		topic   string
-		handler mqtt.MessageHandler
-	}{
-		{s.topic("update/delta"), mqtt.MessageHandler(s.updateDelta)},
-		{s.topic("update/accepted"), mqtt.MessageHandler(s.updateAccepted)},
-		{s.topic("update/rejected"), mqtt.MessageHandler(s.rejected)},
-		{s.topic("delete/accepted"), mqtt.MessageHandler(s.deleteAccepted)},
-		{s.topic("delete/rejected"), mqtt.MessageHandler(s.rejected)},
-		{s.topic("get/accepted"), mqtt.MessageHandler(s.getAccepted)},
-		{s.topic("get/rejected"), mqtt.MessageHandler(s.rejected)},
-		{s.topic("name/health/update/delta"), mqtt.MessageHandler(s.updateDelta)},
-		{s.topic("name/health/update/accepted"), mqtt.MessageHandler(s.updateAccepted)},
-		{s.topic("name/health/update/rejected"), mqtt.MessageHandler(s.rejected)},
-		{s.topic("name/health/delete/accepted"), mqtt.MessageHandler(s.deleteAccepted)},
-		{s.topic("name/health/delete/rejected"), mqtt.MessageHandler(s.rejected)},
-		{s.topic("name/health/get/accepted"), mqtt.MessageHandler(s.getAccepted)},
-		{s.topic("name/health/get/rejected"), mqtt.MessageHandler(s.rejected)},
-	} {
-		if err := thing.Connection.Subscribe(sub.topic, sub.handler); err != nil {
-			return nil, fmt.Errorf("registering message handlers %v", err)
-		}
+		name:      name,
+		doc:       newThingDocument(),
+		chResps:   make(map[string]chan interface{}),
 	}
+}
 
-	return s, nil
+func (s *shadow) subscriptions() []connect.Subscription {
+	return []connect.Subscription{
+		{Topic: s.topic("update/delta"), QoS: 1, Handler: s.updateDelta},
+		{Topic: s.topic("update/accepted"), QoS: 1, Handler: s.updateAccepted},
+		{Topic: s.topic("update/rejected"), QoS: 1, Handler: s.rejected},
+		{Topic: s.topic("delete/accepted"), QoS: 1, Handler: s.deleteAccepted},
+		{Topic: s.topic("delete/rejected"), QoS: 1, Handler: s.rejected},
+		{Topic: s.topic("get/accepted"), QoS: 1, Handler: s.getAccepted},
+		{Topic: s.topic("get/rejected"), QoS: 1, Handler: s.rejected},
+	}
+}
+
+func (s *shadow) subscribe() error {
+	if err := s.thing.Connection.SubscribeMultiple(s.subscriptions()); err != nil {
+		return fmt.Errorf("registering message handlers %v", err)
+	}
+	s.unwatch = s.thing.Connection.OnStateChange(s.stateChanged)
+	return nil
+}
+
+// stateChanged fetches the document again after a reconnect, as deltas
+// sent while the connection was down are lost.
+func (s *shadow) stateChanged(ev connect.Event) {
+	if ev.State != connect.StateConnected || ev.Previous != connect.StateReconnecting {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+		if _, err := s.Get(ctx); err != nil {
+			s.handleError(fmt.Errorf("refreshing document after reconnect %v", err))
+		}
+	}()
 }
 
-func (s *shadow) handleResponse(r interface{}) {
+func (s *shadow) unsubscribe() error {
+	if s.unwatch != nil {
+		s.unwatch()
+	}
+	var topics []string
+	for _, sub := range s.subscriptions() {
+		topics = append(topics, sub.Topic)
+	}
+	if err := s.thing.Connection.Unsubscribe(topics...); err != nil {
+		return fmt.Errorf("removing message handlers %v", err)
+	}
+	return nil
+}
+
+func (s *shadow) handleResponse(msg mqtt.Message, r interface{}) {
 	fmt.Println("received response")
-	token, ok := clientToken(r)
+	token, ok := clienttoken.Response(msg, r)
 	if !ok {
 		return
 	}
@@ -132,46 +174,50 @@ func (s *shadow) handleResponse(r interface{}) {
 
 func (s *shadow) getAccepted(client mqtt.Client, msg mqtt.Message) {
 	doc := &ThingDocument{}
-	if err := json.Unmarshal(msg.Payload(), doc); err != nil {
+	if err := payloadCodec.Unmarshal(msg.Payload(), doc); err != nil {
 		s.handleError(fmt.Errorf("unmarshaling thing document  %v", err))
 		return
 	}
 	s.mu.Lock()
 	s.doc = doc
 	s.mu.Unlock()
-	s.handleResponse(doc)
+	s.handleResponse(msg, doc)
 
 	s.handleDelta(doc.State.Delta)
 }
 
 func (s *shadow) rejected(client mqtt.Client, msg mqtt.Message) {
 	e := &ErrorResponse{}
-	if err := json.Unmarshal(msg.Payload(), e); err != nil {
+	if err := payloadCodec.Unmarshal(msg.Payload(), e); err != nil {
 		s.handleError(fmt.Errorf("unmarshaling error response %v", err))
 		return
 	}
-	s.handleResponse(e)
+	s.handleResponse(msg, e)
 }
 
 func (s *shadow) updateAccepted(client mqtt.Client, msg mqtt.Message) {
 	doc := &thingDocumentRaw{}
-	if err := json.Unmarshal(msg.Payload(), doc); err != nil {
+	if err := payloadCodec.Unmarshal(msg.Payload(), doc); err != nil {
 		s.handleError(fmt.Errorf("unmarshaling thing document %v", err))
 		return
 	}
 	s.mu.Lock()
+	if s.doc == nil {
+		// The document was deleted; start over from an empty one.
+		s.doc = newThingDocument()
+	}
 	err := s.doc.update(doc)
 	s.mu.Unlock()
 	if err != nil {
 		s.handleError(fmt.Errorf("updating local thing document %v", err))
 		return
 	}
-	s.handleResponse(doc)
+	s.handleResponse(msg, doc)
 }
 
 func (s *shadow) updateDelta(client mqtt.Client, msg mqtt.Message) {
 	state := &thingDelta{}
-	if err := json.Unmarshal(msg.Payload(), state); err != nil {
+	if err := payloadCodec.Unmarshal(msg.Payload(), state); err != nil {
 		s.handleError(fmt.Errorf("unmarshaling thing delta %v", err))
 		return
 	}
@@ -186,14 +232,14 @@ func (s *shadow) updateDelta(client mqtt.Client, msg mqtt.Message) {
 
 func (s *shadow) deleteAccepted(client mqtt.Client, msg mqtt.Message) {
 	doc := &thingDocumentRaw{}
-	if err := json.Unmarshal(msg.Payload(), doc); err != nil {
+	if err := payloadCodec.Unmarshal(msg.Payload(), doc); err != nil {
 		s.handleError(fmt.Errorf("unmarshaling thing document %v", err))
 		return
 	}
 	s.mu.Lock()
 	s.doc = nil
 	s.mu.Unlock()
-	s.handleResponse(doc)
+	s.handleResponse(msg, doc)
 }
 
 func (s *shadow) Report(ctx context.Context, state interface{}) (*ThingDocument, error) {
@@ -203,7 +249,7 @@ func (s *shadow) Report(ctx context.Context, state interface{}) (*ThingDocument,
 	}
 	token := s.token()
 	rawStateJSON := json.RawMessage(rawState)
-	data, err := json.Marshal(&thingDocumentRaw{
+	data, err := payloadCodec.Marshal(&thingDocumentRaw{
 		State:       thingStateRaw{Reported: rawStateJSON},
 		ClientToken: token,
 	})
@@ -221,7 +267,7 @@ func (s *shadow) Report(ctx context.Context, state interface{}) (*ThingDocument,
 		s.mu.Unlock()
 	}()
 
-	if token := s.thing.Connection.Publish(s.topic("update"), data); token.Wait() && token.Error() != nil {
+	if token := s.thing.Connection.Publish(s.topic("update"), data, connect.WithCorrelationData([]byte(token))); token.Wait() && token.Error() != nil {
 		return nil, fmt.Errorf("sending request %v", err)
 	}
 
@@ -250,7 +296,7 @@ func (s *shadow) Desire(ctx context.Context, state interface{}) (*ThingDocument,
 	}
 	token := s.token()
 	rawStateJSON := json.RawMessage(rawState)
-	data, err := json.Marshal(&thingDocumentRaw{
+	data, err := payloadCodec.Marshal(&thingDocumentRaw{
 		State:       thingStateRaw{Desired: rawStateJSON},
 		ClientToken: token,
 	})
@@ -268,7 +314,7 @@ func (s *shadow) Desire(ctx context.Context, state interface{}) (*ThingDocument,
 		s.mu.Unlock()
 	}()
 
-	if token := s.thing.Connection.Publish(s.topic("update"), data); token.Wait() && token.Error() != nil {
+	if token := s.thing.Connection.Publish(s.topic("update"), data, connect.WithCorrelationData([]byte(token))); token.Wait() && token.Error() != nil {
 		return nil, fmt.Errorf("sending request %v", err)
 	}
 
@@ -292,7 +338,7 @@ func (s *shadow) Desire(ctx context.Context, state interface{}) (*ThingDocument,
 
 func (s *shadow) Get(ctx context.Context) (*ThingDocument, error) {
 	token := s.token()
-	data, err := json.Marshal(&simpleRequest{
+	data, err := payloadCodec.Marshal(&simpleRequest{
 		ClientToken: token,
 	})
 	if err != nil {
@@ -309,7 +355,7 @@ func (s *shadow) Get(ctx context.Context) (*ThingDocument, error) {
 		s.mu.Unlock()
 	}()
 
-	if token := s.thing.Connection.Publish(s.topic("get"), []byte(data)); token.Wait() && token.Error() != nil {
+	if token := s.thing.Connection.Publish(s.topic("get"), []byte(data), connect.WithCorrelationData([]byte(token))); token.Wait() && token.Error() != nil {
 		return nil, fmt.Errorf("sending request %v", err)
 	}
 
@@ -319,7 +365,7 @@ func (s *shadow) Get(ctx context.Context) (*ThingDocument, error) {
 	case res := <-ch:
 		switch r := res.(type) {
 		case *ThingDocument:
-			setClientToken(r, "")
+			clienttoken.Set(r, "")
 			return r, nil
 		case *ErrorResponse:
 			return nil, r
@@ -331,7 +377,7 @@ func (s *shadow) Get(ctx context.Context) (*ThingDocument, error) {
 
 func (s *shadow) Delete(ctx context.Context) error {
 	token := s.token()
-	data, err := json.Marshal(&simpleRequest{
+	data, err := payloadCodec.Marshal(&simpleRequest{
 		ClientToken: token,
 	})
 	if err != nil {
@@ -348,7 +394,7 @@ func (s *shadow) Delete(ctx context.Context) error {
 		s.mu.Unlock()
 	}()
 
-	if token := s.thing.Connection.Publish(s.topic("delete"), []byte(data)); token.Wait() && token.Error() != nil {
+	if token := s.thing.Connection.Publish(s.topic("delete"), []byte(data), connect.WithCorrelationData([]byte(token))); token.Wait() && token.Error() != nil {
 		return fmt.Errorf("sending request %v", err)
 	}
 
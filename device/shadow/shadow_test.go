@@ -0,0 +1,120 @@
+package shadow_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/iottest"
+	"github.com/randyridgley/simple-go-iot-device/device/shadow"
+)
+
+const thingName = "thing-1"
+
+// newShadow connects a thing to an emulated AWS IoT and creates its
+// classic shadow.
+func newShadow(t *testing.T) (shadow.Shadow, *iottest.Emulator) {
+	t.Helper()
+	thing, emu := iottest.NewThing(t, device.ThingConfiguration{ThingName: thingName})
+	s, err := shadow.New(context.Background(), thing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, emu
+}
+
+func TestShadowReportGetDelete(t *testing.T) {
+	s, emu := newShadow(t)
+	ctx := iottest.Context(t)
+
+	doc, err := s.Report(ctx, map[string]interface{}{"color": "red", "speed": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.State.Reported["color"] != "red" {
+		t.Errorf("reported %v", doc.State.Reported)
+	}
+	remote, ok := emu.Shadow(thingName, "")
+	if !ok || remote.State.Reported["color"] != "red" {
+		t.Fatalf("emulated shadow %v", remote)
+	}
+
+	// A null value deletes the field.
+	if _, err := s.Report(ctx, map[string]interface{}{"speed": nil}); err != nil {
+		t.Fatal(err)
+	}
+	doc, err = s.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc.State.Reported["speed"]; ok || doc.State.Reported["color"] != "red" {
+		t.Errorf("reported %v after deleting speed", doc.State.Reported)
+	}
+	if doc.Version != remote.Version+1 {
+		t.Errorf("version %d, want %d", doc.Version, remote.Version+1)
+	}
+
+	if err := s.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := emu.Shadow(thingName, ""); ok {
+		t.Error("shadow still exists after Delete")
+	}
+	_, err = s.Get(ctx)
+	var rejected *shadow.ErrorResponse
+	if !errors.As(err, &rejected) || rejected.Code != 404 {
+		t.Errorf("Get() after Delete = %v, want a 404 rejection", err)
+	}
+}
+
+func TestShadowDelta(t *testing.T) {
+	s, emu := newShadow(t)
+	ctx := iottest.Context(t)
+
+	deltas := make(chan map[string]interface{}, 1)
+	s.OnDelta(func(delta map[string]interface{}) { deltas <- delta })
+	if _, err := s.Report(ctx, map[string]interface{}{"color": "red"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := emu.Desire(thingName, "", map[string]interface{}{"color": "blue"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case delta := <-deltas:
+		if delta["color"] != "blue" {
+			t.Errorf("delta %v", delta)
+		}
+	case <-ctx.Done():
+		t.Fatal("no delta received")
+	}
+}
+
+func TestShadowRejected(t *testing.T) {
+	s, emu := newShadow(t)
+	ctx := iottest.Context(t)
+
+	emu.Script("$aws/things/+/shadow/update", 1, iottest.RejectShadow(409, "Version conflict"))
+	_, err := s.Report(ctx, map[string]interface{}{"color": "red"})
+	var rejected *shadow.ErrorResponse
+	if !errors.As(err, &rejected) || rejected.Code != 409 {
+		t.Fatalf("Report() = %v, want a 409 rejection", err)
+	}
+
+	// The script is used up and the next update is accepted.
+	if _, err := s.Report(ctx, map[string]interface{}{"color": "red"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShadowTimeout(t *testing.T) {
+	s, emu := newShadow(t)
+	emu.Script("$aws/things/+/shadow/get", 0, iottest.Drop())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.Get(ctx); err == nil {
+		t.Fatal("Get() of a dropped request succeeded")
+	}
+}
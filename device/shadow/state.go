@@ -41,6 +41,16 @@ type ThingDocument struct {
 	ClientToken string     `json:"clientToken,omitempty"`
 }
 
+func newThingDocument() *ThingDocument {
+	return &ThingDocument{
+		State: ThingState{
+			Desired:  map[string]interface{}{},
+			Reported: map[string]interface{}{},
+			Delta:    map[string]interface{}{},
+		},
+	}
+}
+
 type thingStateRaw struct {
 	Desired     json.RawMessage `json:"desired,omitempty"`
 	Reported    json.RawMessage `json:"reported,omitempty"`
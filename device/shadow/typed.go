@@ -0,0 +1,214 @@
+package shadow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Typed wraps a Shadow and exposes the thing state as T instead of untyped
+// maps. T is converted to and from the shadow document with encoding/json,
+// so struct tags control the field names.
+type Typed[T any] struct {
+	shadow  Shadow
+	mu      sync.Mutex
+	onError func(err error)
+}
+
+// NewTyped creates a typed view of the shadow s.
+func NewTyped[T any](s Shadow) *Typed[T] {
+	return &Typed[T]{shadow: s}
+}
+
+// Shadow returns the underlying untyped shadow.
+func (t *Typed[T]) Shadow() Shadow {
+	return t.shadow
+}
+
+// Get fetches the thing document and returns the reported state.
+func (t *Typed[T]) Get(ctx context.Context) (T, error) {
+	var state T
+	doc, err := t.shadow.Get(ctx)
+	if err != nil {
+		return state, err
+	}
+	return decodeState[T](doc.State.Reported)
+}
+
+// Reported returns the reported state of the local thing document.
+func (t *Typed[T]) Reported() (T, error) {
+	var state T
+	doc := t.shadow.Document()
+	if doc == nil {
+		return state, nil
+	}
+	return decodeState[T](doc.State.Reported)
+}
+
+// Desired returns the desired state of the local thing document.
+func (t *Typed[T]) Desired() (T, error) {
+	var state T
+	doc := t.shadow.Document()
+	if doc == nil {
+		return state, nil
+	}
+	return decodeState[T](doc.State.Desired)
+}
+
+// Report updates the reported state to state. Only the fields that differ
+// from the local document are sent; fields that are no longer present in
+// the encoded state are sent as null so AWS IoT deletes them.
+func (t *Typed[T]) Report(ctx context.Context, state T) (T, error) {
+	var reported T
+	update, err := t.update(state, func(doc *ThingDocument) map[string]interface{} {
+		return doc.State.Reported
+	})
+	if err != nil {
+		return reported, err
+	}
+	if len(update) == 0 {
+		return t.Reported()
+	}
+	doc, err := t.shadow.Report(ctx, update)
+	if err != nil {
+		return reported, err
+	}
+	return decodeState[T](doc.State.Reported)
+}
+
+// Desire updates the desired state to state with the same partial update
+// semantics as Report.
+func (t *Typed[T]) Desire(ctx context.Context, state T) (T, error) {
+	var desired T
+	update, err := t.update(state, func(doc *ThingDocument) map[string]interface{} {
+		return doc.State.Desired
+	})
+	if err != nil {
+		return desired, err
+	}
+	if len(update) == 0 {
+		return t.Desired()
+	}
+	doc, err := t.shadow.Desire(ctx, update)
+	if err != nil {
+		return desired, err
+	}
+	return decodeState[T](doc.State.Desired)
+}
+
+// OnDelta sets handler of state deltas. The delta is decoded on top of the
+// current reported state, so fields without a delta keep their reported
+// value and the result can be passed straight to Report once applied.
+func (t *Typed[T]) OnDelta(cb func(state T)) {
+	t.shadow.OnDelta(func(delta map[string]interface{}) {
+		if len(delta) == 0 {
+			return
+		}
+		var reported map[string]interface{}
+		if doc := t.shadow.Document(); doc != nil {
+			reported = doc.State.Reported
+		}
+		merged := cloneState(reported)
+		if err := updateState(merged, cloneState(delta)); err != nil {
+			t.handleError(fmt.Errorf("applying delta %v", err))
+			return
+		}
+		state, err := decodeState[T](merged)
+		if err != nil {
+			t.handleError(err)
+			return
+		}
+		cb(state)
+	})
+}
+
+// OnError sets handler of asynchronous errors, including deltas that could
+// not be decoded into T.
+func (t *Typed[T]) OnError(cb func(err error)) {
+	t.mu.Lock()
+	t.onError = cb
+	t.mu.Unlock()
+	t.shadow.OnError(cb)
+}
+
+func (t *Typed[T]) handleError(err error) {
+	t.mu.Lock()
+	cb := t.onError
+	t.mu.Unlock()
+	if cb != nil {
+		cb(err)
+	}
+}
+
+func (t *Typed[T]) update(state T, current func(doc *ThingDocument) map[string]interface{}) (map[string]interface{}, error) {
+	next, err := encodeState(state)
+	if err != nil {
+		return nil, err
+	}
+	var prev map[string]interface{}
+	if doc := t.shadow.Document(); doc != nil {
+		prev = current(doc)
+	}
+	return diffState(prev, next), nil
+}
+
+// encodeState converts state to its shadow document representation.
+func encodeState(state interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling state %v", err)
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("state must encode to a JSON object %v", err)
+	}
+	return m, nil
+}
+
+// decodeState converts a shadow document state to T.
+func decodeState[T any](state map[string]interface{}) (T, error) {
+	var v T
+	if len(state) == 0 {
+		return v, nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return v, fmt.Errorf("marshaling state %v", err)
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, fmt.Errorf("unmarshaling state %v", err)
+	}
+	return v, nil
+}
+
+// diffState returns the update that turns prev into next. Keys missing from
+// next are set to nil, which AWS IoT treats as a delete.
+func diffState(prev, next map[string]interface{}) map[string]interface{} {
+	d := map[string]interface{}{}
+	for k, nv := range next {
+		pv, ok := prev[k]
+		if !ok {
+			d[k] = nv
+			continue
+		}
+		pm, pok := pv.(map[string]interface{})
+		nm, nok := nv.(map[string]interface{})
+		if pok && nok {
+			if sub := diffState(pm, nm); len(sub) != 0 {
+				d[k] = sub
+			}
+			continue
+		}
+		if !reflect.DeepEqual(pv, nv) {
+			d[k] = nv
+		}
+	}
+	for k := range prev {
+		if _, ok := next[k]; !ok {
+			d[k] = nil
+		}
+	}
+	return d
+}
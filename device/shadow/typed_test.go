@@ -0,0 +1,82 @@
+package shadow
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffState(t *testing.T) {
+	tests := []struct {
+		name       string
+		prev, next map[string]interface{}
+		want       map[string]interface{}
+	}{
+		{
+			name: "unchanged",
+			prev: map[string]interface{}{"color": "red", "speed": 1.0},
+			next: map[string]interface{}{"color": "red", "speed": 1.0},
+			want: map[string]interface{}{},
+		},
+		{
+			name: "changed and added",
+			prev: map[string]interface{}{"color": "red"},
+			next: map[string]interface{}{"color": "blue", "speed": 2.0},
+			want: map[string]interface{}{"color": "blue", "speed": 2.0},
+		},
+		{
+			name: "removed is deleted with null",
+			prev: map[string]interface{}{"color": "red", "speed": 1.0},
+			next: map[string]interface{}{"color": "red"},
+			want: map[string]interface{}{"speed": nil},
+		},
+		{
+			name: "nested removed is deleted with null",
+			prev: map[string]interface{}{"led": map[string]interface{}{"on": true, "level": 3.0}},
+			next: map[string]interface{}{"led": map[string]interface{}{"on": true}},
+			want: map[string]interface{}{"led": map[string]interface{}{"level": nil}},
+		},
+		{
+			name: "nested unchanged is omitted",
+			prev: map[string]interface{}{"led": map[string]interface{}{"on": true}, "color": "red"},
+			next: map[string]interface{}{"led": map[string]interface{}{"on": true}, "color": "blue"},
+			want: map[string]interface{}{"color": "blue"},
+		},
+		{
+			name: "object replaced by value",
+			prev: map[string]interface{}{"led": map[string]interface{}{"on": true}},
+			next: map[string]interface{}{"led": "off"},
+			want: map[string]interface{}{"led": "off"},
+		},
+		{
+			name: "no previous state",
+			next: map[string]interface{}{"color": "red"},
+			want: map[string]interface{}{"color": "red"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffState(tt.prev, tt.next); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffState() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeStateOmitsEmptyFields(t *testing.T) {
+	type state struct {
+		Color string `json:"color,omitempty"`
+		Speed int    `json:"speed"`
+	}
+	prev, err := encodeState(state{Color: "red", Speed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := encodeState(state{Speed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"color": nil}
+	if got := diffState(prev, next); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffState() = %v, want %v", got, want)
+	}
+}
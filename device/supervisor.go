@@ -0,0 +1,98 @@
+/*
+Copyright © 2020 Randy Ridgley randy.ridgley@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrDrainTimeout is returned by Wait if services did not stop in time.
+var ErrDrainTimeout = errors.New("timed out waiting for services to stop")
+
+// Supervisor runs the long lived services of a device and stops all of
+// them as soon as one fails or the parent context is cancelled.
+type Supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error
+}
+
+// NewSupervisor creates a Supervisor bound to the given context.
+func NewSupervisor(ctx context.Context) *Supervisor {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Supervisor{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Go starts fn as a supervised service. A service returning an error other
+// than a context cancellation stops every other service.
+func (s *Supervisor) Go(name string, fn func(ctx context.Context) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fmt.Printf("[%s] started\n", name)
+		err := fn(s.ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			fmt.Printf("[%s] failed: %v\n", name, err)
+			s.mu.Lock()
+			if s.err == nil {
+				s.err = fmt.Errorf("%s: %v", name, err)
+			}
+			s.mu.Unlock()
+			s.cancel()
+			return
+		}
+		fmt.Printf("[%s] stopped\n", name)
+	}()
+}
+
+// Done is closed when the supervisor starts shutting down.
+func (s *Supervisor) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Stop asks every service to shut down.
+func (s *Supervisor) Stop() {
+	s.cancel()
+}
+
+// Wait blocks until all services have returned or the timeout expires and
+// returns the first service failure, if any.
+func (s *Supervisor) Wait(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return ErrDrainTimeout
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
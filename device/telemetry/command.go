@@ -0,0 +1,70 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultCommandTimeout = 10 * time.Second
+
+// CommandConfiguration configures the Command source.
+type CommandConfiguration struct {
+	// Command is the program and its arguments. It is not run by a shell.
+	Command []string
+	// Timeout kills the command if it runs longer. It defaults to 10s.
+	Timeout time.Duration
+}
+
+type command struct {
+	config CommandConfiguration
+}
+
+// Command returns a Source that runs a command on every read. Output that
+// is valid JSON is published as the decoded value, other output as a
+// trimmed string.
+func Command(config CommandConfiguration) Source {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultCommandTimeout
+	}
+	return &command{config: config}
+}
+
+func (c *command) Start(ctx context.Context) error {
+	if len(c.config.Command) == 0 {
+		return fmt.Errorf("command source has no command")
+	}
+	if _, err := exec.LookPath(c.config.Command[0]); err != nil {
+		return fmt.Errorf("command source %v", err)
+	}
+	return nil
+}
+
+func (c *command) Read(ctx context.Context) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.config.Command[0], c.config.Command[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("running %s %v: %s", c.config.Command[0], err, msg)
+		}
+		return nil, fmt.Errorf("running %s %v", c.config.Command[0], err)
+	}
+	out = bytes.TrimSpace(out)
+	var v interface{}
+	if err := json.Unmarshal(out, &v); err == nil {
+		return v, nil
+	}
+	return string(out), nil
+}
+
+func (c *command) Stop() error {
+	return nil
+}
@@ -0,0 +1,69 @@
+package telemetry_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/randyridgley/simple-go-iot-device/device/telemetry"
+)
+
+func TestCommand(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		command []string
+		want    interface{}
+	}{
+		{"json", []string{"echo", `{"temperature": 21.5, "ok": true}`}, map[string]interface{}{"temperature": 21.5, "ok": true}},
+		{"number", []string{"echo", "42"}, float64(42)},
+		{"text", []string{"echo", "  hello world  "}, "hello world"},
+		{"not run by a shell", []string{"echo", "$HOME", "|", "cat"}, "$HOME | cat"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			src := telemetry.Command(telemetry.CommandConfiguration{Command: c.command})
+			if err := src.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			v, err := src.Read(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(v, c.want) {
+				t.Errorf("Read() = %#v, want %#v", v, c.want)
+			}
+		})
+	}
+}
+
+func TestCommandFails(t *testing.T) {
+	src := telemetry.Command(telemetry.CommandConfiguration{Command: []string{"sh", "-c", "echo partial; echo sensor offline >&2; exit 3"}})
+	if err := src.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_, err := src.Read(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") || !strings.Contains(err.Error(), "sensor offline") {
+		t.Errorf("Read() = %v, want the exit status and stderr", err)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	src := telemetry.Command(telemetry.CommandConfiguration{Command: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond})
+	start := time.Now()
+	if _, err := src.Read(context.Background()); err == nil {
+		t.Error("Read() of a command that timed out succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Read() took %v", elapsed)
+	}
+}
+
+func TestCommandStart(t *testing.T) {
+	for _, command := range [][]string{nil, {"no-such-command-in-path"}} {
+		src := telemetry.Command(telemetry.CommandConfiguration{Command: command})
+		if err := src.Start(context.Background()); err == nil {
+			t.Errorf("Start() of %q succeeded", command)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package telemetry
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// diskUsage returns the usage of the file system mounted at path.
+func diskUsage(path string) (DiskSample, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return DiskSample{}, fmt.Errorf("reading disk usage of %s %v", path, err)
+	}
+	d := DiskSample{
+		Total: st.Blocks * uint64(st.Bsize),
+		Free:  st.Bavail * uint64(st.Bsize),
+	}
+	// Blocks reserved for root are neither free nor available to users.
+	if used := (st.Blocks - st.Bfree) * uint64(st.Bsize); used+d.Free > 0 {
+		d.UsedPercent = 100 * float64(used) / float64(used+d.Free)
+	}
+	return d, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package telemetry
+
+import "fmt"
+
+// diskUsage is only implemented for Linux.
+func diskUsage(path string) (DiskSample, error) {
+	return DiskSample{}, fmt.Errorf("reading disk usage of %s: not supported on this platform", path)
+}
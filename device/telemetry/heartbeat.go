@@ -0,0 +1,23 @@
+package telemetry
+
+import (
+	"context"
+	"time"
+)
+
+// Heartbeat returns a SampleFunc of the serial number of the device, the
+// time and the seconds since Heartbeat was called.
+func Heartbeat(serialNumber string) SampleFunc {
+	started := time.Now()
+	return func(ctx context.Context) (interface{}, error) {
+		return struct {
+			SerialNumber string `json:"serialNumber"`
+			Timestamp    int64  `json:"timestamp"`
+			Uptime       int64  `json:"uptime"`
+		}{
+			SerialNumber: serialNumber,
+			Timestamp:    time.Now().Unix(),
+			Uptime:       int64(time.Since(started).Seconds()),
+		}, nil
+	}
+}
@@ -0,0 +1,242 @@
+package telemetry
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HostMetricsConfiguration selects what the HostMetrics source reports.
+type HostMetricsConfiguration struct {
+	// ProcPath is where procfs is mounted. It defaults to /proc.
+	ProcPath string
+	// Disks are the mount points whose usage is reported. It defaults
+	// to /.
+	Disks []string
+	// Interfaces are the network interfaces reported. It defaults to all
+	// interfaces but lo.
+	Interfaces []string
+}
+
+// HostSample is a value of the HostMetrics source. CPU is the percentage
+// of time the CPUs were busy since the previous read, or since boot on
+// the first one.
+type HostSample struct {
+	CPU     float64                  `json:"cpu"`
+	Memory  MemorySample             `json:"memory"`
+	Disks   map[string]DiskSample    `json:"disks,omitempty"`
+	Network map[string]NetworkSample `json:"network,omitempty"`
+}
+
+// MemorySample is the memory usage of the host in bytes.
+type MemorySample struct {
+	Total       uint64  `json:"total"`
+	Available   uint64  `json:"available"`
+	UsedPercent float64 `json:"usedPercent"`
+}
+
+// DiskSample is the usage of a file system in bytes.
+type DiskSample struct {
+	Total       uint64  `json:"total"`
+	Free        uint64  `json:"free"`
+	UsedPercent float64 `json:"usedPercent"`
+}
+
+// NetworkSample holds the byte counters of a network interface and
+// their rates in bytes per second since the previous read.
+type NetworkSample struct {
+	RxBytes uint64  `json:"rxBytes"`
+	TxBytes uint64  `json:"txBytes"`
+	RxRate  float64 `json:"rxRate"`
+	TxRate  float64 `json:"txRate"`
+}
+
+type hostMetrics struct {
+	config HostMetricsConfiguration
+
+	busy, total uint64
+	network     map[string]NetworkSample
+	read        time.Time
+}
+
+// HostMetrics returns a Source of the CPU, memory, disk and network usage
+// of a Linux host, read from procfs.
+func HostMetrics(config HostMetricsConfiguration) Source {
+	if config.ProcPath == "" {
+		config.ProcPath = "/proc"
+	}
+	if len(config.Disks) == 0 {
+		config.Disks = []string{"/"}
+	}
+	return &hostMetrics{config: config}
+}
+
+func (h *hostMetrics) Start(ctx context.Context) error {
+	if _, err := os.Stat(filepath.Join(h.config.ProcPath, "stat")); err != nil {
+		return fmt.Errorf("reading host metrics %v", err)
+	}
+	return nil
+}
+
+func (h *hostMetrics) Read(ctx context.Context) (interface{}, error) {
+	now := time.Now()
+	s := &HostSample{}
+
+	busy, total, err := h.cpu()
+	if err != nil {
+		return nil, err
+	}
+	if total > h.total {
+		s.CPU = 100 * float64(busy-h.busy) / float64(total-h.total)
+	}
+	h.busy, h.total = busy, total
+
+	if s.Memory, err = h.memory(); err != nil {
+		return nil, err
+	}
+
+	s.Disks = make(map[string]DiskSample, len(h.config.Disks))
+	for _, path := range h.config.Disks {
+		d, err := diskUsage(path)
+		if err != nil {
+			return nil, err
+		}
+		s.Disks[path] = d
+	}
+
+	network, err := h.interfaces()
+	if err != nil {
+		return nil, err
+	}
+	if !h.read.IsZero() {
+		elapsed := now.Sub(h.read).Seconds()
+		for name, n := range network {
+			if prev, ok := h.network[name]; ok && elapsed > 0 && n.RxBytes >= prev.RxBytes && n.TxBytes >= prev.TxBytes {
+				n.RxRate = float64(n.RxBytes-prev.RxBytes) / elapsed
+				n.TxRate = float64(n.TxBytes-prev.TxBytes) / elapsed
+				network[name] = n
+			}
+		}
+	}
+	h.network = network
+	h.read = now
+	s.Network = network
+	return s, nil
+}
+
+func (h *hostMetrics) Stop() error {
+	return nil
+}
+
+// cpu returns the busy and total jiffies of all CPUs from /proc/stat.
+func (h *hostMetrics) cpu() (uint64, uint64, error) {
+	f, err := os.Open(filepath.Join(h.config.ProcPath, "stat"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading cpu usage %v", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		// user, nice, system, idle, iowait, irq, softirq and steal. The
+		// guest times that may follow are already part of user and nice.
+		if len(fields) > 9 {
+			fields = fields[:9]
+		}
+		var busy, total uint64
+		for i, field := range fields[1:] {
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("parsing cpu usage %v", err)
+			}
+			total += v
+			// idle and iowait are the 4th and 5th values.
+			if i != 3 && i != 4 {
+				busy += v
+			}
+		}
+		return busy, total, nil
+	}
+	return 0, 0, fmt.Errorf("parsing cpu usage: no cpu line")
+}
+
+// memory reads the memory usage from /proc/meminfo.
+func (h *hostMetrics) memory() (MemorySample, error) {
+	f, err := os.Open(filepath.Join(h.config.ProcPath, "meminfo"))
+	if err != nil {
+		return MemorySample{}, fmt.Errorf("reading memory usage %v", err)
+	}
+	defer f.Close()
+	values := make(map[string]uint64)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		// Values are in kB.
+		values[strings.TrimSuffix(fields[0], ":")] = v * 1024
+	}
+	m := MemorySample{Total: values["MemTotal"], Available: values["MemAvailable"]}
+	if _, ok := values["MemAvailable"]; !ok {
+		// Kernels before 3.14 do not report MemAvailable.
+		m.Available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+	if m.Total > 0 {
+		m.UsedPercent = 100 * float64(m.Total-m.Available) / float64(m.Total)
+	}
+	return m, nil
+}
+
+// interfaces reads the byte counters of the network interfaces from
+// /proc/net/dev.
+func (h *hostMetrics) interfaces() (map[string]NetworkSample, error) {
+	f, err := os.Open(filepath.Join(h.config.ProcPath, "net", "dev"))
+	if err != nil {
+		return nil, fmt.Errorf("reading network usage %v", err)
+	}
+	defer f.Close()
+	wanted := make(map[string]bool, len(h.config.Interfaces))
+	for _, name := range h.config.Interfaces {
+		wanted[name] = true
+	}
+	network := make(map[string]NetworkSample)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		name, counters, ok := strings.Cut(s.Text(), ":")
+		if !ok {
+			// The two header lines.
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if len(wanted) > 0 && !wanted[name] || len(wanted) == 0 && name == "lo" {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 9 {
+			continue
+		}
+		rx, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing network usage %v", err)
+		}
+		tx, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing network usage %v", err)
+		}
+		network[name] = NetworkSample{RxBytes: rx, TxBytes: tx}
+	}
+	return network, nil
+}
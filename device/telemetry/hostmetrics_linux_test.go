@@ -0,0 +1,221 @@
+package telemetry_test
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/randyridgley/simple-go-iot-device/device/telemetry"
+)
+
+const netDev = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo: 5000      50    0    0    0     0          0         0     5000      50    0    0    0     0       0          0
+  eth0: 1000      10    0    0    0     0          0         0     2000      20    0    0    0     0       0          0
+ wlan0: 3000      30    0    0    0     0          0         0     4000      40    0    0    0     0       0          0
+`
+
+// writeProc writes the files of a fixture procfs under dir.
+func writeProc(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readHost(t *testing.T, src telemetry.Source) *telemetry.HostSample {
+	t.Helper()
+	v, err := src.Read(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.(*telemetry.HostSample)
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestHostMetricsCPU(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		stat        []string
+		first, next float64
+	}{{
+		name: "guest time",
+		// guest and guest_nice are part of user and nice and not counted
+		// twice.
+		stat: []string{
+			"cpu  100 0 100 700 100 0 0 0 50 50\ncpu0 100 0 100 700 100 0 0 0 50 50\n",
+			"cpu  200 0 200 1300 100 0 0 0 150 150\ncpu0 200 0 200 1300 100 0 0 0 150 150\n",
+		},
+		first: 20,
+		next:  25,
+	}, {
+		name: "steal time",
+		stat: []string{
+			"cpu  100 100 100 500 50 25 25 100\n",
+			"cpu  100 100 100 900 50 25 25 200\n",
+		},
+		first: 45,
+		next:  20,
+	}, {
+		name: "old kernel",
+		stat: []string{
+			"cpu  50 0 50 900\n",
+			"cpu  100 0 100 1000\n",
+		},
+		first: 10,
+		next:  50,
+	}, {
+		name: "idle",
+		stat: []string{
+			"cpu  0 0 0 100 0 0 0 0 0 0\n",
+			"cpu  0 0 0 100 0 0 0 0 0 0\n",
+		},
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			proc := t.TempDir()
+			writeProc(t, proc, map[string]string{"stat": c.stat[0], "meminfo": "", "net/dev": ""})
+			src := telemetry.HostMetrics(telemetry.HostMetricsConfiguration{ProcPath: proc, Disks: []string{proc}})
+			if err := src.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if s := readHost(t, src); !near(s.CPU, c.first) {
+				t.Errorf("first CPU = %v, want %v", s.CPU, c.first)
+			}
+			writeProc(t, proc, map[string]string{"stat": c.stat[1]})
+			if s := readHost(t, src); !near(s.CPU, c.next) {
+				t.Errorf("next CPU = %v, want %v", s.CPU, c.next)
+			}
+		})
+	}
+}
+
+func TestHostMetricsMemory(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		meminfo string
+		want    telemetry.MemorySample
+	}{{
+		name:    "available",
+		meminfo: "MemTotal:       1000 kB\nMemFree:         100 kB\nMemAvailable:    250 kB\nBuffers:          50 kB\nCached:          100 kB\n",
+		want:    telemetry.MemorySample{Total: 1024000, Available: 256000, UsedPercent: 75},
+	}, {
+		name:    "old kernel",
+		meminfo: "MemTotal:       1000 kB\nMemFree:         100 kB\nBuffers:          50 kB\nCached:          350 kB\n",
+		want:    telemetry.MemorySample{Total: 1024000, Available: 512000, UsedPercent: 50},
+	}, {
+		name:    "empty",
+		meminfo: "",
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			proc := t.TempDir()
+			writeProc(t, proc, map[string]string{"stat": "cpu  1 0 0 1\n", "meminfo": c.meminfo, "net/dev": ""})
+			src := telemetry.HostMetrics(telemetry.HostMetricsConfiguration{ProcPath: proc, Disks: []string{proc}})
+			s := readHost(t, src)
+			if s.Memory.Total != c.want.Total || s.Memory.Available != c.want.Available || !near(s.Memory.UsedPercent, c.want.UsedPercent) {
+				t.Errorf("memory %+v, want %+v", s.Memory, c.want)
+			}
+		})
+	}
+}
+
+func TestHostMetricsNetwork(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		interfaces []string
+		want       map[string][2]uint64
+	}{{
+		name: "default",
+		want: map[string][2]uint64{"eth0": {1000, 2000}, "wlan0": {3000, 4000}},
+	}, {
+		name:       "selected",
+		interfaces: []string{"lo", "wlan0", "missing"},
+		want:       map[string][2]uint64{"lo": {5000, 5000}, "wlan0": {3000, 4000}},
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			proc := t.TempDir()
+			writeProc(t, proc, map[string]string{"stat": "cpu  1 0 0 1\n", "meminfo": "", "net/dev": netDev})
+			src := telemetry.HostMetrics(telemetry.HostMetricsConfiguration{
+				ProcPath:   proc,
+				Disks:      []string{proc},
+				Interfaces: c.interfaces,
+			})
+			s := readHost(t, src)
+			if len(s.Network) != len(c.want) {
+				t.Fatalf("network %+v, want %v", s.Network, c.want)
+			}
+			for name, want := range c.want {
+				n := s.Network[name]
+				if n.RxBytes != want[0] || n.TxBytes != want[1] || n.RxRate != 0 || n.TxRate != 0 {
+					t.Errorf("%s %+v, want %v", name, n, want)
+				}
+			}
+
+			// Rates are computed from the second read.
+			writeProc(t, proc, map[string]string{"net/dev": strings.NewReplacer("1000 ", "1500 ", "3000 ", "3500 ").Replace(netDev)})
+			s = readHost(t, src)
+			for name := range c.want {
+				if n := s.Network[name]; name != "lo" && n.RxRate <= 0 {
+					t.Errorf("%s %+v, want a receive rate", name, n)
+				}
+			}
+		})
+	}
+}
+
+func TestHostMetricsDisks(t *testing.T) {
+	proc := t.TempDir()
+	writeProc(t, proc, map[string]string{"stat": "cpu  1 0 0 1\n", "meminfo": "", "net/dev": ""})
+	src := telemetry.HostMetrics(telemetry.HostMetricsConfiguration{ProcPath: proc, Disks: []string{"/", proc}})
+	s := readHost(t, src)
+	for _, path := range []string{"/", proc} {
+		d, ok := s.Disks[path]
+		if !ok || d.Total == 0 || d.Free > d.Total || d.UsedPercent < 0 || d.UsedPercent > 100 {
+			t.Errorf("disk %s %+v", path, d)
+		}
+	}
+
+	src = telemetry.HostMetrics(telemetry.HostMetricsConfiguration{ProcPath: proc, Disks: []string{filepath.Join(proc, "missing")}})
+	if _, err := src.Read(context.Background()); err == nil {
+		t.Error("Read() of a missing disk succeeded")
+	}
+}
+
+func TestHostMetricsErrors(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		files map[string]string
+	}{
+		{"no cpu line", map[string]string{"stat": "intr 1 2 3\n", "meminfo": "", "net/dev": ""}},
+		{"invalid cpu", map[string]string{"stat": "cpu  1 x 0 1\n", "meminfo": "", "net/dev": ""}},
+		{"no meminfo", map[string]string{"stat": "cpu  1 0 0 1\n", "net/dev": ""}},
+		{"no net/dev", map[string]string{"stat": "cpu  1 0 0 1\n", "meminfo": ""}},
+		{"invalid net/dev", map[string]string{"stat": "cpu  1 0 0 1\n", "meminfo": "", "net/dev": "eth0: x 0 0 0 0 0 0 0 1 0 0 0 0 0 0 0\n"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			proc := t.TempDir()
+			writeProc(t, proc, c.files)
+			src := telemetry.HostMetrics(telemetry.HostMetricsConfiguration{ProcPath: proc, Disks: []string{proc}})
+			if _, err := src.Read(context.Background()); err == nil {
+				t.Error("Read() succeeded")
+			}
+		})
+	}
+
+	src := telemetry.HostMetrics(telemetry.HostMetricsConfiguration{ProcPath: t.TempDir()})
+	if err := src.Start(context.Background()); err == nil {
+		t.Error("Start() without procfs succeeded")
+	}
+}
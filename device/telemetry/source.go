@@ -0,0 +1,28 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNoSample is returned by Source.Read when there is no new value, for
+// example no new lines in a tailed file. The stream skips the sample.
+var ErrNoSample = errors.New("no new sample")
+
+// Source produces the values of a stream. The publisher calls Start once
+// before the first Read, Read at the interval of the stream and Stop when
+// it stops, all from the same goroutine.
+type Source interface {
+	Start(ctx context.Context) error
+	Read(ctx context.Context) (interface{}, error)
+	Stop() error
+}
+
+// SampleFunc is a Source that needs no setup: Read calls the function.
+type SampleFunc func(ctx context.Context) (interface{}, error)
+
+func (f SampleFunc) Start(ctx context.Context) error { return nil }
+
+func (f SampleFunc) Read(ctx context.Context) (interface{}, error) { return f(ctx) }
+
+func (f SampleFunc) Stop() error { return nil }
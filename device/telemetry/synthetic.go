@@ -0,0 +1,67 @@
+package telemetry
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// SyntheticConfiguration configures the Synthetic source.
+type SyntheticConfiguration struct {
+	// Fields are the names of the generated values. It defaults to
+	// temperature and humidity.
+	Fields []string
+	// Min and Max bound the values. They default to 0 and 100.
+	Min, Max float64
+	// Seed makes the values repeatable. Zero seeds from the clock.
+	Seed int64
+}
+
+type synthetic struct {
+	config SyntheticConfiguration
+	rand   *rand.Rand
+	values map[string]float64
+}
+
+// Synthetic returns a Source of made up values for demos and load tests.
+// Every field follows a random walk between Min and Max.
+func Synthetic(config SyntheticConfiguration) Source {
+	if len(config.Fields) == 0 {
+		config.Fields = []string{"temperature", "humidity"}
+	}
+	if config.Max <= config.Min {
+		config.Min, config.Max = 0, 100
+	}
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	return &synthetic{config: config}
+}
+
+func (s *synthetic) Start(ctx context.Context) error {
+	s.rand = rand.New(rand.NewSource(s.config.Seed))
+	span := s.config.Max - s.config.Min
+	s.values = make(map[string]float64, len(s.config.Fields))
+	for _, f := range s.config.Fields {
+		s.values[f] = s.config.Min + span*(0.25+0.5*s.rand.Float64())
+	}
+	return nil
+}
+
+func (s *synthetic) Read(ctx context.Context) (interface{}, error) {
+	span := s.config.Max - s.config.Min
+	sample := make(map[string]float64, len(s.values))
+	for _, f := range s.config.Fields {
+		// Steps of up to 2% of the range, rounded to two decimals.
+		v := s.values[f] + span*0.02*(2*s.rand.Float64()-1)
+		v = math.Max(s.config.Min, math.Min(s.config.Max, v))
+		s.values[f] = v
+		sample[f] = math.Round(v*100) / 100
+	}
+	return sample, nil
+}
+
+func (s *synthetic) Stop() error {
+	return nil
+}
@@ -0,0 +1,150 @@
+package telemetry
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const defaultTailMaxLines = 1000
+
+// TailConfiguration configures the Tail source.
+type TailConfiguration struct {
+	Path string
+	// FromStart reads the lines already in the file on start instead of
+	// only the lines appended later.
+	FromStart bool
+	// MaxLines is the most lines returned by one read. Further lines are
+	// returned by the following reads. It defaults to 1000.
+	MaxLines int
+}
+
+type tail struct {
+	config TailConfiguration
+
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	offset  int64
+	partial string
+}
+
+// Tail returns a Source of the lines appended to a file, like tail -F.
+// Each read returns the complete lines appended since the previous read
+// as a []string, or ErrNoSample if there are none. A file that is
+// truncated or replaced, e.g. by log rotation, is read from its start.
+func Tail(config TailConfiguration) Source {
+	if config.MaxLines <= 0 {
+		config.MaxLines = defaultTailMaxLines
+	}
+	return &tail{config: config}
+}
+
+func (t *tail) Start(ctx context.Context) error {
+	if err := t.open(); err != nil {
+		return err
+	}
+	if t.config.FromStart {
+		return nil
+	}
+	offset, err := t.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("tailing %s %v", t.config.Path, err)
+	}
+	t.offset = offset
+	t.reader.Reset(t.file)
+	return nil
+}
+
+func (t *tail) open() error {
+	f, err := os.Open(t.config.Path)
+	if err != nil {
+		return fmt.Errorf("tailing %s %v", t.config.Path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("tailing %s %v", t.config.Path, err)
+	}
+	if t.file != nil {
+		t.file.Close()
+	}
+	t.file, t.info, t.offset, t.partial = f, info, 0, ""
+	t.reader = bufio.NewReader(f)
+	return nil
+}
+
+func (t *tail) Read(ctx context.Context) (interface{}, error) {
+	lines, err := t.lines(nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) < t.config.MaxLines {
+		if err := t.reopen(); err != nil {
+			return nil, err
+		}
+		if lines, err = t.lines(lines); err != nil {
+			return nil, err
+		}
+	}
+	if len(lines) == 0 {
+		return nil, ErrNoSample
+	}
+	return lines, nil
+}
+
+// reopen switches to the file now at the path if it was replaced, or
+// starts over if the file was truncated.
+func (t *tail) reopen() error {
+	info, err := os.Stat(t.config.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Rotated and not created again yet.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("tailing %s %v", t.config.Path, err)
+	}
+	if !os.SameFile(info, t.info) {
+		return t.open()
+	}
+	if info.Size() < t.offset {
+		if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("tailing %s %v", t.config.Path, err)
+		}
+		t.offset, t.partial = 0, ""
+		t.reader.Reset(t.file)
+	}
+	return nil
+}
+
+// lines appends the complete lines available in the file to lines.
+func (t *tail) lines(lines []string) ([]string, error) {
+	for len(lines) < t.config.MaxLines {
+		s, err := t.reader.ReadString('\n')
+		t.offset += int64(len(s))
+		if err == io.EOF {
+			t.partial += s
+			return lines, nil
+		}
+		if err != nil {
+			return lines, fmt.Errorf("tailing %s %v", t.config.Path, err)
+		}
+		line := strings.TrimRight(t.partial+s, "\r\n")
+		t.partial = ""
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+func (t *tail) Stop() error {
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
@@ -0,0 +1,122 @@
+package telemetry_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/randyridgley/simple-go-iot-device/device/telemetry"
+)
+
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTail starts a Tail source of path that is stopped by the test
+// cleanup.
+func startTail(t *testing.T, config telemetry.TailConfiguration) telemetry.Source {
+	t.Helper()
+	src := telemetry.Tail(config)
+	if err := src.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { src.Stop() })
+	return src
+}
+
+// expectLines reads src and checks it returned want, or ErrNoSample if
+// want is empty.
+func expectLines(t *testing.T, src telemetry.Source, want ...string) {
+	t.Helper()
+	v, err := src.Read(context.Background())
+	if len(want) == 0 {
+		if !errors.Is(err, telemetry.ErrNoSample) {
+			t.Errorf("Read() = %v, %v, want %v", v, err, telemetry.ErrNoSample)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("Read() = %q, want %q", v, want)
+	}
+}
+
+func TestTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendFile(t, path, "old\n")
+	src := startTail(t, telemetry.TailConfiguration{Path: path})
+
+	expectLines(t, src)
+	appendFile(t, path, "one\ntwo\r\nthr")
+	expectLines(t, src, "one", "two")
+	// A partial line is returned once it is complete.
+	expectLines(t, src)
+	appendFile(t, path, "ee\n")
+	expectLines(t, src, "three")
+}
+
+func TestTailFromStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendFile(t, path, "one\ntwo\nthree\n")
+	src := startTail(t, telemetry.TailConfiguration{Path: path, FromStart: true, MaxLines: 2})
+
+	expectLines(t, src, "one", "two")
+	expectLines(t, src, "three")
+	expectLines(t, src)
+}
+
+func TestTailTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendFile(t, path, "old line\n")
+	src := startTail(t, telemetry.TailConfiguration{Path: path})
+
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "new\n")
+	expectLines(t, src, "new")
+	appendFile(t, path, "next\n")
+	expectLines(t, src, "next")
+}
+
+func TestTailRotated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "old\n")
+	src := startTail(t, telemetry.TailConfiguration{Path: path})
+
+	// Lines written before the rotation are read before the new file.
+	appendFile(t, path, "last\n")
+	if err := os.Rename(path, filepath.Join(dir, "app.log.1")); err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, src, "last")
+	// The path is missing until the new file is created.
+	expectLines(t, src)
+
+	appendFile(t, path, "first\n")
+	expectLines(t, src, "first")
+	appendFile(t, filepath.Join(dir, "app.log.1"), "late\n")
+	appendFile(t, path, "second\n")
+	expectLines(t, src, "second")
+}
+
+func TestTailMissing(t *testing.T) {
+	src := telemetry.Tail(telemetry.TailConfiguration{Path: filepath.Join(t.TempDir(), "app.log")})
+	if err := src.Start(context.Background()); err == nil {
+		t.Error("Start() of a missing file succeeded")
+	}
+}
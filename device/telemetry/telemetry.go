@@ -0,0 +1,466 @@
+// Package telemetry samples named streams of values and publishes them
+// through the connection of a thing, optionally batched into a single
+// message and compressed.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/codec"
+	"github.com/randyridgley/simple-go-iot-device/device/connect"
+)
+
+// publishTimeout bounds the wait for the broker to acknowledge a message.
+const publishTimeout = 30 * time.Second
+
+var (
+	// ErrUnknownStream is returned by Publish for streams that were not
+	// added.
+	ErrUnknownStream = errors.New("unknown telemetry stream")
+	// ErrStreamExists is returned by Add for a name that is already used.
+	ErrStreamExists = errors.New("telemetry stream already exists")
+	// ErrStopped is returned by Publish once Run flushed the stream.
+	ErrStopped = errors.New("telemetry stream stopped")
+)
+
+// Stream is a named series of samples published to a topic.
+type Stream struct {
+	Name string
+	// Topic is a template of the topic, see Expand. It may use the
+	// variables {thingName}, {serialNumber}, {deviceLocation} and
+	// {stream}.
+	Topic string
+	// Interval is the time between reads of Source. With a zero interval
+	// or no source the stream only publishes values passed to
+	// Publisher.Publish.
+	Interval time.Duration
+	Source   Source
+	// Codec encodes the messages. It defaults to codec.JSON.
+	Codec codec.Codec
+	// Compression is CompressionNone, CompressionGzip or CompressionZstd.
+	Compression string
+	// Batch collects several samples into one message.
+	Batch Batch
+	// PublishOptions are passed to every publish of the stream.
+	PublishOptions []connect.PublishOption
+	// BasicIngestRule sends the messages straight to the named AWS IoT
+	// rule with Basic Ingest instead of through the broker, see
+	// connect.WithBasicIngest.
+	BasicIngestRule string
+}
+
+// Batch controls how samples are collected into messages. A batch is
+// published once it holds MaxCount samples, would grow beyond MaxBytes
+// or its first sample is MaxDelay old. With all limits zero every sample
+// is published as a message of its own.
+type Batch struct {
+	MaxCount int
+	// MaxBytes limits the encoded size of a batch before compression.
+	MaxBytes int
+	MaxDelay time.Duration
+}
+
+func (b Batch) enabled() bool {
+	return b.MaxCount > 1 || b.MaxBytes > 0 || b.MaxDelay > 0
+}
+
+// Sample is a value of a batched stream with the time it was taken in
+// milliseconds since the epoch.
+type Sample struct {
+	Timestamp int64       `json:"timestamp"`
+	Value     interface{} `json:"value"`
+}
+
+// Message is the payload of a batched stream. Streams without batching
+// publish the sampled value itself.
+type Message struct {
+	Stream  string   `json:"stream"`
+	Samples []Sample `json:"samples"`
+}
+
+// StreamStats are the counters of a stream.
+type StreamStats struct {
+	Samples  uint64
+	Messages uint64
+	// Bytes is the size of the published payloads after compression.
+	Bytes    uint64
+	Failures uint64
+	LastSent time.Time
+}
+
+// Publisher publishes the samples of telemetry streams.
+type Publisher interface {
+	// Add registers stream. Streams added after Run was called are not
+	// sampled.
+	Add(stream Stream) error
+	// Publish adds value as a sample of the named stream, for values
+	// that are not sampled at an interval. Publishes the broker does not
+	// acknowledge are reported to the OnError handler. Once Run is done
+	// it fails with ErrStopped.
+	Publish(name string, value interface{}) error
+	// Run samples the streams until ctx is done, then publishes the
+	// batches that are still open and waits for their acknowledgements.
+	Run(ctx context.Context) error
+	// Stats returns the counters of every stream.
+	Stats() map[string]StreamStats
+	// OnError sets handler of sampling and publishing errors.
+	OnError(handler func(error))
+}
+
+type publisher struct {
+	thing device.Thing
+
+	mu      sync.Mutex
+	streams map[string]*stream
+	order   []*stream
+	onError func(error)
+}
+
+type stream struct {
+	Stream
+	topic string
+	p     *publisher
+
+	mu       sync.Mutex
+	pending  []Sample
+	size     int
+	deadline time.Time
+	stats    StreamStats
+	wake     chan struct{}
+	// closed is set under mu before waiting for inflight, so no publish
+	// is added to it during the wait.
+	closed   bool
+	inflight sync.WaitGroup
+}
+
+// New creates a Publisher that publishes with the connection of thing.
+func New(thing device.Thing) Publisher {
+	return &publisher{
+		thing:   thing,
+		streams: make(map[string]*stream),
+	}
+}
+
+func (p *publisher) Add(s Stream) error {
+	if s.Name == "" {
+		return fmt.Errorf("telemetry stream has no name")
+	}
+	if s.Codec == nil {
+		s.Codec = codec.JSON
+	}
+	if s.Compression == "none" {
+		s.Compression = CompressionNone
+	}
+	if err := checkCompression(s.Compression); err != nil {
+		return fmt.Errorf("stream %s %v", s.Name, err)
+	}
+	if s.Codec == codec.Protobuf && s.Batch.enabled() {
+		return fmt.Errorf("stream %s: the protobuf codec cannot encode batches", s.Name)
+	}
+	topic, err := Expand(s.Topic, p.variables(s.Name))
+	if err != nil {
+		return fmt.Errorf("stream %s %v", s.Name, err)
+	}
+	if s.BasicIngestRule != "" {
+		if _, err := connect.BasicIngestTopic(s.BasicIngestRule, topic); err != nil {
+			return fmt.Errorf("stream %s %v", s.Name, err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.streams[s.Name]; ok {
+		return fmt.Errorf("stream %s: %w", s.Name, ErrStreamExists)
+	}
+	st := &stream{Stream: s, topic: topic, p: p, wake: make(chan struct{}, 1)}
+	p.streams[s.Name] = st
+	p.order = append(p.order, st)
+	return nil
+}
+
+// variables returns the values of the topic variables of stream name.
+func (p *publisher) variables(name string) map[string]string {
+	return map[string]string{
+		"thingName":      p.thing.Config.ThingName,
+		"serialNumber":   p.thing.Config.SerialNumber,
+		"deviceLocation": p.thing.Config.DeviceLocation,
+		"stream":         name,
+	}
+}
+
+func (p *publisher) Publish(name string, value interface{}) error {
+	p.mu.Lock()
+	s, ok := p.streams[name]
+	p.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("stream %s: %w", name, ErrUnknownStream)
+	}
+	return s.add(value)
+}
+
+func (p *publisher) Run(ctx context.Context) error {
+	p.mu.Lock()
+	streams := append([]*stream(nil), p.order...)
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		go func(s *stream) {
+			defer wg.Done()
+			s.run(ctx)
+			s.close()
+			s.inflight.Wait()
+		}(s)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (p *publisher) Stats() map[string]StreamStats {
+	p.mu.Lock()
+	streams := append([]*stream(nil), p.order...)
+	p.mu.Unlock()
+	stats := make(map[string]StreamStats, len(streams))
+	for _, s := range streams {
+		s.mu.Lock()
+		stats[s.Name] = s.stats
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+func (p *publisher) OnError(handler func(error)) {
+	p.mu.Lock()
+	p.onError = handler
+	p.mu.Unlock()
+}
+
+func (p *publisher) handleError(err error) {
+	p.mu.Lock()
+	cb := p.onError
+	p.mu.Unlock()
+	if cb == nil {
+		fmt.Println(err)
+		return
+	}
+	cb(err)
+}
+
+// run samples s at its interval and publishes batches whose delay ran
+// out until ctx is done.
+func (s *stream) run(ctx context.Context) {
+	var tick <-chan time.Time
+	if s.Interval > 0 && s.Source != nil {
+		if err := s.Source.Start(ctx); err != nil {
+			s.p.handleError(fmt.Errorf("starting source of %s %v", s.Name, err))
+		} else {
+			defer s.stop()
+			ticker := time.NewTicker(s.Interval)
+			defer ticker.Stop()
+			tick = ticker.C
+			s.sample(ctx)
+		}
+	}
+
+	for {
+		s.mu.Lock()
+		deadline := s.deadline
+		s.mu.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			expired = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			s.flush()
+			return
+		case <-tick:
+			s.sample(ctx)
+		case <-expired:
+			s.flush()
+		case <-s.wake:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (s *stream) sample(ctx context.Context) {
+	v, err := s.Source.Read(ctx)
+	if errors.Is(err, ErrNoSample) {
+		return
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			s.p.handleError(fmt.Errorf("sampling %s %v", s.Name, err))
+		}
+		return
+	}
+	if err := s.add(v); err != nil {
+		s.p.handleError(err)
+	}
+}
+
+// close rejects further samples and publishes.
+func (s *stream) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
+
+func (s *stream) stop() {
+	if err := s.Source.Stop(); err != nil {
+		s.p.handleError(fmt.Errorf("stopping source of %s %v", s.Name, err))
+	}
+}
+
+// add appends a sample of value and publishes the batch once it is full.
+func (s *stream) add(value interface{}) error {
+	if !s.Batch.enabled() {
+		s.mu.Lock()
+		s.stats.Samples++
+		s.mu.Unlock()
+		return s.send(value)
+	}
+
+	sample := Sample{Timestamp: time.Now().UnixNano() / int64(time.Millisecond), Value: value}
+	data, err := s.Codec.Marshal(sample)
+	if err != nil {
+		return fmt.Errorf("encoding sample of %s %v", s.Name, err)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return fmt.Errorf("stream %s: %w", s.Name, ErrStopped)
+	}
+	s.stats.Samples++
+	var full []Sample
+	if s.Batch.MaxBytes > 0 && len(s.pending) > 0 && s.size+len(data) > s.Batch.MaxBytes {
+		full = s.take()
+	}
+	s.pending = append(s.pending, sample)
+	s.size += len(data)
+	if len(s.pending) == 1 && s.Batch.MaxDelay > 0 {
+		s.deadline = time.Now().Add(s.Batch.MaxDelay)
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	var next []Sample
+	if (s.Batch.MaxCount > 0 && len(s.pending) >= s.Batch.MaxCount) ||
+		(s.Batch.MaxBytes > 0 && s.size >= s.Batch.MaxBytes) {
+		next = s.take()
+	}
+	s.mu.Unlock()
+
+	for _, batch := range [][]Sample{full, next} {
+		if batch == nil {
+			continue
+		}
+		if err := s.send(&Message{Stream: s.Name, Samples: batch}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// take removes the pending samples. The caller holds s.mu.
+func (s *stream) take() []Sample {
+	batch := s.pending
+	s.pending = nil
+	s.size = 0
+	s.deadline = time.Time{}
+	return batch
+}
+
+// flush publishes the pending samples.
+func (s *stream) flush() {
+	s.mu.Lock()
+	batch := s.take()
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	if err := s.send(&Message{Stream: s.Name, Samples: batch}); err != nil {
+		s.p.handleError(err)
+	}
+}
+
+// send encodes, compresses and publishes v.
+func (s *stream) send(v interface{}) error {
+	data, err := s.Codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding %s %v", s.Name, err)
+	}
+	data, err = compress(s.Compression, data)
+	if err != nil {
+		return fmt.Errorf("compressing %s %v", s.Name, err)
+	}
+
+	// Telemetry is kept in the outbound queue while offline.
+	opts := append([]connect.PublishOption{connect.WithContentType(s.Codec.ContentType()), connect.WithQueue()}, s.PublishOptions...)
+	if s.Compression != CompressionNone {
+		opts = append(opts, connect.WithUserProperty("content-encoding", s.Compression))
+	}
+	if s.BasicIngestRule != "" {
+		opts = append(opts, connect.WithBasicIngest(s.BasicIngestRule))
+	}
+	conn := s.p.thing.Connection
+	if conn == nil {
+		s.fail()
+		return fmt.Errorf("publishing %s %v", s.Name, connect.ErrClosed)
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return fmt.Errorf("stream %s: %w", s.Name, ErrStopped)
+	}
+	s.inflight.Add(1)
+	s.mu.Unlock()
+	token := conn.Publish(s.topic, data, opts...)
+	// Waiting for the acknowledgement would hold up sampling.
+	go s.await(token, len(data))
+	return nil
+}
+
+// await counts the publish of token once the broker acknowledged it, and
+// as a failure if it did not within publishTimeout.
+func (s *stream) await(token mqtt.Token, size int) {
+	defer s.inflight.Done()
+	err := connect.ErrTimeout
+	if token.WaitTimeout(publishTimeout) {
+		err = token.Error()
+	}
+	if err != nil {
+		s.fail()
+		s.p.handleError(fmt.Errorf("publishing %s %v", s.Name, err))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Messages++
+	s.stats.Bytes += uint64(size)
+	s.stats.LastSent = time.Now()
+}
+
+func (s *stream) fail() {
+	s.mu.Lock()
+	s.stats.Failures++
+	s.mu.Unlock()
+}
@@ -0,0 +1,309 @@
+package telemetry_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/randyridgley/simple-go-iot-device/device"
+	"github.com/randyridgley/simple-go-iot-device/device/connect/connecttest"
+	"github.com/randyridgley/simple-go-iot-device/device/telemetry"
+)
+
+const (
+	thingName = "thing-1"
+	topic     = "fleet/123/metrics"
+)
+
+// newPublisher creates a publisher of a thing connected to a broker.
+func newPublisher(t *testing.T) (telemetry.Publisher, *connecttest.Broker, *connecttest.Connection) {
+	t.Helper()
+	broker := connecttest.NewBroker()
+	conn := broker.Connection(thingName)
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	thing := device.Thing{Connection: conn, Config: device.ThingConfiguration{
+		ThingName:    thingName,
+		SerialNumber: "123",
+	}}
+	return telemetry.New(thing), broker, conn
+}
+
+// start runs p until the returned function is called, which waits for Run
+// to return.
+func start(t *testing.T, p telemetry.Publisher) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.Run(ctx) }()
+	stopped := false
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run() = %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Run() did not return")
+		}
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func TestPublishWhileStopping(t *testing.T) {
+	p, _, _ := newPublisher(t)
+	for _, s := range []telemetry.Stream{
+		{Name: "single", Topic: "fleet/{serialNumber}/{stream}"},
+		{Name: "batched", Topic: "fleet/{serialNumber}/{stream}", Batch: telemetry.Batch{MaxCount: 3}},
+	} {
+		if err := p.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop := start(t, p)
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for {
+			err := p.Publish("single", 1)
+			if berr := p.Publish("batched", 1); err == nil {
+				err = berr
+			}
+			if errors.Is(err, telemetry.ErrStopped) {
+				return
+			}
+			if err != nil {
+				t.Errorf("Publish() = %v", err)
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	stop()
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("Publish() was not rejected after Run returned")
+	}
+	if err := p.Publish("single", 1); !errors.Is(err, telemetry.ErrStopped) {
+		t.Errorf("Publish() after Run = %v, want %v", err, telemetry.ErrStopped)
+	}
+}
+
+// addStream adds a stream named metrics that publishes to topic.
+func addStream(t *testing.T, p telemetry.Publisher, s telemetry.Stream) {
+	t.Helper()
+	s.Name = "metrics"
+	s.Topic = "fleet/{serialNumber}/{stream}"
+	if err := p.Add(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func publish(t *testing.T, p telemetry.Publisher, values ...int) {
+	t.Helper()
+	for _, v := range values {
+		if err := p.Publish("metrics", v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// batches decodes the batches published to topic into their values.
+func batches(t *testing.T, broker *connecttest.Broker) [][]float64 {
+	t.Helper()
+	var values [][]float64
+	for _, msg := range broker.Messages(topic) {
+		var m telemetry.Message
+		if err := json.Unmarshal(msg.Payload(), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Stream != "metrics" {
+			t.Errorf("batch of stream %q", m.Stream)
+		}
+		batch := []float64{}
+		for _, s := range m.Samples {
+			if s.Timestamp == 0 {
+				t.Error("sample without timestamp")
+			}
+			batch = append(batch, s.Value.(float64))
+		}
+		values = append(values, batch)
+	}
+	return values
+}
+
+func expectBatches(t *testing.T, broker *connecttest.Broker, want ...[]float64) {
+	t.Helper()
+	got := batches(t, broker)
+	if len(got) != len(want) {
+		t.Fatalf("published %v, want %v", got, want)
+	}
+	for i := range want {
+		if len(got[i]) != len(want[i]) {
+			t.Fatalf("published %v, want %v", got, want)
+		}
+		for j := range want[i] {
+			if got[i][j] != want[i][j] {
+				t.Fatalf("published %v, want %v", got, want)
+			}
+		}
+	}
+}
+
+func TestUnbatched(t *testing.T) {
+	p, broker, _ := newPublisher(t)
+	addStream(t, p, telemetry.Stream{})
+	publish(t, p, 1, 2)
+
+	msgs := broker.Messages(topic)
+	if len(msgs) != 2 || string(msgs[0].Payload()) != "1" || string(msgs[1].Payload()) != "2" {
+		t.Errorf("published %v", msgs)
+	}
+}
+
+func TestBatchMaxCount(t *testing.T) {
+	p, broker, _ := newPublisher(t)
+	addStream(t, p, telemetry.Stream{Batch: telemetry.Batch{MaxCount: 3}})
+	stop := start(t, p)
+
+	publish(t, p, 1, 2)
+	expectBatches(t, broker)
+	publish(t, p, 3, 4)
+	expectBatches(t, broker, []float64{1, 2, 3})
+
+	// The open batch is published when Run stops.
+	stop()
+	expectBatches(t, broker, []float64{1, 2, 3}, []float64{4})
+}
+
+func TestBatchMaxBytes(t *testing.T) {
+	p, broker, _ := newPublisher(t)
+	// A sample like {"timestamp":1700000000000,"value":1} takes 38 bytes,
+	// so two fit into a batch.
+	addStream(t, p, telemetry.Stream{Batch: telemetry.Batch{MaxBytes: 100}})
+	stop := start(t, p)
+
+	publish(t, p, 1, 2)
+	expectBatches(t, broker)
+	publish(t, p, 3)
+	expectBatches(t, broker, []float64{1, 2})
+	stop()
+	expectBatches(t, broker, []float64{1, 2}, []float64{3})
+}
+
+func TestBatchMaxDelay(t *testing.T) {
+	p, broker, _ := newPublisher(t)
+	addStream(t, p, telemetry.Stream{Batch: telemetry.Batch{MaxCount: 10, MaxDelay: 50 * time.Millisecond}})
+	start(t, p)
+
+	publish(t, p, 1, 2)
+	expectBatches(t, broker)
+	deadline := time.Now().Add(time.Second)
+	for len(broker.Messages(topic)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("batch was not published after MaxDelay")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	expectBatches(t, broker, []float64{1, 2})
+}
+
+func TestCompression(t *testing.T) {
+	zstdDecoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zstdDecoder.Close()
+	for compression, decompress := range map[string]func([]byte) ([]byte, error){
+		telemetry.CompressionGzip: func(data []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(r)
+		},
+		telemetry.CompressionZstd: func(data []byte) ([]byte, error) {
+			return zstdDecoder.DecodeAll(data, nil)
+		},
+	} {
+		t.Run(compression, func(t *testing.T) {
+			p, broker, _ := newPublisher(t)
+			addStream(t, p, telemetry.Stream{Compression: compression, Batch: telemetry.Batch{MaxCount: 2}})
+			publish(t, p, 1, 2)
+
+			msgs := broker.Messages(topic)
+			if len(msgs) != 1 {
+				t.Fatalf("published %d messages, want 1", len(msgs))
+			}
+			data, err := decompress(msgs[0].Payload())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m telemetry.Message
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatal(err)
+			}
+			if len(m.Samples) != 2 || m.Samples[0].Value != 1.0 || m.Samples[1].Value != 2.0 {
+				t.Errorf("decompressed %s", data)
+			}
+		})
+	}
+}
+
+func TestUnacknowledgedPublish(t *testing.T) {
+	p, _, conn := newPublisher(t)
+	addStream(t, p, telemetry.Stream{})
+	errs := make(chan error, 1)
+	p.OnError(func(err error) { errs <- err })
+	conn.Disconnect(0)
+
+	publish(t, p, 1)
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("failed publish was not reported")
+	}
+	stats := p.Stats()["metrics"]
+	if stats.Samples != 1 || stats.Failures != 1 || stats.Messages != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestAddRejects(t *testing.T) {
+	p, _, _ := newPublisher(t)
+	addStream(t, p, telemetry.Stream{})
+	for _, s := range []telemetry.Stream{
+		{Name: "metrics", Topic: "fleet/metrics"},
+		{Name: "", Topic: "fleet/metrics"},
+		{Name: "wildcard", Topic: "fleet/+/metrics"},
+		{Name: "compression", Topic: "fleet/metrics", Compression: "brotli"},
+		{Name: "rule", Topic: "fleet/metrics", BasicIngestRule: "not a rule"},
+	} {
+		if err := p.Add(s); err == nil {
+			t.Errorf("Add(%+v) succeeded", s)
+		}
+	}
+	if err := p.Add(telemetry.Stream{Name: "metrics", Topic: "fleet/metrics"}); !errors.Is(err, telemetry.ErrStreamExists) {
+		t.Errorf("Add() of an existing stream = %v, want %v", err, telemetry.ErrStreamExists)
+	}
+	if err := p.Publish("other", 1); !errors.Is(err, telemetry.ErrUnknownStream) {
+		t.Errorf("Publish() to an unknown stream = %v, want %v", err, telemetry.ErrUnknownStream)
+	}
+}
@@ -0,0 +1,47 @@
+package telemetry
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Expand replaces the variables in braces of the topic template with
+// their values, e.g. fleet/{serialNumber}/telemetry. Unknown variables,
+// empty levels and wildcards are errors.
+func Expand(template string, variables map[string]string) (string, error) {
+	var b strings.Builder
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			b.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed variable in topic %q", template)
+		}
+		name := rest[start+1 : start+end]
+		value, ok := variables[name]
+		if !ok {
+			return "", fmt.Errorf("unknown variable {%s} in topic %q", name, template)
+		}
+		b.WriteString(rest[:start])
+		b.WriteString(value)
+		rest = rest[start+end+1:]
+	}
+
+	topic := b.String()
+	if topic == "" {
+		return "", fmt.Errorf("topic %q is empty", template)
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return "", fmt.Errorf("topic %q contains a wildcard", topic)
+	}
+	for _, level := range strings.Split(topic, "/") {
+		if level == "" {
+			return "", fmt.Errorf("topic %q has an empty level", topic)
+		}
+	}
+	return topic, nil
+}
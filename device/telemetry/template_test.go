@@ -0,0 +1,37 @@
+package telemetry_test
+
+import (
+	"testing"
+
+	"github.com/randyridgley/simple-go-iot-device/device/telemetry"
+)
+
+func TestExpand(t *testing.T) {
+	variables := map[string]string{"thingName": "thing-1", "serialNumber": "123", "empty": "", "wildcard": "#"}
+	for _, c := range []struct {
+		template string
+		want     string
+	}{
+		{"fleet/telemetry", "fleet/telemetry"},
+		{"fleet/{serialNumber}/telemetry", "fleet/123/telemetry"},
+		{"{thingName}-{serialNumber}", "thing-1-123"},
+		{"fleet/{unknown}", ""},
+		{"fleet/{serialNumber", ""},
+		{"fleet/{empty}/telemetry", ""},
+		{"fleet/{wildcard}", ""},
+		{"fleet/+", ""},
+		{"fleet//telemetry", ""},
+		{"{empty}", ""},
+	} {
+		got, err := telemetry.Expand(c.template, variables)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("Expand(%q) = %q, want an error", c.template, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("Expand(%q) = %q, %v, want %q", c.template, got, err, c.want)
+		}
+	}
+}
@@ -17,15 +17,17 @@ package device
 
 import (
 	"fmt"
-	"os"
+	"io"
+	"time"
 
+	"github.com/randyridgley/simple-go-iot-device/device/codec"
 	"github.com/randyridgley/simple-go-iot-device/device/connect"
+	"github.com/randyridgley/simple-go-iot-device/device/keystore"
 )
 
 type Thing struct {
-	Connection  connect.Connection
-	Config      ThingConfiguration
-	isConnected bool
+	Connection connect.Connection
+	Config     ThingConfiguration
 }
 
 type ThingConfiguration struct {
@@ -33,11 +35,52 @@ type ThingConfiguration struct {
 	DeviceLocation       string
 	SerialNumber         string
 	ProvisioningTemplate string
+	CertificateMode      string
+	KeyAlgorithm         string
 	Endpoint             string
 	Port                 int
+	// ProvisioningCodec is the payload format of fleet provisioning,
+	// codec.JSON or codec.CBOR. It defaults to codec.JSON.
+	ProvisioningCodec codec.Codec
+	// Transport, Region and Credentials select MQTT over WebSockets
+	// signed with SigV4 instead of the client certificate.
+	Transport   string
+	Region      string
+	Credentials connect.CredentialsProvider
+	// ALPN and Fallback allow MQTT on port 443, see
+	// connect.ConnectionConfiguration.
+	ALPN     bool
+	Fallback bool
+	// Authorizer authenticates with an AWS IoT custom authorizer instead
+	// of the certificate.
+	Authorizer *connect.AuthorizerConfiguration
+	// ProtocolVersion selects MQTT 5 with 5 and MQTT 3.1.1 otherwise.
+	ProtocolVersion   int
+	TopicAliasMaximum uint16
+	// Will, KeepAlive, CleanSession and Reconnect are passed on to the
+	// connection.
+	Will         *connect.Will
+	KeepAlive    time.Duration
+	CleanSession bool
+	Reconnect    connect.ReconnectPolicy
+	// Keystore holds the credentials of the thing. It defaults to PEM
+	// files in the certs directory.
+	Keystore keystore.Keystore
+	// Queue configures the outbound queue of the primary connection.
+	Queue connect.QueueConfiguration
+	// Recording receives the messages published and received by the
+	// thing if set, see connect.Recorder.
+	Recording io.Writer
 }
 
 func New(config ThingConfiguration) (*Thing, error) {
+	if config.Keystore == nil {
+		ks, err := keystore.New(keystore.Configuration{})
+		if err != nil {
+			return nil, err
+		}
+		config.Keystore = ks
+	}
 	return &Thing{
 		Config: config,
 	}, nil
@@ -49,28 +92,70 @@ func (t *Thing) Connect(kp connect.KeyPair) error {
 		Endpoint: t.Config.Endpoint,
 		Port:     t.Config.Port,
 		ClientId: t.Config.ThingName,
+		Queue:    t.Config.Queue,
+
+		Transport:   t.Config.Transport,
+		Region:      t.Config.Region,
+		Credentials: t.Config.Credentials,
+		ALPN:        t.Config.ALPN,
+		Fallback:    t.Config.Fallback,
+		Authorizer:  t.Config.Authorizer,
+
+		Will:              t.Config.Will,
+		KeepAlive:         t.Config.KeepAlive,
+		CleanSession:      t.Config.CleanSession,
+		Reconnect:         t.Config.Reconnect,
+		TopicAliasMaximum: t.Config.TopicAliasMaximum,
 	}
 	// fmt.Print(conf)
-	c, err := connect.New(&conf)
-	c.Connect()
+	newConnection := connect.New
+	if t.Config.ProtocolVersion == 5 {
+		newConnection = connect.NewV5
+	}
+	c, err := newConnection(&conf)
 	if err != nil {
 		return fmt.Errorf("Could not create connection %v", err)
 	}
+	if t.Config.Recording != nil {
+		c = connect.NewRecorder(c, t.Config.Recording)
+	}
+	if err := c.Connect(); err != nil {
+		// Stops the goroutines of the connection, such as the queue.
+		c.Disconnect(0)
+		return fmt.Errorf("Could not connect to %s %v", t.Config.Endpoint, err)
+	}
 	t.Connection = c
 	fmt.Printf("Connected to %s\n", t.Config.Endpoint)
 	return nil
 }
 
+// IsConnected reports whether the connection of the thing is up.
+func (t *Thing) IsConnected() bool {
+	return t.Connection != nil && t.Connection.State() == connect.StateConnected
+}
+
+// UsesCertificate reports whether the thing authenticates with its client
+// certificate and therefore has to be provisioned.
+func (t *Thing) UsesCertificate() bool {
+	if t.Config.Authorizer != nil {
+		return false
+	}
+	return t.Config.Transport == "" || t.Config.Transport == connect.TransportMQTTS
+}
+
 func (t *Thing) IsProvisioned() bool {
-	for _, file := range []string{
-		"certs/root.ca.bundle.pem",
-		fmt.Sprintf("certs/%s.certificate.pem", t.Config.ThingName),
-		fmt.Sprintf("certs/%s.private.key", t.Config.ThingName),
-	} {
-		_, err := os.Stat(file)
-		if os.IsNotExist(err) {
-			return false
-		}
+	return t.Config.Keystore.Exists(t.Config.ThingName)
+}
+
+// KeyPair loads the credentials of the thing from its keystore.
+func (t *Thing) KeyPair(caCertificatePath string) (connect.KeyPair, error) {
+	c, err := t.Config.Keystore.Load(t.Config.ThingName)
+	if err != nil {
+		return connect.KeyPair{}, fmt.Errorf("loading credentials of %s %v", t.Config.ThingName, err)
 	}
-	return true
+	return connect.KeyPair{
+		CertificatePEM:    c.CertificatePEM,
+		PrivateKeyPEM:     c.PrivateKeyPEM,
+		CACertificatePath: caCertificatePath,
+	}, nil
 }
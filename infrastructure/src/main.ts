@@ -94,6 +94,7 @@ export class InfraStack extends Stack {
             Action: ['iot:Publish', 'iot:Receive'],
             Resource: [
               `arn:aws:iot:${Aws.REGION}:${Aws.ACCOUNT_ID}:topic/$aws/certificates/create/*`,
+              `arn:aws:iot:${Aws.REGION}:${Aws.ACCOUNT_ID}:topic/$aws/certificates/create-from-csr/*`,
               `arn:aws:iot:${Aws.REGION}:${Aws.ACCOUNT_ID}:topic/$aws/provisioning-templates/${templateName}/provision/*`,
             ],
           },
@@ -102,6 +103,7 @@ export class InfraStack extends Stack {
             Action: 'iot:Subscribe',
             Resource: [
               `arn:aws:iot:${Aws.REGION}:${Aws.ACCOUNT_ID}:topicfilter/$aws/certificates/create/*`,
+              `arn:aws:iot:${Aws.REGION}:${Aws.ACCOUNT_ID}:topicfilter/$aws/certificates/create-from-csr/*`,
               `arn:aws:iot:${Aws.REGION}:${Aws.ACCOUNT_ID}:topicfilter/$aws/provisioning-templates/${templateName}/provision/*`,
             ],
           },